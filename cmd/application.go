@@ -1,12 +1,12 @@
 package main
 
 import (
-	"fmt"
 	"log"
 
 	"github.com/go-git/go-git/v5"
 	"github.com/spf13/cobra"
 	"github.com/trustacks/trustacks/pkg/toolchain"
+	"helm.sh/helm/v3/pkg/cli/values"
 )
 
 // application cli command flags.
@@ -14,6 +14,10 @@ var (
 	applicationName   string
 	applicationConfig string
 	applicationForce  bool
+	applicationValues values.Options
+	applicationParams values.Options
+	applicationEnv    string
+	applicationBundle string
 )
 
 // applicationCmd contains subcommands for managing factories.
@@ -27,8 +31,17 @@ var applicationCreateCmd = &cobra.Command{
 	Use:   "create",
 	Short: "create a new application",
 	Run: func(cmd *cobra.Command, args []string) {
-		if err := toolchain.CreateApplication(applicationName, applicationForce, applicationConfig, git.PlainClone); err != nil {
-			fmt.Println(err)
+		vars, err := mergeValues(&applicationValues)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		params, err := mergeValues(&applicationParams)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		opts := &toolchain.ApplicationOptions{Vars: vars, Parameters: params, Env: applicationEnv, Bundle: applicationBundle}
+		if err := toolchain.CreateApplication(cmd.Context(), applicationName, applicationForce, applicationConfig, git.PlainClone, opts); err != nil {
+			logger.Fatal(err)
 		}
 	},
 }
@@ -45,6 +58,11 @@ func init() {
 		log.Fatal(err)
 	}
 	applicationCreateCmd.Flags().BoolVar(&applicationForce, "force", false, "force update (experimental: use at your own risk)")
+	addValuesFlags(applicationCreateCmd, &applicationValues, "application vars")
+	applicationCreateCmd.Flags().StringArrayVar(&applicationParams.Values, "set-param", []string{}, "set application parameters (can specify multiple or separate values with commas: key1=val1,key2=val2)")
+	applicationCreateCmd.Flags().StringVar(&applicationEnv, "env", "", "environment overlay (merges config.<env>.yaml over the config file)")
+
+	applicationCreateCmd.Flags().StringVar(&applicationBundle, "bundle", "", "create from an offline bundle")
 
 	rootCmd.AddCommand(applicationCmd)
 }
@@ -1,19 +1,70 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/trustacks/trustacks/pkg"
+	"github.com/trustacks/trustacks/pkg/toolchain"
+	"k8s.io/klog/v2"
 )
 
 var cliVersion string
 
+// global cli flags.
+var (
+	logLevel  string
+	logFormat string
+)
+
+// logger is the cli logger.
+var logger = logrus.New()
+
 // rootCmd is the cobra start command.
 var rootCmd = &cobra.Command{
 	Use:   "tsctl",
 	Short: "Trustacks is the workflow driven value steam delivery platform",
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		return configureLogging()
+	},
+}
+
+// configureLogging configures the cli logger from the global flags
+// and routes the toolchain, helm and client-go output through it.
+func configureLogging() error {
+	level, err := logrus.ParseLevel(logLevel)
+	if err != nil {
+		return err
+	}
+	logger.SetLevel(level)
+	switch logFormat {
+	case "text":
+		logger.SetFormatter(&logrus.TextFormatter{})
+	case "json":
+		logger.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return fmt.Errorf("unsupported log format '%s'", logFormat)
+	}
+	toolchain.SetLogger(logger)
+
+	// client-go logs through klog. route it through the logger and
+	// enable the request level output when tracing.
+	fs := flag.NewFlagSet("klog", flag.ContinueOnError)
+	klog.InitFlags(fs)
+	if level == logrus.TraceLevel {
+		if err := fs.Set("v", "6"); err != nil {
+			return err
+		}
+	}
+	klog.LogToStderr(false)
+	klog.SetOutput(logger.WithField("source", "client-go").WriterLevel(logrus.DebugLevel))
+	return nil
 }
 
 func main() {
@@ -21,7 +72,24 @@ func main() {
 		fmt.Printf("error setting path: %s\n", err)
 		os.Exit(1)
 	}
-	if err := rootCmd.Execute(); err != nil {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		// restore the default signal behavior so that a second
+		// interrupt terminates the process immediately.
+		signal.Stop(signals)
+		logger.Warn("interrupt received. cancelling the in-flight operations (interrupt again to force exit)")
+		cancel()
+	}()
+	if err := rootCmd.ExecuteContext(ctx); err != nil {
 		fmt.Printf("error executing the command: %s", err)
 	}
 }
+
+func init() {
+	rootCmd.PersistentFlags().StringVarP(&logLevel, "log-level", "v", "info", "log level (trace, debug, info, warn, error)")
+	rootCmd.PersistentFlags().StringVar(&logFormat, "log-format", "text", "log format (text, json)")
+}
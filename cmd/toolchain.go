@@ -6,10 +6,13 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/go-git/go-git/v5"
 	"github.com/spf13/cobra"
 	"github.com/trustacks/trustacks/pkg/toolchain"
+	"helm.sh/helm/v3/pkg/cli/values"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/util/homedir"
@@ -17,10 +20,24 @@ import (
 
 // toolchain cli command flags.
 var (
-	toolchainName       string
-	toolchainConfig     string
-	toolchainKubeconfig string
-	toolchainForce      bool
+	toolchainName        string
+	toolchainConfig      string
+	toolchainKubeconfig  string
+	toolchainForce       bool
+	toolchainYes         bool
+	toolchainValues      values.Options
+	toolchainEnv         string
+	toolchainBundle      string
+	toolchainOutput      string
+	toolchainFix         bool
+	toolchainArchive     string
+	toolchainAgeKey      string
+	toolchainBackupDest  string
+	toolchainBackupID    string
+	toolchainS3Options   toolchain.BackupOptions
+	toolchainNoPreflight bool
+	toolchainWait        bool
+	toolchainTimeout     time.Duration
 )
 
 // toolchainCmd contains subcommands for managing factories.
@@ -34,9 +51,62 @@ var toolchainInstallCmd = &cobra.Command{
 	Use:   "install",
 	Short: "install a toolchain",
 	Run: func(cmd *cobra.Command, args []string) {
-		if err := toolchain.Install(toolchainConfig, toolchainForce, git.PlainClone); err != nil {
-			fmt.Println(err)
-			os.Exit(1)
+		parameters, err := mergeValues(&toolchainValues)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		opts := &toolchain.InstallOptions{Confirm: confirm, Parameters: parameters, Env: toolchainEnv, Bundle: toolchainBundle, SkipPreflight: toolchainNoPreflight}
+		if toolchainWait {
+			opts.Wait = toolchainTimeout
+		}
+		if err := toolchain.Install(cmd.Context(), toolchainConfig, toolchainForce, git.PlainClone, opts); err != nil {
+			logger.Fatal(err)
+		}
+	},
+}
+
+// toolchainPreflightCmd checks the cluster targets before an install.
+var toolchainPreflightCmd = &cobra.Command{
+	Use:   "preflight",
+	Short: "check the cluster targets against the toolchain requirements",
+	Run: func(cmd *cobra.Command, args []string) {
+		opts := &toolchain.PreflightOptions{Env: toolchainEnv, Bundle: toolchainBundle}
+		results, err := toolchain.Preflight(cmd.Context(), toolchainConfig, git.PlainClone, opts)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		failed := 0
+		for _, result := range results {
+			fmt.Println(result)
+			if !result.Passed {
+				failed++
+			}
+		}
+		if failed > 0 {
+			logger.Fatalf("%d pre-flight check(s) failed", failed)
+		}
+		logger.Info("the pre-flight checks passed")
+	},
+}
+
+// toolchainBundleCmd creates an offline toolchain bundle.
+var toolchainBundleCmd = &cobra.Command{
+	Use:   "bundle",
+	Short: "create an offline toolchain bundle",
+	Run: func(cmd *cobra.Command, args []string) {
+		parameters, err := mergeValues(&toolchainValues)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		opts := &toolchain.BundleOptions{Parameters: parameters, Env: toolchainEnv}
+		images, err := toolchain.Bundle(cmd.Context(), toolchainConfig, toolchainOutput, git.PlainClone, opts)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		logger.Infof("the bundle has been written to %s", toolchainOutput)
+		fmt.Println("container images referenced by the toolchain:")
+		for _, image := range images {
+			fmt.Printf("  %s\n", image)
 		}
 	},
 }
@@ -45,36 +115,180 @@ var toolchainDestroyCmd = &cobra.Command{
 	Use:   "destroy",
 	Short: "destroy a toolchain",
 	Run: func(cmd *cobra.Command, args []string) {
-		stdin := bufio.NewReader(os.Stdin)
 		fmt.Println("\033[0;93mWARNING: \033[3mthis action is destructive\033[0m")
 		fmt.Printf("please type the name of the toolchain to proceed [\033[1;95m%s\033[0m]:\n> ", toolchainName)
 		line, _, err := stdin.ReadLine()
 		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
+			logger.Fatal(err)
 		}
 		if string(line) != toolchainName {
-			fmt.Println("the toolchain name did not match. aborting")
-			os.Exit(1)
+			logger.Fatal("the toolchain name did not match. aborting")
 		}
 		config, err := clientcmd.BuildConfigFromFlags("", toolchainKubeconfig)
 		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
+			logger.Fatal(err)
 		}
 		clientset, err := kubernetes.NewForConfig(config)
 		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
+			logger.Fatal(err)
+		}
+		if err := toolchain.Destory(cmd.Context(), toolchainName, clientset); err != nil {
+			logger.Fatal(err)
+		}
+		logger.Info("the toolchain has been deleted. the kubernetes resources will be cleaned up in the background")
+	},
+}
+
+// toolchainRepairCmd recovers the releases stuck in an intermediate
+// state.
+var toolchainRepairCmd = &cobra.Command{
+	Use:   "repair",
+	Short: "recover toolchain releases stuck in a pending state",
+	Run: func(cmd *cobra.Command, args []string) {
+		confirmFunc := confirm
+		if toolchainYes {
+			confirmFunc = func(string) bool { return true }
+		}
+		repaired, err := toolchain.Repair(cmd.Context(), toolchainName, confirmFunc)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		if len(repaired) == 0 {
+			logger.Info("no releases were repaired")
+			return
+		}
+		logger.Infof("repaired releases: %s", strings.Join(repaired, ", "))
+	},
+}
+
+// toolchainDriftCmd compares the toolchain releases with the live
+// objects.
+var toolchainDriftCmd = &cobra.Command{
+	Use:   "drift",
+	Short: "report the drift between the toolchain releases and the cluster",
+	Run: func(cmd *cobra.Command, args []string) {
+		drifted, err := toolchain.Drift(cmd.Context(), toolchainName, toolchainFix)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		if len(drifted) == 0 {
+			logger.Info("no drift was detected")
+			return
+		}
+		for _, d := range drifted {
+			fmt.Println(d)
+		}
+		if toolchainFix {
+			logger.Info("the drift has been fixed")
+			return
+		}
+		os.Exit(1)
+	},
+}
+
+// toolchainStatusCmd reports the release state and readiness of the
+// toolchain components.
+var toolchainStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "report the release state and health of the toolchain components",
+	Run: func(cmd *cobra.Command, args []string) {
+		statuses, err := toolchain.Status(cmd.Context(), toolchainName)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		notReady := 0
+		for _, status := range statuses {
+			fmt.Println(status)
+			if !status.Ready() {
+				notReady++
+			}
+		}
+		if notReady > 0 {
+			logger.Fatalf("%d component(s) are not ready", notReady)
+		}
+	},
+}
+
+// toolchainExportCmd exports the toolchain state to an archive.
+var toolchainExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "export the toolchain state for migrating to another cluster",
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := toolchain.Export(cmd.Context(), toolchainName, toolchainOutput, toolchainAgeKey); err != nil {
+			logger.Fatal(err)
+		}
+		logger.Infof("the toolchain has been exported to %s", toolchainOutput)
+		logger.Warnf("the secrets are encrypted with the age key written to %s. store it separately from the archive", toolchainAgeKey)
+	},
+}
+
+// toolchainImportCmd restores an exported toolchain.
+var toolchainImportCmd = &cobra.Command{
+	Use:   "import",
+	Short: "import an exported toolchain",
+	Run: func(cmd *cobra.Command, args []string) {
+		name, err := toolchain.Import(cmd.Context(), toolchainArchive, toolchainAgeKey, toolchainForce)
+		if err != nil {
+			logger.Fatal(err)
 		}
-		if err := toolchain.Destory(toolchainName, clientset); err != nil {
-			fmt.Println(err)
-			os.Exit(1)
+		logger.Infof("toolchain '%s' has been imported", name)
+	},
+}
+
+// toolchainBackupCmd backs up the component data.
+var toolchainBackupCmd = &cobra.Command{
+	Use:   "backup",
+	Short: "back up the persistent data of the toolchain components",
+	Run: func(cmd *cobra.Command, args []string) {
+		id, err := toolchain.Backup(cmd.Context(), toolchainName, toolchainBackupDest, &toolchainS3Options)
+		if err != nil {
+			logger.Fatal(err)
 		}
-		fmt.Println("the toolchain has been deleted. the kubernetes resources will be cleaned up in the background")
+		logger.Infof("backup '%s' has been written to %s", id, toolchainBackupDest)
 	},
 }
 
+// toolchainRestoreCmd restores the component data.
+var toolchainRestoreCmd = &cobra.Command{
+	Use:   "restore",
+	Short: "restore the persistent data of the toolchain components",
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := toolchain.Restore(cmd.Context(), toolchainName, toolchainBackupDest, toolchainBackupID, &toolchainS3Options); err != nil {
+			logger.Fatal(err)
+		}
+		logger.Infof("backup '%s' has been restored", toolchainBackupID)
+	},
+}
+
+// addBackupFlags adds the backup location flags to the command.
+func addBackupFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&toolchainName, "name", "", "name of the toolchain")
+	if err := cmd.MarkFlagRequired("name"); err != nil {
+		log.Fatal(err)
+	}
+	cmd.Flags().StringVar(&toolchainBackupDest, "location", "", "local directory or s3://<bucket>/<prefix> url of the backups")
+	if err := cmd.MarkFlagRequired("location"); err != nil {
+		log.Fatal(err)
+	}
+	cmd.Flags().StringVar(&toolchainS3Options.Endpoint, "s3-endpoint", "", "s3 compatible endpoint url")
+	cmd.Flags().StringVar(&toolchainS3Options.Region, "s3-region", "", "s3 bucket region")
+}
+
+// stdin is shared by the prompts, since a reader may buffer the input
+// of the next prompt.
+var stdin = bufio.NewReader(os.Stdin)
+
+// confirm prompts the user to confirm the action.
+func confirm(message string) bool {
+	fmt.Printf("%s? [y/N]:\n> ", message)
+	line, _, err := stdin.ReadLine()
+	if err != nil {
+		return false
+	}
+	answer := strings.ToLower(strings.TrimSpace(string(line)))
+	return answer == "y" || answer == "yes"
+}
+
 func init() {
 	toolchainCmd.AddCommand(toolchainInstallCmd)
 	toolchainInstallCmd.Flags().StringVar(&toolchainConfig, "config", "", "configuration file")
@@ -82,13 +296,79 @@ func init() {
 		log.Fatal(err)
 	}
 	toolchainInstallCmd.Flags().BoolVar(&toolchainForce, "force", false, "force update (experimental: use at your own risk)")
+	addValuesFlags(toolchainInstallCmd, &toolchainValues, "toolchain parameters")
+	toolchainInstallCmd.Flags().StringVar(&toolchainEnv, "env", "", "environment overlay (merges config.<env>.yaml over the config file)")
+	toolchainInstallCmd.Flags().StringVar(&toolchainBundle, "bundle", "", "install from an offline bundle")
+	toolchainInstallCmd.Flags().BoolVar(&toolchainNoPreflight, "skip-preflight", false, "skip the pre-flight cluster checks")
+	toolchainInstallCmd.Flags().BoolVar(&toolchainWait, "wait", false, "wait for the components to be deployed and pass their health checks")
+	toolchainInstallCmd.Flags().DurationVar(&toolchainTimeout, "timeout", 15*time.Minute, "how long to wait for the components")
 	rootCmd.AddCommand(toolchainCmd)
 
+	toolchainCmd.AddCommand(toolchainPreflightCmd)
+	toolchainPreflightCmd.Flags().StringVar(&toolchainConfig, "config", "", "configuration file")
+	if err := toolchainPreflightCmd.MarkFlagRequired("config"); err != nil {
+		log.Fatal(err)
+	}
+	toolchainPreflightCmd.Flags().StringVar(&toolchainEnv, "env", "", "environment overlay (merges config.<env>.yaml over the config file)")
+	toolchainPreflightCmd.Flags().StringVar(&toolchainBundle, "bundle", "", "read the toolchain source and catalogs from an offline bundle")
+
+	toolchainCmd.AddCommand(toolchainBundleCmd)
+	toolchainBundleCmd.Flags().StringVar(&toolchainConfig, "config", "", "configuration file")
+	if err := toolchainBundleCmd.MarkFlagRequired("config"); err != nil {
+		log.Fatal(err)
+	}
+	toolchainBundleCmd.Flags().StringVarP(&toolchainOutput, "output", "o", "toolchain-bundle.tar.gz", "bundle archive path")
+	addValuesFlags(toolchainBundleCmd, &toolchainValues, "toolchain parameters")
+	toolchainBundleCmd.Flags().StringVar(&toolchainEnv, "env", "", "environment overlay (merges config.<env>.yaml over the config file)")
+
 	toolchainCmd.AddCommand(toolchainDestroyCmd)
 	toolchainDestroyCmd.Flags().StringVar(&toolchainName, "name", "", "name of the toolchain")
 	if err := toolchainDestroyCmd.MarkFlagRequired("name"); err != nil {
 		log.Fatal(err)
 	}
+	toolchainCmd.AddCommand(toolchainRepairCmd)
+	toolchainRepairCmd.Flags().StringVar(&toolchainName, "name", "", "name of the toolchain")
+	if err := toolchainRepairCmd.MarkFlagRequired("name"); err != nil {
+		log.Fatal(err)
+	}
+	toolchainRepairCmd.Flags().BoolVar(&toolchainYes, "yes", false, "repair the releases without confirmation")
+	toolchainCmd.AddCommand(toolchainDriftCmd)
+	toolchainDriftCmd.Flags().StringVar(&toolchainName, "name", "", "name of the toolchain")
+	if err := toolchainDriftCmd.MarkFlagRequired("name"); err != nil {
+		log.Fatal(err)
+	}
+	toolchainDriftCmd.Flags().BoolVar(&toolchainFix, "fix", false, "re-apply the drifted releases and delete the extra resources")
+	toolchainCmd.AddCommand(toolchainStatusCmd)
+	toolchainStatusCmd.Flags().StringVar(&toolchainName, "name", "", "name of the toolchain")
+	if err := toolchainStatusCmd.MarkFlagRequired("name"); err != nil {
+		log.Fatal(err)
+	}
+	toolchainCmd.AddCommand(toolchainExportCmd)
+	toolchainExportCmd.Flags().StringVar(&toolchainName, "name", "", "name of the toolchain")
+	if err := toolchainExportCmd.MarkFlagRequired("name"); err != nil {
+		log.Fatal(err)
+	}
+	toolchainExportCmd.Flags().StringVarP(&toolchainOutput, "output", "o", "toolchain-export.tar.gz", "export archive path")
+	toolchainExportCmd.Flags().StringVar(&toolchainAgeKey, "age-key", "toolchain-export.agekey", "path of the written age key file")
+	toolchainCmd.AddCommand(toolchainImportCmd)
+	toolchainImportCmd.Flags().StringVar(&toolchainArchive, "archive", "", "export archive path")
+	if err := toolchainImportCmd.MarkFlagRequired("archive"); err != nil {
+		log.Fatal(err)
+	}
+	toolchainImportCmd.Flags().StringVar(&toolchainAgeKey, "age-key", "", "age key file of the export")
+	if err := toolchainImportCmd.MarkFlagRequired("age-key"); err != nil {
+		log.Fatal(err)
+	}
+	toolchainImportCmd.Flags().BoolVar(&toolchainForce, "force", false, "replace the local toolchain if it exists")
+	toolchainCmd.AddCommand(toolchainBackupCmd)
+	addBackupFlags(toolchainBackupCmd)
+	toolchainCmd.AddCommand(toolchainRestoreCmd)
+	addBackupFlags(toolchainRestoreCmd)
+	toolchainRestoreCmd.Flags().StringVar(&toolchainBackupID, "id", "", "id of the backup")
+	if err := toolchainRestoreCmd.MarkFlagRequired("id"); err != nil {
+		log.Fatal(err)
+	}
+
 	// add the kubeconfig
 	if home := homedir.HomeDir(); home != "" {
 		toolchainDestroyCmd.Flags().StringVar(&toolchainKubeconfig, "kubeconfig", filepath.Join(home, ".kube", "config"), "kubeconfig path (absolute path)")
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"github.com/spf13/cobra"
+	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/cli/values"
+	"helm.sh/helm/v3/pkg/getter"
+)
+
+// addValuesFlags adds the helm style value override flags to the
+// command.
+func addValuesFlags(cmd *cobra.Command, opts *values.Options, usage string) {
+	cmd.Flags().StringArrayVar(&opts.Values, "set", []string{}, "set "+usage+" (can specify multiple or separate values with commas: key1=val1,key2=val2)")
+	cmd.Flags().StringArrayVar(&opts.FileValues, "set-file", []string{}, "set "+usage+" from files (can specify multiple or separate values with commas: key1=path1,key2=path2)")
+	cmd.Flags().StringSliceVarP(&opts.ValueFiles, "values", "f", []string{}, "specify "+usage+" in a YAML file or a URL (can specify multiple)")
+}
+
+// mergeValues merges the value override flags.
+func mergeValues(opts *values.Options) (map[string]interface{}, error) {
+	return opts.MergeValues(getter.All(cli.New()))
+}
@@ -9,6 +9,7 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"time"
 
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/plumbing"
@@ -61,13 +62,41 @@ func getWorkflowCatalog(source, version string, cloneFunc func(string, bool, *gi
 
 // applicationConfig contains the parameters for the application.
 type applicationConfig struct {
-	Name     string            `json:"name"`
-	CI       string            `json:"ci"`
-	Workflow string            `json:"workflow"`
-	Source   string            `json:"source"`
-	Version  string            `json:"version"`
-	Vars     map[string]string `json:"vars"`
-	Secrets  map[string]string `json:"secrets"`
+	Name      string            `json:"name"`
+	CI        string            `json:"ci"`
+	Workflow  string            `json:"workflow"`
+	Source    string            `json:"source"`
+	Version   string            `json:"version"`
+	Vars      map[string]string `json:"vars"`
+	Secrets   map[string]string `json:"secrets"`
+	Namespace *namespaceConfig  `json:"namespace"`
+	Isolation *isolationConfig  `json:"isolation"`
+	// Parameters override the toolchain parameters when rendering the
+	// application hooks.
+	Parameters map[string]interface{} `json:"parameters"`
+}
+
+// isolationConfig contains the parameters of an application that is
+// isolated in a dedicated namespace.
+type isolationConfig struct {
+	// Enabled installs the application in a dedicated namespace with
+	// access restricted to the application secrets.
+	Enabled bool `json:"enabled"`
+	// ServiceAccounts are the toolchain namespace service accounts
+	// that are granted access to the application secrets.
+	ServiceAccounts []string `json:"serviceAccounts" yaml:"serviceAccounts"`
+	// ShareDriverServiceAccount grants the ci driver service account
+	// access to the application secrets, and runs the application
+	// pipeline as the driver instead of the application service
+	// account. The driver can then read the secrets of every
+	// application that shares it.
+	ShareDriverServiceAccount bool `json:"shareDriverServiceAccount" yaml:"shareDriverServiceAccount"`
+}
+
+// isolated returns true if the application is isolated in a dedicated
+// namespace.
+func (c *applicationConfig) isolated() bool {
+	return c != nil && c.Isolation != nil && c.Isolation.Enabled
 }
 
 // application is an instance of a toolchain application.
@@ -130,6 +159,108 @@ func (app *application) addSecrets(secrets map[string]string) error {
 	return os.WriteFile(path.Join(app.path(), "templates", "application-secret.yaml"), data, 0644)
 }
 
+// serviceAccountName returns the name of the application service
+// account.
+func (app *application) serviceAccountName() string {
+	return fmt.Sprintf("trustacks-application-%s", app.name)
+}
+
+// driverServiceAccount returns the ci driver service account if the
+// isolated application shares it, or an empty string.
+func (app *application) driverServiceAccount() string {
+	config := app.toolchain.findApplication(app.name)
+	if !config.isolated() || !config.Isolation.ShareDriverServiceAccount || app.toolchain.config == nil {
+		return ""
+	}
+	driver, _ := app.toolchain.config.Parameters["ci"].(string)
+	return driver
+}
+
+// pipelineServiceAccount returns the service account that runs the
+// pipeline of the isolated application. It is the application service
+// account unless the application shares the ci driver service account.
+func (app *application) pipelineServiceAccount() string {
+	if driver := app.driverServiceAccount(); driver != "" {
+		return driver
+	}
+	return app.serviceAccountName()
+}
+
+// addRBAC adds the application service account and the role that
+// restricts access to the application vars and secrets to the
+// application chart.
+//
+// The role is bound to the application service account and to the
+// provided service accounts of the toolchain namespace.
+func (app *application) addRBAC(serviceAccounts []string) error {
+	name := app.serviceAccountName()
+	subjects := []map[string]interface{}{
+		{"kind": "ServiceAccount", "name": name},
+	}
+	for _, sa := range serviceAccounts {
+		subjects = append(subjects, map[string]interface{}{
+			"kind":      "ServiceAccount",
+			"name":      sa,
+			"namespace": app.toolchain.namespace(),
+		})
+	}
+	resources := []map[string]interface{}{
+		{
+			"apiVersion": "v1",
+			"kind":       "ServiceAccount",
+			"metadata":   map[string]interface{}{"name": name},
+		},
+		{
+			"apiVersion": "rbac.authorization.k8s.io/v1",
+			"kind":       "Role",
+			"metadata":   map[string]interface{}{"name": name},
+			"rules": []map[string]interface{}{
+				{
+					"apiGroups":     []string{""},
+					"resources":     []string{"secrets"},
+					"resourceNames": []string{fmt.Sprintf("application-%s-secrets", app.name)},
+					"verbs":         []string{"get"},
+				},
+				{
+					"apiGroups":     []string{""},
+					"resources":     []string{"configmaps"},
+					"resourceNames": []string{fmt.Sprintf("application-%s-vars", app.name)},
+					"verbs":         []string{"get"},
+				},
+			},
+		},
+		{
+			"apiVersion": "rbac.authorization.k8s.io/v1",
+			"kind":       "RoleBinding",
+			"metadata":   map[string]interface{}{"name": name},
+			"subjects":   subjects,
+			"roleRef": map[string]interface{}{
+				"apiGroup": "rbac.authorization.k8s.io",
+				"kind":     "Role",
+				"name":     name,
+			},
+		},
+	}
+	var buf bytes.Buffer
+	for _, resource := range resources {
+		data, err := yaml.Marshal(resource)
+		if err != nil {
+			return err
+		}
+		buf.WriteString("---\n")
+		buf.Write(data)
+	}
+	return os.WriteFile(path.Join(app.path(), "templates", "application-rbac.yaml"), buf.Bytes(), 0644)
+}
+
+// applicationParameters returns the parameters of the application
+// hooks. The catalog defaults are overridden by the toolchain
+// parameters, the application parameters, the toolchain install
+// overrides and the application overrides, in that order.
+func (tc *toolchain) applicationParameters(catalog *componentCatalog, config *applicationConfig, overrides map[string]interface{}) map[string]interface{} {
+	return tc.join(tc.config.Parameters, catalog.Config.Parameters, config.Parameters, tc.overrides, overrides)
+}
+
 // addCIDriverHooks creates the application hook template file in
 // the chart.
 func (app *application) addCIDriverHooks(driver string, components []string, catalog *componentCatalog, params map[string]interface{}) error {
@@ -139,8 +270,14 @@ func (app *application) addCIDriverHooks(driver string, components []string, cat
 			continue
 		}
 		component := catalog.Components[name]
-		params["image"] = catalog.HookSource
+		params["image"] = mirrorImage(app.toolchain.registryMirror(), catalog.HookSource)
 		params["toolchain"] = app.toolchain.name
+		params["toolchainNamespace"] = app.toolchain.namespace()
+		params["applicationNamespace"] = app.namespaceConfig().Name
+		if app.toolchain.findApplication(app.name).isolated() {
+			params["applicationServiceAccount"] = app.serviceAccountName()
+			params["pipelineServiceAccount"] = app.pipelineServiceAccount()
+		}
 		params["application"] = app.name
 		var buf bytes.Buffer
 		t := template.Must(template.New("hook").Parse(component.ApplicationHooks))
@@ -148,7 +285,7 @@ func (app *application) addCIDriverHooks(driver string, components []string, cat
 			return err
 		}
 		path := filepath.Join(app.toolchain.applicationsPath(), app.name, "templates", fmt.Sprintf("trustacks-application-%s-hooks.yaml", app.name))
-		if err := os.WriteFile(path, buf.Bytes(), 0666); err != nil {
+		if err := os.WriteFile(path, app.toolchain.mirrorHooks(buf.Bytes()), 0666); err != nil {
 			return err
 		}
 	}
@@ -160,30 +297,67 @@ func (app *application) path() string {
 	return path.Join(app.toolchain.applicationsPath(), app.name)
 }
 
+// cluster returns the cluster target of the application, which is the
+// cluster of the toolchain ci driver.
+func (app *application) cluster() *clusterConfig {
+	if app.toolchain.config == nil {
+		return nil
+	}
+	driver, _ := app.toolchain.config.Parameters["ci"].(string)
+	return app.toolchain.cluster(driver)
+}
+
+// clusterName returns the name of the application cluster target.
+func (app *application) clusterName() string {
+	if app.toolchain.config == nil {
+		return ""
+	}
+	driver, _ := app.toolchain.config.Parameters["ci"].(string)
+	return app.toolchain.clusterName(driver)
+}
+
+// releaseName returns the release name of the application chart.
+func (app *application) releaseName() string {
+	return fmt.Sprintf("trustacks-application-%s", app.name)
+}
+
+// namespaceConfig returns the namespace configuration of the
+// application.
+func (app *application) namespaceConfig() *namespaceConfig {
+	return app.toolchain.applicationNamespaceConfig(app.toolchain.findApplication(app.name))
+}
+
 // install installs the application helm chart.
-func (app *application) install() error {
-	namespace := fmt.Sprintf("trustacks-toolchain-%s", app.toolchain.name)
+func (app *application) install(ctx context.Context) error {
+	namespaceConfig := app.namespaceConfig()
+	namespace := namespaceConfig.Name
 	chartSpec := helmclient.ChartSpec{
-		ReleaseName:     fmt.Sprintf("trustacks-application-%s", app.name),
-		ChartName:       filepath.Join(app.path()),
-		Namespace:       namespace,
-		UpgradeCRDs:     true,
-		CreateNamespace: true,
-		CleanupOnFail:   true,
-	}
-	kubeconfig, err := os.ReadFile(filepath.Join(os.Getenv("HOME"), ".kube", "config"))
+		ReleaseName:   app.releaseName(),
+		ChartName:     filepath.Join(app.path()),
+		Namespace:     namespace,
+		UpgradeCRDs:   true,
+		CleanupOnFail: true,
+	}
+	cluster := app.cluster()
+	clientset, err := newClientset(cluster)
 	if err != nil {
 		return err
 	}
-	helmClient, err := helmclient.NewClientFromKubeConf(&helmclient.KubeConfClientOptions{
-		Options:    &helmclient.Options{Namespace: namespace},
-		KubeConfig: kubeconfig,
-	})
+	if err := ensureNamespace(ctx, clientset, namespaceConfig); err != nil {
+		return err
+	}
+	helmClient, err := newHelmClient(namespace, cluster)
 	if err != nil {
 		return err
 	}
-	_, err = helmClient.InstallOrUpgradeChart(context.Background(), &chartSpec, nil)
-	return err
+	opts, err := app.toolchain.helmOptions()
+	if err != nil {
+		return err
+	}
+	logger.WithField("release", chartSpec.ReleaseName).Info("installing the application chart")
+	started := time.Now()
+	_, err = helmClient.InstallOrUpgradeChart(ctx, &chartSpec, opts)
+	return withHookLogs(err, chartSpec.ReleaseName, started, namespace, cluster)
 }
 
 // newApplication creates the application chart and input assets.
@@ -201,30 +375,97 @@ func newApplication(name string, config *applicationConfig, tc *toolchain, force
 	if err := app.addSecrets(config.Secrets); err != nil {
 		return nil, err
 	}
+	if config.isolated() {
+		serviceAccounts := config.Isolation.ServiceAccounts
+		if driver := app.driverServiceAccount(); driver != "" {
+			serviceAccounts = append(serviceAccounts, driver)
+		}
+		if err := app.addRBAC(serviceAccounts); err != nil {
+			return nil, err
+		}
+	}
 	return app, nil
 }
 
+// ApplicationOptions contains the optional application create
+// parameters.
+type ApplicationOptions struct {
+	// Vars are merged over the config file application vars.
+	Vars map[string]interface{}
+	// Parameters are merged over the application parameters and the
+	// toolchain install overrides.
+	Parameters map[string]interface{}
+	// Env is the environment overlay merged over the config file.
+	Env string
+	// Bundle is the path of an offline bundle. The workflow catalog,
+	// component catalogs and charts are read from the bundle instead
+	// of the network if it is set.
+	Bundle string
+}
+
 // CreateApplication creates a new application instance and installs
 // the application workflow dependencies.
-func CreateApplication(name string, force bool, configPath string, cloneFunc func(string, bool, *git.CloneOptions) (*git.Repository, error)) error {
-	config, err := loadToolchainConfig(configPath)
+//
+// Cancelling the context interrupts the in-flight helm operations. The
+// releases left in an intermediate state are reported in the returned
+// error.
+func CreateApplication(ctx context.Context, name string, force bool, configPath string, cloneFunc func(string, bool, *git.CloneOptions) (*git.Repository, error), opts *ApplicationOptions) error {
+	if opts == nil {
+		opts = &ApplicationOptions{}
+	}
+	config, err := loadToolchainConfig(configPath, opts.Env)
 	if err != nil {
 		return fmt.Errorf("error loading the toolchain config: %s", err)
 	}
 	var appConfig *applicationConfig
-	for _, a := range config.Applications {
-		if a.Name == name {
-			appConfig = &a
+	for i := range config.Applications {
+		if config.Applications[i].Name == name {
+			appConfig = &config.Applications[i]
 			break
 		}
 	}
 	if appConfig == nil {
 		return fmt.Errorf("error: config for '%s' was not found in '%s'", name, configPath)
 	}
+	if opts.Vars != nil {
+		vars, err := stringValues(opts.Vars)
+		if err != nil {
+			return fmt.Errorf("error merging the application vars: %s", err)
+		}
+		appConfig.Vars = mergeStringMaps(appConfig.Vars, vars)
+	}
+	if err := validateClusters(config); err != nil {
+		return fmt.Errorf("error validating the cluster targets: %s", err)
+	}
 	tc, err := newToolchainFromConfig(config.Name)
 	if err != nil {
 		return fmt.Errorf("error getting toolchain from config %s", err)
 	}
+	// the install overrides are kept over the toolchain parameters of
+	// the reloaded config.
+	config.Parameters = mergeValues(config.Parameters, tc.overrides)
+	tc.config = config
+	if err := validateInstaller(config); err != nil {
+		return fmt.Errorf("error validating the installer: %s", err)
+	}
+	// the gitops repository is cloned with the provided clone func
+	// when installing from a bundle.
+	gitClone := cloneFunc
+	if opts.Bundle != "" {
+		b, err := openBundle(opts.Bundle)
+		if err != nil {
+			return fmt.Errorf("error opening the bundle: %s", err)
+		}
+		defer b.remove()
+		tc.bundle = b
+		cloneFunc = b.clone
+	}
+	if appConfig.isolated() && tc.applicationNamespaceConfig(appConfig).Name == tc.namespace() {
+		return fmt.Errorf("error: isolated application '%s' cannot use the toolchain namespace", name)
+	}
+	if err := tc.saveConfig(); err != nil {
+		return fmt.Errorf("error saving the toolchain config: %s", err)
+	}
 	app, err := newApplication(name, appConfig, tc, force)
 	if err != nil {
 		return fmt.Errorf("error creating the application %s", err)
@@ -243,12 +484,12 @@ func CreateApplication(name string, force bool, configPath string, cloneFunc fun
 		return fmt.Errorf("error: workflow '%s' was not found in the catalog", appConfig.Workflow)
 	}
 	for _, dep := range wf.Dependencies {
-		catalog, err := getToolchainCatalog(dep.Catalog)
+		catalog, err := tc.catalog(ctx, dep.Catalog)
 		if err != nil {
 			return fmt.Errorf("error fetching catalog: %s", err)
 		}
 		parameters := tc.join(config.Parameters, catalog.Config.Parameters)
-		if err := tc.addComponents(dep.Components, catalog); err != nil {
+		if err := tc.addComponents(ctx, dep.Components, catalog); err != nil {
 			return fmt.Errorf("error adding subcharts: %s", err)
 		}
 		if err := tc.addHooks(dep.Components, catalog, parameters); err != nil {
@@ -257,23 +498,51 @@ func CreateApplication(name string, force bool, configPath string, cloneFunc fun
 		if err := tc.addSubChartValues(dep.Components, catalog, parameters); err != nil {
 			return fmt.Errorf("error adding subchart values: %s", err)
 		}
+		if err := tc.addBackupJobs(dep.Components, catalog, parameters); err != nil {
+			return fmt.Errorf("error adding the backup jobs: %s", err)
+		}
+		if err := tc.addHealthChecks(dep.Components, catalog, parameters); err != nil {
+			return fmt.Errorf("error adding the health checks: %s", err)
+		}
+		if tc.controllerInstaller() {
+			if err := tc.addControllerResources(ctx, dep.Components, catalog); err != nil {
+				return fmt.Errorf("error adding the controller resources: %s", err)
+			}
+		}
 	}
 	// add application hooks
 	for _, dep := range tc.Dependencies {
-		catalog, err := getToolchainCatalog(dep.Catalog)
+		catalog, err := tc.catalog(ctx, dep.Catalog)
 		if err != nil {
 			return fmt.Errorf("error fetching catalog: %s", err)
 		}
-		parameters := tc.join(config.Parameters, catalog.Config.Parameters)
-		if err := app.addCIDriverHooks(parameters["ci"].(string), dep.Components, catalog, parameters); err != nil {
+		// the ci driver is selected by the toolchain parameters and
+		// can not be overridden by the application.
+		driver, _ := tc.join(config.Parameters, catalog.Config.Parameters)["ci"].(string)
+		parameters := tc.applicationParameters(catalog, appConfig, opts.Parameters)
+		if err := app.addCIDriverHooks(driver, dep.Components, catalog, parameters); err != nil {
 			return fmt.Errorf("error adding application hook templates: %s", err)
 		}
 	}
-	if err := tc.installComponents(); err != nil {
-		return fmt.Errorf("error installing the toolchain components: %s", err)
+	if tc.installer() == installerGitOps {
+		// the workflow components and the application chart are
+		// published with the toolchain manifests.
+		if err := tc.publish(ctx, gitClone); err != nil {
+			return fmt.Errorf("error publishing the toolchain manifests: %s", err)
+		}
+		return nil
+	}
+	if tc.controllerInstaller() {
+		// the workflow components are added to the controller
+		// resources of the toolchain chart.
+		if err := tc.install(ctx); err != nil {
+			return tc.interrupted(ctx, fmt.Errorf("error installing the toolchain chart: %s", err))
+		}
+	} else if err := tc.installComponents(ctx); err != nil {
+		return tc.interrupted(ctx, fmt.Errorf("error installing the toolchain components: %s", err))
 	}
-	if err := app.install(); err != nil {
-		return fmt.Errorf("error installing the application chart: %s", err)
+	if err := app.install(ctx); err != nil {
+		return tc.interrupted(ctx, fmt.Errorf("error installing the application chart: %s", err))
 	}
 	return nil
 }
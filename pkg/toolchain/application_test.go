@@ -151,3 +151,167 @@ func TestAddCIDriverHooks(t *testing.T) {
 	}
 	assert.FileExists(t, fmt.Sprintf("%s/applications/test/templates/trustacks-application-test-hooks.yaml", tc.path()), "expected hooks manifest to exist")
 }
+
+func TestApplicationParameters(t *testing.T) {
+	defer patchToolchainRoot()()
+	if err := os.MkdirAll(filepath.Join(toolchainRoot, "test"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(toolchainRoot, "test", "config.yaml"), []byte(""), 0644); err != nil {
+		t.Fatal(err)
+	}
+	saved := &toolchain{
+		name:      "test",
+		config:    &toolchainConfig{Name: "test", Parameters: map[string]interface{}{"toolchain": "toolchain", "application": "toolchain", "install": "toolchain", "cli": "toolchain"}},
+		overrides: map[string]interface{}{"install": "install", "cli": "install"},
+	}
+	if err := saved.saveConfig(); err != nil {
+		t.Fatal(err)
+	}
+	tc, err := newToolchainFromConfig("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, saved.overrides, tc.overrides, "expected the install overrides to be stored")
+	catalog := &componentCatalog{Config: &componentCatalogConfig{Parameters: []componentCatalogConfigParameters{
+		{Name: "catalog", Default: "catalog"},
+		{Name: "toolchain", Default: "catalog"},
+		{Name: "application", Default: "catalog"},
+		{Name: "install", Default: "catalog"},
+		{Name: "cli", Default: "catalog"},
+	}}}
+	config := &applicationConfig{Name: "web", Parameters: map[string]interface{}{"application": "application", "install": "application", "cli": "application"}}
+	assert.Equal(t, map[string]interface{}{
+		"catalog":     "catalog",
+		"toolchain":   "toolchain",
+		"application": "application",
+		"install":     "install",
+		"cli":         "cli",
+	}, tc.applicationParameters(catalog, config, map[string]interface{}{"cli": "cli"}))
+}
+
+func TestApplicationAddRBAC(t *testing.T) {
+	defer patchToolchainRoot()()
+	app := &application{toolchain: &toolchain{name: "test"}, name: "web"}
+	if err := os.MkdirAll(path.Join(app.path(), "templates"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.addRBAC([]string{"concourse"}); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path.Join(app.path(), "templates", "application-rbac.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	resources := map[string]map[string]interface{}{}
+	decoder := yaml.NewDecoder(f)
+	for {
+		resource := map[string]interface{}{}
+		if err := decoder.Decode(&resource); err != nil {
+			break
+		}
+		resources[resource["kind"].(string)] = resource
+	}
+	assert.Contains(t, resources, "ServiceAccount", "expected the application service account")
+	rules := resources["Role"]["rules"].([]interface{})
+	assert.Equal(t, []interface{}{"application-web-secrets"}, rules[0].(map[string]interface{})["resourceNames"], "expected access to the application secrets only")
+	subjects := resources["RoleBinding"]["subjects"].([]interface{})
+	assert.Equal(t, "trustacks-application-web", subjects[0].(map[string]interface{})["name"], "expected the application service account subject")
+	assert.Equal(t, "concourse", subjects[1].(map[string]interface{})["name"], "expected the ci driver service account subject")
+	assert.Equal(t, "trustacks-toolchain-test", subjects[1].(map[string]interface{})["namespace"], "expected the toolchain namespace")
+}
+
+func TestNewIsolatedApplication(t *testing.T) {
+	defer patchToolchainRoot()()
+	config := &applicationConfig{Name: "web", Isolation: &isolationConfig{Enabled: true}}
+	tc := &toolchain{
+		name: "test",
+		config: &toolchainConfig{
+			Parameters:   map[string]interface{}{"ci": "concourse"},
+			Applications: []applicationConfig{*config},
+		},
+	}
+	app, err := newApplication("web", config, tc, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.FileExists(t, path.Join(app.path(), "templates", "application-rbac.yaml"), "expected the rbac manifest to exist")
+	assert.Equal(t, "trustacks-toolchain-test-web", app.namespaceConfig().Name, "expected the dedicated application namespace")
+}
+
+// secretReaders returns the namespace/name of the service accounts
+// that the rbac manifest of the application grants access to the
+// secret in the application namespace.
+func secretReaders(t *testing.T, app *application, secret string) map[string]bool {
+	data, err := os.ReadFile(path.Join(app.path(), "templates", "application-rbac.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects, err := decodeManifests(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	namespace := app.namespaceConfig().Name
+	granted := map[string]bool{}
+	for _, obj := range objects {
+		if obj["kind"] != "Role" {
+			continue
+		}
+		for _, rule := range obj["rules"].([]interface{}) {
+			for _, name := range rule.(map[string]interface{})["resourceNames"].([]interface{}) {
+				if name == secret {
+					granted[obj["metadata"].(map[string]interface{})["name"].(string)] = true
+				}
+			}
+		}
+	}
+	readers := map[string]bool{}
+	for _, obj := range objects {
+		if obj["kind"] != "RoleBinding" || !granted[obj["roleRef"].(map[string]interface{})["name"].(string)] {
+			continue
+		}
+		for _, subject := range obj["subjects"].([]interface{}) {
+			s := subject.(map[string]interface{})
+			ns, ok := s["namespace"].(string)
+			if !ok {
+				ns = namespace
+			}
+			readers[fmt.Sprintf("%s/%s", ns, s["name"])] = true
+		}
+	}
+	return readers
+}
+
+func TestIsolatedApplicationSecrets(t *testing.T) {
+	defer patchToolchainRoot()()
+	tc := &toolchain{
+		name: "test",
+		config: &toolchainConfig{
+			Parameters: map[string]interface{}{"ci": "concourse"},
+			Applications: []applicationConfig{
+				{Name: "a", Isolation: &isolationConfig{Enabled: true}},
+				{Name: "b", Isolation: &isolationConfig{Enabled: true}},
+				{Name: "shared", Isolation: &isolationConfig{Enabled: true, ShareDriverServiceAccount: true}},
+			},
+		},
+	}
+	apps := map[string]*application{}
+	for i := range tc.config.Applications {
+		config := &tc.config.Applications[i]
+		app, err := newApplication(config.Name, config, tc, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		apps[config.Name] = app
+	}
+	a := "trustacks-toolchain-test-a/trustacks-application-a"
+	driver := "trustacks-toolchain-test/concourse"
+	assert.Equal(t, map[string]bool{a: true}, secretReaders(t, apps["a"], "application-a-secrets"))
+	readers := secretReaders(t, apps["b"], "application-b-secrets")
+	assert.False(t, readers[a], "expected the application a service account not to read the application b secrets")
+	assert.False(t, readers[driver], "expected the ci driver not to read the secrets by default")
+	assert.True(t, secretReaders(t, apps["shared"], "application-shared-secrets")[driver], "expected the shared ci driver to read the secrets")
+	assert.Equal(t, "trustacks-application-a", apps["a"].pipelineServiceAccount())
+	assert.Equal(t, "concourse", apps["shared"].pipelineServiceAccount())
+}
@@ -0,0 +1,103 @@
+package toolchain
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArchive(t *testing.T) {
+	src := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(src, "charts", "helloworld"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "charts", "helloworld", "Chart.yaml"), []byte("name: helloworld"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("Chart.yaml", filepath.Join(src, "charts", "helloworld", "link.yaml")); err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(t.TempDir(), "archive.tar.gz")
+	if err := writeArchive(src, archive); err != nil {
+		t.Fatal(err)
+	}
+	dst := t.TempDir()
+	if err := extractArchive(archive, dst); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dst, "charts", "helloworld", "link.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "name: helloworld", string(data), "got unexpected extracted contents")
+
+	copied := filepath.Join(t.TempDir(), "copy")
+	if err := copyDir(dst, copied); err != nil {
+		t.Fatal(err)
+	}
+	assert.FileExists(t, filepath.Join(copied, "charts", "helloworld", "Chart.yaml"))
+}
+
+// writeTestArchive writes the tar entries to a gzipped tarball.
+func writeTestArchive(t *testing.T, headers []*tar.Header) string {
+	archive := filepath.Join(t.TempDir(), "archive.tar.gz")
+	f, err := os.Create(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	for _, header := range headers {
+		if header.Typeflag == tar.TypeReg {
+			header.Size = int64(len("data"))
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if header.Typeflag == tar.TypeReg {
+			if _, err := tw.Write([]byte("data")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return archive
+}
+
+func TestExtractArchiveEscape(t *testing.T) {
+	outside := t.TempDir()
+	for name, headers := range map[string][]*tar.Header{
+		"absolute link": {
+			{Name: "x", Typeflag: tar.TypeSymlink, Linkname: outside},
+			{Name: "x/.bashrc", Typeflag: tar.TypeReg, Mode: 0644},
+		},
+		"relative link": {
+			{Name: "charts/x", Typeflag: tar.TypeSymlink, Linkname: "../../" + filepath.Base(outside)},
+		},
+		"parent path": {
+			{Name: "../.bashrc", Typeflag: tar.TypeReg, Mode: 0644},
+		},
+		"hard link": {
+			{Name: "x", Typeflag: tar.TypeLink, Linkname: filepath.Join(outside, ".bashrc")},
+		},
+	} {
+		dst := t.TempDir()
+		err := extractArchive(writeTestArchive(t, headers), dst)
+		assert.Error(t, err, name)
+		entries, readErr := os.ReadDir(outside)
+		if readErr != nil {
+			t.Fatal(readErr)
+		}
+		assert.Empty(t, entries, "%s: expected nothing to be written outside of the destination", name)
+	}
+}
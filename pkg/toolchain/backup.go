@@ -0,0 +1,723 @@
+package toolchain
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"filippo.io/age"
+	"github.com/sirupsen/logrus"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// componentBackupFile is the rendered backup configuration of a
+	// component.
+	componentBackupFile = "trustacks-backup.yaml"
+	// backupIndexFile lists the components of a backup.
+	backupIndexFile = "backup.json"
+	// backupMountPath is where the backup volume is mounted in the
+	// job containers.
+	backupMountPath = "/backup"
+	// backupVolumeName is the name of the backup volume.
+	backupVolumeName = "trustacks-backup"
+	// backupTransferImage is the image of the pod that copies the
+	// artifacts from and to the backup volume.
+	backupTransferImage = "busybox:1.35"
+	// defaultBackupSize is the default size of the backup volume.
+	defaultBackupSize = "10Gi"
+)
+
+var (
+	// backupPollInterval is the interval of the job and pod status
+	// checks.
+	backupPollInterval = 2 * time.Second
+	// backupTimeout is how long the backup and restore jobs, and the
+	// transfer pods, are waited for.
+	backupTimeout = time.Hour
+)
+
+// componentBackup contains the backup and restore job templates of a
+// component.
+//
+// The jobs write and read the component data in the /backup directory,
+// which is a volume created for each backup and restore.
+type componentBackup struct {
+	// Backup is the job that writes the component data to /backup.
+	Backup string `json:"backup"`
+	// Restore is the job that restores the component data from
+	// /backup.
+	Restore string `json:"restore"`
+	// Size is the size of the backup volume.
+	Size string `json:"size,omitempty"`
+}
+
+// backupIndex lists the component artifacts of a backup.
+type backupIndex struct {
+	Toolchain  string   `json:"toolchain"`
+	Components []string `json:"components"`
+	// Encrypted indicates that the artifacts are encrypted with the
+	// toolchain age key.
+	Encrypted bool `json:"encrypted,omitempty"`
+	// Checksums are the sha256 checksums of the stored artifacts by
+	// component.
+	Checksums map[string]string `json:"checksums,omitempty"`
+}
+
+// artifactKey returns the store key of the component artifact.
+func (index *backupIndex) artifactKey(id, component string) string {
+	key := fmt.Sprintf("%s/%s.tar", id, component)
+	if index.Encrypted {
+		key += encryptedSuffix
+	}
+	return key
+}
+
+// BackupOptions contains the s3 options of s3:// destinations. The
+// credentials are read from the AWS_ACCESS_KEY_ID and
+// AWS_SECRET_ACCESS_KEY environment variables.
+type BackupOptions struct {
+	// Endpoint is the url of the s3 compatible endpoint.
+	Endpoint string
+	// Region is the bucket region.
+	Region string
+}
+
+// addBackupJobs renders the backup and restore jobs of the components.
+func (tc *toolchain) addBackupJobs(components []string, catalog *componentCatalog, params map[string]interface{}) error {
+	for _, name := range components {
+		c := catalog.Components[name]
+		if c.Backup == nil {
+			continue
+		}
+		params["image"] = mirrorImage(tc.registryMirror(), catalog.HookSource)
+		rendered := &componentBackup{Size: c.Backup.Size}
+		for _, job := range []struct {
+			source string
+			target *string
+		}{{c.Backup.Backup, &rendered.Backup}, {c.Backup.Restore, &rendered.Restore}} {
+			var buf bytes.Buffer
+			t, err := template.New("backup").Parse(job.source)
+			if err != nil {
+				return fmt.Errorf("error parsing the '%s' backup jobs: %s", name, err)
+			}
+			if err := t.Execute(&buf, params); err != nil {
+				return err
+			}
+			*job.target = string(tc.mirrorHooks(buf.Bytes()))
+		}
+		data, err := yaml.Marshal(rendered)
+		if err != nil {
+			return err
+		}
+		dir := filepath.Join(tc.componentsPath(), name)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(dir, componentBackupFile), data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// componentBackups returns the rendered backup configurations of the
+// toolchain components.
+func (tc *toolchain) componentBackups() (map[string]*componentBackup, error) {
+	backups := map[string]*componentBackup{}
+	components, err := os.ReadDir(tc.componentsPath())
+	if os.IsNotExist(err) {
+		return backups, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, component := range components {
+		data, err := os.ReadFile(filepath.Join(tc.componentsPath(), component.Name(), componentBackupFile))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		backup := &componentBackup{}
+		if err := yaml.Unmarshal(data, backup); err != nil {
+			return nil, fmt.Errorf("error reading the '%s' backup jobs: %s", component.Name(), err)
+		}
+		backups[component.Name()] = backup
+	}
+	return backups, nil
+}
+
+// componentJob decodes the job manifest of a component. The job is
+// not retried.
+func componentJob(manifest, name, component string) (*batchv1.Job, error) {
+	job := &batchv1.Job{}
+	if err := yaml.Unmarshal([]byte(manifest), job); err != nil {
+		return nil, err
+	}
+	if job.Kind != "Job" {
+		return nil, fmt.Errorf("the manifest is a '%s' instead of a Job", job.Kind)
+	}
+	job.Name = name
+	job.Namespace = ""
+	job.Labels = mergeStringMaps(job.Labels, map[string]string{componentLabel: component})
+	if job.Spec.BackoffLimit == nil {
+		var backoffLimit int32
+		job.Spec.BackoffLimit = &backoffLimit
+	}
+	if job.Spec.Template.Spec.RestartPolicy == "" {
+		job.Spec.Template.Spec.RestartPolicy = corev1.RestartPolicyNever
+	}
+	return job, nil
+}
+
+// backupJob decodes the job manifest and mounts the backup volume in
+// its containers.
+func backupJob(manifest, name, component string) (*batchv1.Job, error) {
+	job, err := componentJob(manifest, name, component)
+	if err != nil {
+		return nil, err
+	}
+	spec := &job.Spec.Template.Spec
+	spec.Volumes = append(spec.Volumes, corev1.Volume{
+		Name: backupVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: name},
+		},
+	})
+	mount := corev1.VolumeMount{Name: backupVolumeName, MountPath: backupMountPath}
+	for i := range spec.InitContainers {
+		spec.InitContainers[i].VolumeMounts = append(spec.InitContainers[i].VolumeMounts, mount)
+	}
+	for i := range spec.Containers {
+		spec.Containers[i].VolumeMounts = append(spec.Containers[i].VolumeMounts, mount)
+	}
+	return job, nil
+}
+
+// backupClaim returns the claim of the backup volume.
+func backupClaim(name, size string) (*corev1.PersistentVolumeClaim, error) {
+	if size == "" {
+		size = defaultBackupSize
+	}
+	quantity, err := resource.ParseQuantity(size)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backup size '%s': %s", size, err)
+	}
+	return &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: quantity},
+			},
+		},
+	}, nil
+}
+
+// transferPod returns the pod that copies the artifacts from and to
+// the backup volume. The pod exits after the backup timeout, so it
+// does not outlive an interrupted transfer.
+func transferPod(name, image string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name + "-transfer"},
+		Spec: corev1.PodSpec{
+			RestartPolicy: corev1.RestartPolicyNever,
+			Containers: []corev1.Container{{
+				Name:         "transfer",
+				Image:        image,
+				Command:      []string{"sleep", strconv.Itoa(int(backupTimeout.Seconds()))},
+				VolumeMounts: []corev1.VolumeMount{{Name: backupVolumeName, MountPath: backupMountPath}},
+			}},
+			Volumes: []corev1.Volume{{
+				Name: backupVolumeName,
+				VolumeSource: corev1.VolumeSource{
+					PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: name},
+				},
+			}},
+		},
+	}
+}
+
+// waitForJob waits for the job to complete. The logs of the job are
+// returned with the error of a failed job.
+func waitForJob(ctx context.Context, clientset kubernetes.Interface, namespace, name string) error {
+	for {
+		job, err := clientset.BatchV1().Jobs(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if jobFailed(*job) {
+			logs, err := jobLogs(ctx, clientset, namespace, name)
+			if err != nil {
+				logs = fmt.Sprintf("error fetching logs: %s", err)
+			}
+			return fmt.Errorf("job '%s' failed\n--- job logs ---\n%s", name, strings.TrimSpace(logs))
+		}
+		if job.Status.Succeeded > 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backupPollInterval):
+		}
+	}
+}
+
+// waitForPod waits for the pod to run.
+func waitForPod(ctx context.Context, clientset kubernetes.Interface, namespace, name string) error {
+	for {
+		pod, err := clientset.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		switch pod.Status.Phase {
+		case corev1.PodRunning:
+			return nil
+		case corev1.PodFailed, corev1.PodSucceeded:
+			return fmt.Errorf("pod '%s' is not running: %s", name, pod.Status.Phase)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backupPollInterval):
+		}
+	}
+}
+
+// execPod runs the command in the transfer container of the pod.
+func execPod(ctx context.Context, config *rest.Config, clientset kubernetes.Interface, namespace, pod string, command []string, stdin io.Reader, stdout io.Writer) error {
+	req := clientset.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Namespace(namespace).
+		Name(pod).
+		SubResource("exec").
+		VersionedParams(&corev1.PodExecOptions{
+			Container: "transfer",
+			Command:   command,
+			Stdin:     stdin != nil,
+			Stdout:    true,
+			Stderr:    true,
+		}, scheme.ParameterCodec)
+	executor, err := remotecommand.NewSPDYExecutor(config, "POST", req.URL())
+	if err != nil {
+		return err
+	}
+	var stderr bytes.Buffer
+	if err := executor.Stream(remotecommand.StreamOptions{Stdin: stdin, Stdout: stdout, Stderr: &stderr}); err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// backupRun manages the backup volume, jobs and transfer pod of a
+// component backup or restore.
+type backupRun struct {
+	config    *rest.Config
+	clientset kubernetes.Interface
+	namespace string
+	name      string
+	component string
+	image     string
+	log       *logrus.Entry
+}
+
+// newBackupRun creates the backup volume of the component.
+func (tc *toolchain) newBackupRun(ctx context.Context, component string, backup *componentBackup) (*backupRun, error) {
+	cluster := tc.cluster(component)
+	config, err := restConfig(cluster)
+	if err != nil {
+		return nil, err
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	r := &backupRun{
+		config:    config,
+		clientset: clientset,
+		namespace: tc.namespace(),
+		name:      fmt.Sprintf("trustacks-backup-%s", component),
+		component: component,
+		image:     mirrorImage(tc.registryMirror(), backupTransferImage),
+		log:       logger.WithFields(logrus.Fields{"component": component, "cluster": clusterLabel(cluster)}),
+	}
+	claim, err := backupClaim(r.name, backup.Size)
+	if err != nil {
+		return nil, err
+	}
+	r.cleanup()
+	if _, err := clientset.CoreV1().PersistentVolumeClaims(r.namespace).Create(ctx, claim, metav1.CreateOptions{}); err != nil {
+		return nil, fmt.Errorf("error creating the backup volume: %s", err)
+	}
+	return r, nil
+}
+
+// runJob runs the backup or restore job.
+func (r *backupRun) runJob(ctx context.Context, manifest string) error {
+	job, err := backupJob(manifest, r.name, r.component)
+	if err != nil {
+		return err
+	}
+	if _, err := r.clientset.BatchV1().Jobs(r.namespace).Create(ctx, job, metav1.CreateOptions{}); err != nil {
+		return err
+	}
+	return r.wait(ctx, fmt.Sprintf("job '%s'", job.Name), func(ctx context.Context) error {
+		return waitForJob(ctx, r.clientset, r.namespace, job.Name)
+	})
+}
+
+// wait runs the wait function with the backup timeout. A volume that
+// can not be bound leaves the pods pending, so the phase of the backup
+// volume is reported when the wait times out.
+func (r *backupRun) wait(ctx context.Context, resource string, wait func(context.Context) error) error {
+	waitCtx, cancel := context.WithTimeout(ctx, backupTimeout)
+	defer cancel()
+	err := wait(waitCtx)
+	if err == nil || ctx.Err() != nil || waitCtx.Err() != context.DeadlineExceeded {
+		return err
+	}
+	claim, claimErr := r.clientset.CoreV1().PersistentVolumeClaims(r.namespace).Get(ctx, r.name, metav1.GetOptions{})
+	if claimErr == nil && claim.Status.Phase != corev1.ClaimBound {
+		return fmt.Errorf("timed out after %s waiting for the %s: the backup volume '%s' is not bound", backupTimeout, resource, r.name)
+	}
+	return fmt.Errorf("timed out after %s waiting for the %s", backupTimeout, resource)
+}
+
+// transfer runs the command in the transfer pod.
+func (r *backupRun) transfer(ctx context.Context, command []string, stdin io.Reader, stdout io.Writer) error {
+	pod := transferPod(r.name, r.image)
+	if _, err := r.clientset.CoreV1().Pods(r.namespace).Create(ctx, pod, metav1.CreateOptions{}); err != nil {
+		return err
+	}
+	if err := r.wait(ctx, fmt.Sprintf("pod '%s'", pod.Name), func(ctx context.Context) error {
+		return waitForPod(ctx, r.clientset, r.namespace, pod.Name)
+	}); err != nil {
+		return err
+	}
+	if err := execPod(ctx, r.config, r.clientset, r.namespace, pod.Name, command, stdin, stdout); err != nil {
+		return err
+	}
+	return r.clientset.CoreV1().Pods(r.namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{})
+}
+
+// cleanup deletes the job, transfer pod and volume of the run.
+func (r *backupRun) cleanup() {
+	ctx := context.Background()
+	propagation := metav1.DeletePropagationBackground
+	deletes := []func() error{
+		func() error {
+			return r.clientset.BatchV1().Jobs(r.namespace).Delete(ctx, r.name, metav1.DeleteOptions{PropagationPolicy: &propagation})
+		},
+		func() error {
+			return r.clientset.CoreV1().Pods(r.namespace).Delete(ctx, transferPod(r.name, r.image).Name, metav1.DeleteOptions{})
+		},
+		func() error {
+			return r.clientset.CoreV1().PersistentVolumeClaims(r.namespace).Delete(ctx, r.name, metav1.DeleteOptions{})
+		},
+	}
+	for _, del := range deletes {
+		if err := del(); err != nil && !errors.IsNotFound(err) {
+			r.log.Warnf("error cleaning up the backup resources: %s", err)
+		}
+	}
+	// the volume is deleted once its pods are removed.
+	for i := 0; i < 30; i++ {
+		_, err := r.clientset.CoreV1().PersistentVolumeClaims(r.namespace).Get(ctx, r.name, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			return
+		}
+		time.Sleep(backupPollInterval)
+	}
+}
+
+// artifactWriter encrypts the artifact for the age recipient and sums
+// the encrypted artifact.
+type artifactWriter struct {
+	io.WriteCloser
+	hash hash.Hash
+}
+
+// newArtifactWriter returns a writer that encrypts the artifact to w.
+func newArtifactWriter(w io.Writer, recipient age.Recipient) (*artifactWriter, error) {
+	h := sha256.New()
+	encrypted, err := age.Encrypt(io.MultiWriter(w, h), recipient)
+	if err != nil {
+		return nil, err
+	}
+	return &artifactWriter{WriteCloser: encrypted, hash: h}, nil
+}
+
+// checksum returns the hex sha256 checksum of the encrypted artifact.
+// The writer must be closed first.
+func (w *artifactWriter) checksum() string {
+	return hex.EncodeToString(w.hash.Sum(nil))
+}
+
+// openArtifact downloads the artifact, verifies its checksum if it is
+// set and returns the decrypted artifact. The artifact is not
+// decrypted if identity is nil.
+func openArtifact(ctx context.Context, store backupStore, key, checksum string, identity age.Identity) (io.ReadCloser, error) {
+	r, err := store.get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	f, err := os.CreateTemp("", "trustacks-restore-")
+	if err != nil {
+		return nil, err
+	}
+	artifact := &tempFile{File: f}
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), r); err != nil {
+		artifact.Close()
+		return nil, err
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); checksum != "" && sum != checksum {
+		artifact.Close()
+		return nil, fmt.Errorf("the checksum of '%s' is %s instead of %s", key, sum, checksum)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		artifact.Close()
+		return nil, err
+	}
+	if identity == nil {
+		return artifact, nil
+	}
+	decrypted, err := age.Decrypt(f, identity)
+	if err != nil {
+		artifact.Close()
+		return nil, fmt.Errorf("error decrypting '%s': %s", key, err)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{decrypted, artifact}, nil
+}
+
+// tempFile is a temporary file that is removed when it is closed.
+type tempFile struct {
+	*os.File
+}
+
+// Close closes and removes the file.
+func (f *tempFile) Close() error {
+	f.File.Close()
+	return os.Remove(f.Name())
+}
+
+// backupComponent runs the backup job and stores the artifact encrypted
+// for the recipient. The checksum of the stored artifact is returned.
+func (tc *toolchain) backupComponent(ctx context.Context, component string, backup *componentBackup, store backupStore, key string, recipient age.Recipient) (string, error) {
+	r, err := tc.newBackupRun(ctx, component, backup)
+	if err != nil {
+		return "", err
+	}
+	defer r.cleanup()
+	r.log.Info("running the backup job")
+	if err := r.runJob(ctx, backup.Backup); err != nil {
+		return "", err
+	}
+	f, err := os.CreateTemp("", "trustacks-backup-")
+	if err != nil {
+		return "", err
+	}
+	artifact := &tempFile{File: f}
+	defer artifact.Close()
+	// the artifact is encrypted as it is copied, so the component data
+	// is never written to the local disk in clear.
+	w, err := newArtifactWriter(artifact, recipient)
+	if err != nil {
+		return "", err
+	}
+	if err := r.transfer(ctx, []string{"tar", "cf", "-", "-C", backupMountPath, "."}, nil, w); err != nil {
+		return "", fmt.Errorf("error copying the backup artifact: %s", err)
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	info, err := artifact.Stat()
+	if err != nil {
+		return "", err
+	}
+	if _, err := artifact.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	r.log.Infof("storing the %d byte artifact", info.Size())
+	if err := store.put(ctx, key, artifact, info.Size()); err != nil {
+		return "", err
+	}
+	return w.checksum(), nil
+}
+
+// restoreComponent copies the artifact to the backup volume and runs
+// the restore job.
+func (tc *toolchain) restoreComponent(ctx context.Context, component string, backup *componentBackup, store backupStore, key, checksum string, identity age.Identity) error {
+	artifact, err := openArtifact(ctx, store, key, checksum, identity)
+	if err != nil {
+		return fmt.Errorf("error reading the backup artifact: %s", err)
+	}
+	defer artifact.Close()
+	r, err := tc.newBackupRun(ctx, component, backup)
+	if err != nil {
+		return err
+	}
+	defer r.cleanup()
+	if err := r.transfer(ctx, []string{"tar", "xf", "-", "-C", backupMountPath}, artifact, io.Discard); err != nil {
+		return fmt.Errorf("error copying the backup artifact: %s", err)
+	}
+	r.log.Info("running the restore job")
+	return r.runJob(ctx, backup.Restore)
+}
+
+// storeBackup runs the backup function of each component of the index
+// and stores the index with the artifact checksums. The stored
+// artifacts are deleted if a component fails, so that a failed backup
+// does not leave a partial backup behind.
+func storeBackup(ctx context.Context, store backupStore, id string, index *backupIndex, backup func(component, key string) (string, error)) (err error) {
+	var keys []string
+	defer func() {
+		if err == nil {
+			return
+		}
+		// the context may be cancelled.
+		for _, key := range keys {
+			if deleteErr := store.delete(context.Background(), key); deleteErr != nil {
+				logger.Warnf("error deleting the partial backup artifact '%s': %s", key, deleteErr)
+			}
+		}
+	}()
+	index.Checksums = map[string]string{}
+	for _, component := range index.Components {
+		key := index.artifactKey(id, component)
+		// the artifact may be partially written when the backup fails.
+		keys = append(keys, key)
+		checksum, err := backup(component, key)
+		if err != nil {
+			return fmt.Errorf("error backing up '%s': %s", component, err)
+		}
+		index.Checksums[component] = checksum
+	}
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	return store.put(ctx, fmt.Sprintf("%s/%s", id, backupIndexFile), bytes.NewReader(data), int64(len(data)))
+}
+
+// Backup runs the backup jobs of the toolchain components and stores
+// the artifacts in the destination, which is a local directory or an
+// s3://<bucket>/<prefix> url. The id of the backup is returned.
+func Backup(ctx context.Context, name, destination string, opts *BackupOptions) (string, error) {
+	if opts == nil {
+		opts = &BackupOptions{}
+	}
+	tc, err := newToolchainFromConfig(name)
+	if err != nil {
+		return "", fmt.Errorf("error loading toolchain '%s': %s", name, err)
+	}
+	store, err := newBackupStore(destination, opts)
+	if err != nil {
+		return "", err
+	}
+	backups, err := tc.componentBackups()
+	if err != nil {
+		return "", err
+	}
+	if len(backups) == 0 {
+		return "", fmt.Errorf("the toolchain components do not declare backup jobs")
+	}
+	identity, err := tc.ageIdentity()
+	if err != nil {
+		return "", fmt.Errorf("error reading the toolchain age key: %s", err)
+	}
+	id := time.Now().UTC().Format("20060102T150405Z")
+	index := &backupIndex{Toolchain: tc.name, Encrypted: true}
+	for component, backup := range backups {
+		if backup.Backup != "" {
+			index.Components = append(index.Components, component)
+		}
+	}
+	sort.Strings(index.Components)
+	err = storeBackup(ctx, store, id, index, func(component, key string) (string, error) {
+		return tc.backupComponent(ctx, component, backups[component], store, key, identity.Recipient())
+	})
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// Restore runs the restore jobs of the components with the artifacts
+// of the backup.
+func Restore(ctx context.Context, name, source, id string, opts *BackupOptions) error {
+	if opts == nil {
+		opts = &BackupOptions{}
+	}
+	tc, err := newToolchainFromConfig(name)
+	if err != nil {
+		return fmt.Errorf("error loading toolchain '%s': %s", name, err)
+	}
+	store, err := newBackupStore(source, opts)
+	if err != nil {
+		return err
+	}
+	r, err := store.get(ctx, fmt.Sprintf("%s/%s", id, backupIndexFile))
+	if err != nil {
+		return fmt.Errorf("error reading backup '%s': %s", id, err)
+	}
+	defer r.Close()
+	index := &backupIndex{}
+	if err := json.NewDecoder(r).Decode(index); err != nil {
+		return err
+	}
+	if index.Toolchain != tc.name {
+		return fmt.Errorf("backup '%s' belongs to toolchain '%s'", id, index.Toolchain)
+	}
+	backups, err := tc.componentBackups()
+	if err != nil {
+		return err
+	}
+	// backups made before the artifacts were encrypted are restored
+	// as is.
+	var identity age.Identity
+	if index.Encrypted {
+		if identity, err = tc.ageIdentity(); err != nil {
+			return fmt.Errorf("error reading the toolchain age key: %s", err)
+		}
+	}
+	for _, component := range index.Components {
+		backup, ok := backups[component]
+		if !ok || backup.Restore == "" {
+			logger.WithField("component", component).Warn("the component does not declare a restore job")
+			continue
+		}
+		if err := tc.restoreComponent(ctx, component, backup, store, index.artifactKey(id, component), index.Checksums[component], identity); err != nil {
+			return fmt.Errorf("error restoring '%s': %s", component, err)
+		}
+	}
+	return nil
+}
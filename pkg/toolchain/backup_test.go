@@ -0,0 +1,290 @@
+package toolchain
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/assert"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const testBackupJob = `apiVersion: batch/v1
+kind: Job
+metadata:
+  name: postgres-backup
+spec:
+  template:
+    spec:
+      containers:
+      - name: backup
+        image: {{ .image }}
+        command: ["pg_dump", "-f", "/backup/{{ .database }}.sql"]
+`
+
+func TestAddBackupJobs(t *testing.T) {
+	defer patchToolchainRoot()()
+	catalog := &componentCatalog{
+		HookSource: "quay.io/trustacks/hooks:1.0.0",
+		Components: map[string]component{
+			"postgres": {Backup: &componentBackup{Backup: testBackupJob, Restore: testBackupJob, Size: "1Gi"}},
+			"none":     {},
+		},
+	}
+	tc := &toolchain{name: "test", config: &toolchainConfig{RegistryMirror: "registry.local"}}
+	if err := tc.addBackupJobs([]string{"postgres", "none"}, catalog, map[string]interface{}{"database": "sso"}); err != nil {
+		t.Fatal(err)
+	}
+	backups, err := tc.componentBackups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, backups, 1) {
+		backup := backups["postgres"]
+		assert.Equal(t, "1Gi", backup.Size)
+		assert.Contains(t, backup.Backup, "image: registry.local/quay.io/trustacks/hooks:1.0.0")
+		assert.Contains(t, backup.Restore, "/backup/sso.sql")
+	}
+}
+
+func TestBackupJob(t *testing.T) {
+	job, err := backupJob(strings.ReplaceAll(testBackupJob, "{{ .image }}", "postgres"), "trustacks-backup-postgres", "postgres")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "trustacks-backup-postgres", job.Name)
+	assert.Equal(t, "postgres", job.Labels[componentLabel])
+	assert.Equal(t, int32(0), *job.Spec.BackoffLimit)
+	assert.Equal(t, corev1.RestartPolicyNever, job.Spec.Template.Spec.RestartPolicy)
+	assert.Equal(t, "trustacks-backup-postgres", job.Spec.Template.Spec.Volumes[0].PersistentVolumeClaim.ClaimName)
+	assert.Equal(t, []corev1.VolumeMount{{Name: backupVolumeName, MountPath: backupMountPath}}, job.Spec.Template.Spec.Containers[0].VolumeMounts)
+
+	_, err = backupJob("apiVersion: v1\nkind: Pod\n", "test", "test")
+	assert.Error(t, err)
+}
+
+func TestWaitForJob(t *testing.T) {
+	defer func(interval time.Duration) { backupPollInterval = interval }(backupPollInterval)
+	backupPollInterval = time.Millisecond
+	clientset := fake.NewSimpleClientset(
+		&batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: "succeeded", Namespace: "trustacks"}, Status: batchv1.JobStatus{Succeeded: 1}},
+		&batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: "failed", Namespace: "trustacks"}, Status: batchv1.JobStatus{Failed: 1}},
+		&batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: "running", Namespace: "trustacks"}},
+	)
+	assert.NoError(t, waitForJob(context.TODO(), clientset, "trustacks", "succeeded"))
+	err := waitForJob(context.TODO(), clientset, "trustacks", "failed")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "job 'failed' failed")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, waitForJob(ctx, clientset, "trustacks", "running"), context.DeadlineExceeded)
+}
+
+func TestBackupRunTimeout(t *testing.T) {
+	defer func(interval, timeout time.Duration) {
+		backupPollInterval, backupTimeout = interval, timeout
+	}(backupPollInterval, backupTimeout)
+	backupPollInterval, backupTimeout = time.Millisecond, 10*time.Millisecond
+	clientset := fake.NewSimpleClientset(&corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "trustacks-backup-postgres", Namespace: "trustacks"},
+		Status:     corev1.PersistentVolumeClaimStatus{Phase: corev1.ClaimPending},
+	})
+	r := &backupRun{clientset: clientset, namespace: "trustacks", name: "trustacks-backup-postgres", component: "postgres"}
+	manifest := strings.NewReplacer("{{ .image }}", "postgres:14", "{{ .database }}", "trustacks").Replace(testBackupJob)
+	err := r.runJob(context.TODO(), manifest)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "the backup volume 'trustacks-backup-postgres' is not bound")
+	}
+}
+
+func TestLocalStore(t *testing.T) {
+	d, err := os.MkdirTemp("", "test-backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	store, err := newBackupStore(d, &BackupOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.put(context.TODO(), "id/postgres.tar", strings.NewReader("data"), 4); err != nil {
+		t.Fatal(err)
+	}
+	r, err := store.get(context.TODO(), "id/postgres.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "data", string(data))
+
+	if err := store.delete(context.TODO(), "id/postgres.tar"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.get(context.TODO(), "id/postgres.tar")
+	assert.True(t, os.IsNotExist(err), "expected the artifact to be deleted")
+	assert.NoError(t, store.delete(context.TODO(), "id/postgres.tar"), "expected deleting a missing artifact to succeed")
+}
+
+func TestS3Store(t *testing.T) {
+	objects := map[string][]byte{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=access/") || !strings.Contains(auth, "/us-east-1/s3/aws4_request") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.Method {
+		case http.MethodPut:
+			data, err := io.ReadAll(r.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			objects[r.URL.Path] = data
+		case http.MethodGet:
+			data, ok := objects[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if _, err := w.Write(data); err != nil {
+				t.Fatal(err)
+			}
+		case http.MethodDelete:
+			delete(objects, r.URL.Path)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer ts.Close()
+
+	if _, err := newBackupStore("s3://bucket", &BackupOptions{Endpoint: ts.URL}); err == nil {
+		t.Fatal("expected an error without credentials")
+	}
+	t.Setenv("AWS_ACCESS_KEY_ID", "access")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	store, err := newBackupStore("s3://bucket/toolchains/", &BackupOptions{Endpoint: ts.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.put(context.TODO(), "id/postgres.tar", bytes.NewReader([]byte("data")), 4); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []byte("data"), objects["/bucket/toolchains/id/postgres.tar"])
+	r, err := store.get(context.TODO(), "id/postgres.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "data", string(data))
+	_, err = store.get(context.TODO(), "id/missing.tar")
+	assert.Error(t, err)
+	if err := store.delete(context.TODO(), "id/postgres.tar"); err != nil {
+		t.Fatal(err)
+	}
+	assert.NotContains(t, objects, "/bucket/toolchains/id/postgres.tar", "expected the object to be deleted")
+}
+
+func TestTransferPodLifetime(t *testing.T) {
+	defer func(timeout time.Duration) { backupTimeout = timeout }(backupTimeout)
+	backupTimeout = 10 * time.Minute
+	pod := transferPod("trustacks-backup-postgres", "busybox:1.35")
+	assert.Equal(t, []string{"sleep", "600"}, pod.Spec.Containers[0].Command, "expected the pod to exit after the backup timeout")
+}
+
+func TestBackupArtifact(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var encrypted bytes.Buffer
+	w, err := newArtifactWriter(&encrypted, identity.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("database dump")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	assert.NotContains(t, encrypted.String(), "database dump", "expected the artifact to be encrypted")
+	sum := sha256.Sum256(encrypted.Bytes())
+	assert.Equal(t, hex.EncodeToString(sum[:]), w.checksum(), "expected the checksum of the encrypted artifact")
+
+	store := &localStore{dir: t.TempDir()}
+	if err := store.put(context.TODO(), "id/postgres.tar.age", bytes.NewReader(encrypted.Bytes()), int64(encrypted.Len())); err != nil {
+		t.Fatal(err)
+	}
+	r, err := openArtifact(context.TODO(), store, "id/postgres.tar.age", w.checksum(), identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, r.Close())
+	assert.Equal(t, "database dump", string(data), "expected the decrypted artifact")
+
+	_, err = openArtifact(context.TODO(), store, "id/postgres.tar.age", strings.Repeat("0", 64), identity)
+	assert.ErrorContains(t, err, "the checksum of 'id/postgres.tar.age'", "expected a checksum error")
+}
+
+func TestStoreBackup(t *testing.T) {
+	store := &localStore{dir: t.TempDir()}
+	index := &backupIndex{Toolchain: "test", Components: []string{"gitea", "postgres"}, Encrypted: true}
+	err := storeBackup(context.TODO(), store, "id", index, func(component, key string) (string, error) {
+		if err := store.put(context.TODO(), key, strings.NewReader("data"), 4); err != nil {
+			return "", err
+		}
+		if component == "postgres" {
+			return "", errors.New("job failed")
+		}
+		return "checksum", nil
+	})
+	assert.EqualError(t, err, "error backing up 'postgres': job failed")
+	for _, key := range []string{"id/gitea.tar.age", "id/postgres.tar.age", "id/" + backupIndexFile} {
+		_, err := os.Stat(filepath.Join(store.dir, filepath.FromSlash(key)))
+		assert.True(t, os.IsNotExist(err), "expected '%s' to be removed", key)
+	}
+
+	err = storeBackup(context.TODO(), store, "id", index, func(component, key string) (string, error) {
+		return component + "-checksum", nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := store.get(context.TODO(), "id/"+backupIndexFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	stored := &backupIndex{}
+	if err := json.NewDecoder(r).Decode(stored); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, map[string]string{"gitea": "gitea-checksum", "postgres": "postgres-checksum"}, stored.Checksums, "expected the artifact checksums in the index")
+}
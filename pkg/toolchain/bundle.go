@@ -0,0 +1,281 @@
+package toolchain
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// bundleManifestFile is the name of the bundle index file.
+const bundleManifestFile = "bundle.json"
+
+// bundleManifest indexes the contents of an offline bundle.
+type bundleManifest struct {
+	Name string `json:"name"`
+	// Sources maps the git repository urls to the bundle directories
+	// of the cloned sources.
+	Sources map[string]string `json:"sources"`
+	// Catalogs maps the component catalog urls to the bundle catalog
+	// manifest files.
+	Catalogs map[string]string `json:"catalogs"`
+	// Images are the container images referenced in the rendered
+	// manifests.
+	Images []string `json:"images"`
+}
+
+// bundle is an extracted offline bundle.
+type bundle struct {
+	path     string
+	manifest *bundleManifest
+}
+
+// openBundle extracts the bundle archive into a temporary directory.
+func openBundle(archive string) (*bundle, error) {
+	d, err := os.MkdirTemp("", "toolchain-bundle")
+	if err != nil {
+		return nil, err
+	}
+	b := &bundle{path: d}
+	if err := extractArchive(archive, d); err != nil {
+		b.remove()
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(d, bundleManifestFile))
+	if err != nil {
+		b.remove()
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &b.manifest); err != nil {
+		b.remove()
+		return nil, err
+	}
+	return b, nil
+}
+
+// remove deletes the extracted bundle.
+func (b *bundle) remove() {
+	if err := os.RemoveAll(b.path); err != nil {
+		logger.Warnf("error removing the extracted bundle: %s", err)
+	}
+}
+
+// clone copies the bundled source of the clone url to the path. It
+// replaces git.PlainClone when installing from the bundle.
+func (b *bundle) clone(path string, _ bool, o *git.CloneOptions) (*git.Repository, error) {
+	dir, ok := b.manifest.Sources[o.URL]
+	if !ok {
+		return nil, fmt.Errorf("source '%s' is not in the bundle", o.URL)
+	}
+	if err := copyDir(filepath.Join(b.path, dir), path); err != nil {
+		return nil, err
+	}
+	repo, err := git.PlainOpen(path)
+	if err == git.ErrRepositoryNotExists {
+		return nil, nil
+	}
+	return repo, err
+}
+
+// catalog returns the bundled component catalog of the url.
+func (b *bundle) catalog(url string) (*componentCatalog, error) {
+	file, ok := b.manifest.Catalogs[url]
+	if !ok {
+		return nil, fmt.Errorf("catalog '%s' is not in the bundle", url)
+	}
+	data, err := os.ReadFile(filepath.Join(b.path, file))
+	if err != nil {
+		return nil, err
+	}
+	return parseCatalogManifest(data)
+}
+
+// copyChart copies the bundled component chart to the path.
+func (b *bundle) copyChart(name, path string) error {
+	src := filepath.Join(b.path, "charts", name)
+	if _, err := os.Stat(src); err != nil {
+		return fmt.Errorf("chart '%s' is not in the bundle", name)
+	}
+	return copyDir(src, path)
+}
+
+// addSource clones the git repository into the bundle.
+func (b *bundle) addSource(url string, cloneFunc func(string, bool, *git.CloneOptions) (*git.Repository, error)) error {
+	if _, ok := b.manifest.Sources[url]; ok {
+		return nil
+	}
+	dir := filepath.Join("sources", fmt.Sprint(len(b.manifest.Sources)))
+	if _, err := cloneFunc(filepath.Join(b.path, dir), false, &git.CloneOptions{
+		URL:           url,
+		Depth:         1,
+		SingleBranch:  true,
+		ReferenceName: plumbing.NewBranchReferenceName("main"),
+	}); err != nil {
+		return err
+	}
+	b.manifest.Sources[url] = dir
+	return nil
+}
+
+// addCatalog downloads the component catalog manifest into the bundle.
+func (b *bundle) addCatalog(ctx context.Context, url string) (*componentCatalog, error) {
+	file := filepath.Join("catalogs", fmt.Sprintf("%d.json", len(b.manifest.Catalogs)))
+	if f, ok := b.manifest.Catalogs[url]; ok {
+		file = f
+	}
+	data, err := getCatalogManifest(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	catalog, err := parseCatalogManifest(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Join(b.path, "catalogs"), 0755); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(b.path, file), data, 0644); err != nil {
+		return nil, err
+	}
+	b.manifest.Catalogs[url] = file
+	return catalog, nil
+}
+
+// BundleOptions contains the optional toolchain bundle parameters.
+type BundleOptions struct {
+	// Parameters are merged over the config file parameters.
+	Parameters map[string]interface{}
+	// Env is the environment overlay merged over the config file.
+	Env string
+}
+
+// Bundle creates an offline bundle archive of the toolchain.
+//
+// The bundle contains the cloned toolchain source, the component
+// catalog manifests, the component charts, the workflow catalogs of
+// the configured applications and the list of the container images
+// referenced in the rendered manifests. The images are returned so
+// that they can be mirrored into the disconnected environment.
+func Bundle(ctx context.Context, configPath, output string, cloneFunc func(string, bool, *git.CloneOptions) (*git.Repository, error), opts *BundleOptions) ([]string, error) {
+	if opts == nil {
+		opts = &BundleOptions{}
+	}
+	config, err := loadToolchainConfig(configPath, opts.Env)
+	if err != nil {
+		return nil, fmt.Errorf("error loading the toolchain config: %s", err)
+	}
+	if opts.Parameters != nil {
+		config.Parameters = mergeValues(config.Parameters, opts.Parameters)
+	}
+	staging, err := os.MkdirTemp("", "toolchain-bundle")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(staging)
+	b := &bundle{
+		path: filepath.Join(staging, "bundle"),
+		manifest: &bundleManifest{
+			Name:     config.Name,
+			Sources:  make(map[string]string),
+			Catalogs: make(map[string]string),
+		},
+	}
+	// the toolchain is staged outside of the toolchain root so that the
+	// bundled charts are not mixed with the installed toolchains. The
+	// registry mirror is ignored so that the source images are listed.
+	stagingConfig := *config
+	stagingConfig.RegistryMirror = ""
+	tc := &toolchain{name: config.Name, root: filepath.Join(staging, "toolchains"), config: &stagingConfig}
+
+	logger.WithField("source", config.Source).Info("bundling the toolchain source")
+	if err := b.addSource(config.Source, cloneFunc); err != nil {
+		return nil, fmt.Errorf("error cloning the toolchain source: %s", err)
+	}
+	if _, err := b.clone(tc.path(), false, &git.CloneOptions{URL: config.Source}); err != nil {
+		return nil, err
+	}
+	if err := tc.readManifest(); err != nil {
+		return nil, fmt.Errorf("error reading the toolchain manifest: %s", err)
+	}
+	dependencies := append([]toolchainDependencies{}, tc.Dependencies...)
+	for _, app := range config.Applications {
+		logger.WithField("source", app.Source).Info("bundling the workflow catalog")
+		if err := b.addSource(app.Source, cloneFunc); err != nil {
+			return nil, fmt.Errorf("error cloning the workflow catalog: %s", err)
+		}
+		catalog, err := getWorkflowCatalog(app.Source, app.Version, b.clone)
+		if err != nil {
+			return nil, fmt.Errorf("error reading the workflow catalog: %s", err)
+		}
+		for _, wf := range catalog.Workflows {
+			if wf.Name != app.Workflow {
+				continue
+			}
+			for _, dep := range wf.Dependencies {
+				dependencies = append(dependencies, toolchainDependencies{Catalog: dep.Catalog, Components: dep.Components})
+			}
+		}
+	}
+
+	var images []string
+	for _, dep := range dependencies {
+		logger.WithField("catalog", dep.Catalog).Info("bundling the component catalog")
+		catalog, err := b.addCatalog(ctx, dep.Catalog)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching catalog: %s", err)
+		}
+		if err := tc.addComponents(ctx, dep.Components, catalog); err != nil {
+			return nil, fmt.Errorf("error adding subcharts: %s", err)
+		}
+		// the charts are bundled before the hooks and values are
+		// rendered into them.
+		for _, name := range dep.Components {
+			if _, err := os.Stat(filepath.Join(b.path, "charts", name)); err == nil {
+				continue
+			}
+			if err := copyDir(filepath.Join(tc.componentsPath(), name), filepath.Join(b.path, "charts", name)); err != nil {
+				return nil, err
+			}
+		}
+		parameters := tc.join(config.Parameters, catalog.Config.Parameters)
+		if err := tc.addHooks(dep.Components, catalog, parameters); err != nil {
+			return nil, fmt.Errorf("error adding hook templates: %s", err)
+		}
+		if err := tc.addSubChartValues(dep.Components, catalog, parameters); err != nil {
+			return nil, fmt.Errorf("error adding subchart values: %s", err)
+		}
+		for _, name := range dep.Components {
+			manifests, err := tc.renderComponent(name)
+			if err != nil {
+				return nil, fmt.Errorf("error rendering '%s': %s", name, err)
+			}
+			componentImages, err := manifestImages(manifests)
+			if err != nil {
+				return nil, fmt.Errorf("error listing the '%s' images: %s", name, err)
+			}
+			images = append(images, componentImages...)
+		}
+	}
+	b.manifest.Images = uniqueStrings(images)
+
+	data, err := json.MarshalIndent(b.manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(b.path, bundleManifestFile), data, 0644); err != nil {
+		return nil, err
+	}
+	imageList := strings.Join(b.manifest.Images, "\n")
+	if err := os.WriteFile(filepath.Join(b.path, "images.txt"), []byte(imageList+"\n"), 0644); err != nil {
+		return nil, err
+	}
+	if err := writeArchive(b.path, output); err != nil {
+		return nil, fmt.Errorf("error writing the bundle: %s", err)
+	}
+	return b.manifest.Images, nil
+}
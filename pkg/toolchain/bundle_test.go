@@ -0,0 +1,118 @@
+package toolchain
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBundle(t *testing.T) {
+	defer patchToolchainRoot()()
+	hooks, err := os.ReadFile(filepath.Join("testdata", "hooks.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var catalogURL string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/catalog-manifest":
+			data, err := json.Marshal(&componentCatalog{
+				HookSource: "quay.io/trustacks/catalog:latest",
+				Components: map[string]component{
+					"helloworld": {
+						Repo:    fmt.Sprintf("%s/charts", catalogURL),
+						Chart:   "helloworld",
+						Version: "1.0.0",
+						Hooks:   string(hooks),
+					},
+				},
+				Config: &componentCatalogConfig{Parameters: []componentCatalogConfigParameters{{Name: "testParam", Default: "test"}}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := w.Write(data); err != nil {
+				t.Fatal(err)
+			}
+		case "/charts/helloworld-1.0.0.tgz":
+			data, err := os.ReadFile(filepath.Join("testdata", "helloworld-1.0.0.tgz"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := w.Write(data); err != nil {
+				t.Fatal(err)
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+	catalogURL = ts.URL
+
+	sources := map[string]string{
+		"https://git.example.com/toolchain.git": fmt.Sprintf("dependencies:\n- catalog: %s\n  components:\n  - helloworld\n", ts.URL),
+		"https://git.example.com/workflows.git": "workflows:\n- name: test\n",
+	}
+	mockPlainClone := func(basePath string, _ bool, o *git.CloneOptions) (*git.Repository, error) {
+		if err := os.MkdirAll(basePath, 0755); err != nil {
+			return nil, err
+		}
+		return nil, os.WriteFile(filepath.Join(basePath, "config.yaml"), []byte(sources[o.URL]), 0644)
+	}
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	config := `name: test
+source: https://git.example.com/toolchain.git
+applications:
+- name: app
+  source: https://git.example.com/workflows.git
+  workflow: test
+`
+	if err := os.WriteFile(configPath, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	output := filepath.Join(t.TempDir(), "bundle.tar.gz")
+	images, err := Bundle(context.Background(), configPath, output, mockPlainClone, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"quay.io/trustacks/catalog:latest", "tutum/hello-world:latest"}, images, "got unexpected bundle images")
+	assert.NoDirExists(t, filepath.Join(toolchainRoot, "test"), "expected the installed toolchains to be untouched")
+
+	b, err := openBundle(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.remove()
+	assert.Len(t, b.manifest.Sources, 2, "expected the toolchain source and workflow catalog")
+	catalog, err := b.catalog(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "1.0.0", catalog.Components["helloworld"].Version, "got an unexpected bundled catalog")
+	assert.FileExists(t, filepath.Join(b.path, "images.txt"))
+
+	tc := &toolchain{name: "test", bundle: b}
+	if err := tc.addComponents(context.TODO(), []string{"helloworld"}, catalog); err != nil {
+		t.Fatal(err)
+	}
+	assert.FileExists(t, filepath.Join(tc.componentsPath(), "helloworld", "Chart.yaml"), "expected the bundled chart")
+	assert.NoFileExists(t, filepath.Join(tc.componentsPath(), "helloworld", "templates", "trustacks-hooks.yaml"), "expected the bundled chart to be unrendered")
+
+	if _, err := b.clone(tc.path(), false, &git.CloneOptions{URL: "https://git.example.com/toolchain.git"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.readManifest(); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, ts.URL, tc.Dependencies[0].Catalog, "got an unexpected bundled toolchain source")
+	_, err = b.clone(t.TempDir(), false, &git.CloneOptions{URL: "https://git.example.com/unknown.git"})
+	assert.Error(t, err, "expected an error for a source that is not bundled")
+}
@@ -0,0 +1,130 @@
+package toolchain
+
+import (
+	"fmt"
+	"sort"
+)
+
+// clusterConfig is a named cluster target that toolchain components
+// are installed to.
+type clusterConfig struct {
+	// Context is the kubeconfig context of the cluster.
+	Context string `json:"context"`
+	// Kubeconfig is the kubeconfig path. The default kubeconfig is
+	// used if it is empty.
+	Kubeconfig string `json:"kubeconfig"`
+	// Components is the group of components installed to the
+	// cluster.
+	Components []string `json:"components"`
+}
+
+// componentConfig contains the toolchain configuration of a
+// component.
+type componentConfig struct {
+	// Cluster is the name of the cluster target of the component.
+	Cluster string `json:"cluster"`
+	// Values are deep merged over the rendered catalog values.
+	Values map[string]interface{} `json:"values"`
+	// Patches are RFC 6902 JSON patch operations applied to the
+	// merged values.
+	Patches []map[string]interface{} `json:"patches"`
+	// Version pins the chart version of the component.
+	Version string `json:"version"`
+	// Repository overrides the chart repository of the component.
+	Repository string `json:"repository"`
+}
+
+// validateClusters checks that the component cluster targets exist and
+// that no component is assigned to more than one cluster.
+func validateClusters(config *toolchainConfig) error {
+	assigned := map[string]string{}
+	names := make([]string, 0, len(config.Clusters))
+	for name := range config.Clusters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, component := range config.Clusters[name].Components {
+			if cluster, ok := assigned[component]; ok {
+				return fmt.Errorf("component '%s' is assigned to clusters '%s' and '%s'", component, cluster, name)
+			}
+			assigned[component] = name
+		}
+	}
+	for component, c := range config.Components {
+		if c.Cluster == "" {
+			continue
+		}
+		if _, ok := config.Clusters[c.Cluster]; !ok {
+			return fmt.Errorf("component '%s' references unknown cluster '%s'", component, c.Cluster)
+		}
+		if cluster, ok := assigned[component]; ok && cluster != c.Cluster {
+			return fmt.Errorf("component '%s' is assigned to clusters '%s' and '%s'", component, cluster, c.Cluster)
+		}
+	}
+	return nil
+}
+
+// clusterName returns the name of the cluster target of the
+// component. An empty name is the default cluster.
+func (tc *toolchain) clusterName(component string) string {
+	if tc.config == nil {
+		return ""
+	}
+	if c, ok := tc.config.Components[component]; ok && c.Cluster != "" {
+		return c.Cluster
+	}
+	for name, cluster := range tc.config.Clusters {
+		for _, c := range cluster.Components {
+			if c == component {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// cluster returns the cluster target of the component. A nil cluster
+// is the default cluster.
+func (tc *toolchain) cluster(component string) *clusterConfig {
+	name := tc.clusterName(component)
+	if name == "" {
+		return nil
+	}
+	cluster := tc.config.Clusters[name]
+	return &cluster
+}
+
+// clusterTarget is a cluster target of the toolchain. The default
+// cluster has an empty name and a nil config.
+type clusterTarget struct {
+	name   string
+	config *clusterConfig
+}
+
+// clusters returns the default cluster followed by the named cluster
+// targets sorted by name.
+func (tc *toolchain) clusters() []clusterTarget {
+	clusters := []clusterTarget{{}}
+	if tc.config == nil {
+		return clusters
+	}
+	names := make([]string, 0, len(tc.config.Clusters))
+	for name := range tc.config.Clusters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		cluster := tc.config.Clusters[name]
+		clusters = append(clusters, clusterTarget{name: name, config: &cluster})
+	}
+	return clusters
+}
+
+// clusterLabel returns the display name of the cluster target.
+func clusterLabel(cluster *clusterConfig) string {
+	if cluster == nil {
+		return "default"
+	}
+	return cluster.Context
+}
@@ -0,0 +1,50 @@
+package toolchain
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateClusters(t *testing.T) {
+	config := &toolchainConfig{
+		Clusters: map[string]clusterConfig{
+			"build":  {Context: "k3d-build", Components: []string{"concourse"}},
+			"shared": {Context: "k3d-shared"},
+		},
+		Components: map[string]componentConfig{
+			"authentik": {Cluster: "shared"},
+		},
+	}
+	assert.Nil(t, validateClusters(config), "expected the cluster targets to be valid")
+
+	config.Components["concourse"] = componentConfig{Cluster: "shared"}
+	assert.ErrorContains(t, validateClusters(config), "component 'concourse' is assigned to clusters 'build' and 'shared'", "expected a duplicate assignment error")
+
+	config.Components["concourse"] = componentConfig{Cluster: "missing"}
+	assert.ErrorContains(t, validateClusters(config), "component 'concourse' references unknown cluster 'missing'", "expected an unknown cluster error")
+}
+
+func TestToolchainCluster(t *testing.T) {
+	tc := &toolchain{
+		config: &toolchainConfig{
+			Clusters: map[string]clusterConfig{
+				"build":  {Context: "k3d-build", Components: []string{"concourse"}},
+				"shared": {Context: "k3d-shared"},
+			},
+			Components: map[string]componentConfig{
+				"authentik": {Cluster: "shared"},
+			},
+		},
+	}
+	assert.Equal(t, "k3d-build", tc.cluster("concourse").Context, "expected the component group cluster")
+	assert.Equal(t, "k3d-shared", tc.cluster("authentik").Context, "expected the component cluster")
+	assert.Nil(t, tc.cluster("dind"), "expected the default cluster")
+
+	clusters := tc.clusters()
+	assert.Len(t, clusters, 3, "expected the default and named clusters")
+	assert.Equal(t, clusterTarget{}, clusters[0], "expected the default cluster first")
+	assert.Equal(t, "build", clusters[1].name, "expected the clusters to be sorted by name")
+	assert.Equal(t, "k3d-build", clusters[1].config.Context, "expected the cluster config with its name")
+	assert.Nil(t, (&toolchain{}).cluster("concourse"), "expected the default cluster without a config")
+}
@@ -0,0 +1,207 @@
+package toolchain
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// envVarPattern matches the ${VAR} environment variable references,
+// and the $$ escapes, in the config files.
+var envVarPattern = regexp.MustCompile(`\$\$|\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// interpolateString replaces the ${VAR} references of the value with
+// the values of the environment variables, and the $$ escapes with a
+// literal $. The references to unset variables are kept and recorded
+// in missing.
+func interpolateString(value string, missing map[string]bool) string {
+	return envVarPattern.ReplaceAllStringFunc(value, func(match string) string {
+		if match == "$$" {
+			return "$"
+		}
+		name := envVarPattern.FindStringSubmatch(match)[1]
+		env, ok := os.LookupEnv(name)
+		if !ok {
+			missing[name] = true
+			return match
+		}
+		return env
+	})
+}
+
+// envReference is a config string value that references environment
+// variables.
+type envReference struct {
+	// Template is the value in the config file.
+	Template string
+	// Value is the interpolated value.
+	Value string
+}
+
+// interpolateValues interpolates the string scalars of the parsed
+// config values. The keys and the structure of the values are never
+// changed, so the environment variable values cannot inject config
+// keys. The values that reference environment variables are recorded
+// in refs by their path.
+func interpolateValues(value interface{}, path string, refs map[string]envReference, missing map[string]bool) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		interpolated := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			interpolated[key] = interpolateValues(item, path+"/"+key, refs, missing)
+		}
+		return interpolated
+	case []interface{}:
+		interpolated := make([]interface{}, len(v))
+		for i, item := range v {
+			interpolated[i] = interpolateValues(item, fmt.Sprintf("%s/%d", path, i), refs, missing)
+		}
+		return interpolated
+	case string:
+		interpolated := interpolateString(v, missing)
+		if interpolated != v {
+			refs[path] = envReference{Template: v, Value: interpolated}
+		}
+		return interpolated
+	}
+	return value
+}
+
+// restoreEnvReferences replaces the interpolated values of the config
+// values with the environment variable references they were read from,
+// so that the environment variable values are not stored. The $ of the
+// other string values are escaped so that they are kept when the
+// values are interpolated again.
+func restoreEnvReferences(value interface{}, path string, refs map[string]envReference) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = restoreEnvReferences(item, path+"/"+key, refs)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = restoreEnvReferences(item, fmt.Sprintf("%s/%d", path, i), refs)
+		}
+	case string:
+		if ref, ok := refs[path]; ok && ref.Value == v {
+			return ref.Template
+		}
+		return strings.ReplaceAll(v, "$", "$$")
+	}
+	return value
+}
+
+// missingEnvError returns the error of the unset environment variables.
+func missingEnvError(missing map[string]bool) error {
+	names := make([]string, 0, len(missing))
+	for name := range missing {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return fmt.Errorf("environment variables are not set: %s", strings.Join(names, ", "))
+}
+
+// readConfigValues reads the config file values. The values are not
+// interpolated.
+func readConfigValues(path string) (map[string]interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]interface{}{}
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return values, nil
+}
+
+// decodeConfigValues interpolates the config values and decodes them
+// into a toolchain config. Unset environment variables are an error
+// if strict is set, and are kept as is otherwise.
+func decodeConfigValues(values map[string]interface{}, strict bool) (*toolchainConfig, error) {
+	refs := map[string]envReference{}
+	missing := map[string]bool{}
+	interpolated := interpolateValues(values, "", refs, missing)
+	if len(missing) > 0 && strict {
+		return nil, missingEnvError(missing)
+	}
+	rawConfig, err := yaml.Marshal(interpolated)
+	if err != nil {
+		return nil, err
+	}
+	var config *toolchainConfig
+	if err := yaml.Unmarshal(rawConfig, &config); err != nil {
+		return nil, err
+	}
+	if config != nil {
+		config.envReferences = refs
+	}
+	return config, nil
+}
+
+// encodeConfig encodes the toolchain config with the environment
+// variable references in place of their values.
+func encodeConfig(config *toolchainConfig) ([]byte, error) {
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	var values interface{}
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return nil, err
+	}
+	var refs map[string]envReference
+	if config != nil {
+		refs = config.envReferences
+	}
+	return yaml.Marshal(restoreEnvReferences(values, "", refs))
+}
+
+// overlayPath returns the path of the environment overlay of the
+// config file. The overlay of config.yaml for the staging environment
+// is config.staging.yaml.
+func overlayPath(path, env string) string {
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s.%s%s", strings.TrimSuffix(path, ext), env, ext)
+}
+
+// mergeConfigValues deep merges the overlay over the base config
+// values.
+//
+// Applications are merged by name. Overlay applications that are not
+// in the base config are appended.
+func mergeConfigValues(base, overlay map[string]interface{}) map[string]interface{} {
+	baseApps, _ := base["applications"].([]interface{})
+	overlayApps, _ := overlay["applications"].([]interface{})
+	merged := mergeValues(base, overlay)
+	if overlayApps == nil {
+		return merged
+	}
+	apps := make([]interface{}, len(baseApps))
+	copy(apps, baseApps)
+	for _, overlayApp := range overlayApps {
+		overlayAppValues, ok := overlayApp.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		found := false
+		for i, app := range apps {
+			appValues, ok := app.(map[string]interface{})
+			if ok && appValues["name"] == overlayAppValues["name"] {
+				apps[i] = mergeValues(appValues, overlayAppValues)
+				found = true
+				break
+			}
+		}
+		if !found {
+			apps = append(apps, overlayAppValues)
+		}
+	}
+	merged["applications"] = apps
+	return merged
+}
@@ -0,0 +1,94 @@
+package toolchain
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+func TestInterpolateValues(t *testing.T) {
+	t.Setenv("TEST_INTERPOLATE_VALUE", "value")
+	t.Setenv("TEST_INTERPOLATE_INJECT", "x\ninjected: true # comment")
+	values := map[string]interface{}{}
+	data := "key: ${TEST_INTERPOLATE_VALUE}\nprice: $5\nescaped: [\"p$$${TEST_INTERPOLATE_VALUE}\", \"$${TEST_INTERPOLATE_MISSING}\"]\npassword: \"${TEST_INTERPOLATE_INJECT}\"\n# unset ${TEST_INTERPOLATE_MISSING}\n"
+	if err := yaml.Unmarshal([]byte(data), &values); err != nil {
+		t.Fatal(err)
+	}
+	refs := map[string]envReference{}
+	missing := map[string]bool{}
+	interpolated := interpolateValues(values, "", refs, missing)
+	assert.Empty(t, missing, "expected the commented reference to be ignored")
+	assert.Equal(t, map[string]interface{}{
+		"key":      "value",
+		"price":    "$5",
+		"escaped":  []interface{}{"p$value", "${TEST_INTERPOLATE_MISSING}"},
+		"password": "x\ninjected: true # comment",
+	}, interpolated, "got unexpected interpolated values")
+	assert.Equal(t, envReference{Template: "${TEST_INTERPOLATE_VALUE}", Value: "value"}, refs["/key"], "expected the reference to be recorded")
+
+	interpolateValues(map[string]interface{}{"key": "${TEST_INTERPOLATE_MISSING}"}, "", refs, missing)
+	assert.ErrorContains(t, missingEnvError(missing), "environment variables are not set: TEST_INTERPOLATE_MISSING", "expected a missing variable error")
+}
+
+func TestEncodeConfigEnvReferences(t *testing.T) {
+	t.Setenv("TEST_ENCODE_PASSWORD", "secret")
+	config, err := decodeConfigValues(map[string]interface{}{
+		"name":       "test",
+		"parameters": map[string]interface{}{"password": "${TEST_ENCODE_PASSWORD}", "price": "$$5"},
+	}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "secret", config.Parameters["password"], "expected the interpolated password")
+	config.Parameters["user"] = "a${TEST_ENCODE_PASSWORD}"
+	data, err := encodeConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotContains(t, string(data), "secret", "expected the environment variable value not to be encoded")
+
+	values := map[string]interface{}{}
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := decodeConfigValues(values, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, map[string]interface{}{
+		"password": "secret",
+		"price":    "$5",
+		"user":     "a${TEST_ENCODE_PASSWORD}",
+	}, decoded.Parameters, "expected the encoded config to decode to the same values")
+}
+
+func TestOverlayPath(t *testing.T) {
+	assert.Equal(t, filepath.Join("configs", "config.prod.yaml"), overlayPath(filepath.Join("configs", "config.yaml"), "prod"), "got an unexpected overlay path")
+}
+
+func TestLoadToolchainConfigOverlay(t *testing.T) {
+	t.Setenv("TEST_INGRESS_PORT", "8081")
+	config, err := loadToolchainConfig(filepath.Join("testdata", "overlay", "config.yaml"), "prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "overlay", config.Name, "expected the base config name")
+	assert.Equal(t, "true", config.Parameters["tls"], "expected the overlay parameter")
+	assert.Equal(t, "concourse", config.Parameters["ci"], "expected the base parameter")
+	assert.Equal(t, "8081", config.Parameters["ingressPort"], "expected the interpolated parameter")
+	assert.Len(t, config.Applications, 2, "expected the overlay application to be appended")
+	assert.Equal(t, "react", config.Applications[0].Workflow, "expected the base application workflow")
+	assert.Equal(t, map[string]string{"target": "prod", "replicas": "1"}, config.Applications[0].Vars, "expected the application vars to be merged")
+	assert.Equal(t, "api", config.Applications[1].Name, "got an unexpected overlay application")
+	dir, err := filepath.Abs(filepath.Join("testdata", "overlay"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, filepath.Join(dir, "overlays", "prod"), config.PostRender.Kustomize, "expected the kustomize path to be relative to the config file")
+	assert.Equal(t, filepath.Join(dir, "bin", "render"), config.PostRender.Exec.Command, "expected the exec command to be relative to the config file")
+
+	_, err = loadToolchainConfig(filepath.Join("testdata", "overlay", "config.yaml"), "missing")
+	assert.ErrorContains(t, err, "error loading the 'missing' overlay", "expected a missing overlay error")
+}
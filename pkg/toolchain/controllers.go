@@ -0,0 +1,440 @@
+package toolchain
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"helm.sh/helm/v3/pkg/registry"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"sigs.k8s.io/yaml"
+)
+
+// gitops controller installer backends.
+const (
+	// installerArgoCD installs the components as argo cd applications.
+	installerArgoCD = "argocd"
+	// installerFlux installs the components as flux helm releases.
+	installerFlux = "flux"
+)
+
+// argoCDConfig contains the argo cd application settings.
+type argoCDConfig struct {
+	// Namespace is the argo cd namespace. It defaults to argocd.
+	Namespace string `json:"namespace"`
+	// Project is the argo cd project. It defaults to default.
+	Project string `json:"project"`
+	// Server is the destination cluster api server. It defaults to the
+	// cluster that argo cd is running in.
+	Server string `json:"server"`
+}
+
+// fluxConfig contains the flux helm release settings.
+type fluxConfig struct {
+	// Interval is the reconciliation interval. It defaults to 10m.
+	Interval string `json:"interval"`
+}
+
+// controllerResourcesDir is the toolchain chart directory of the
+// controller resources. The resources are chart files instead of
+// templates so that the inlined values are not rendered by helm.
+const controllerResourcesDir = "trustacks-controllers"
+
+// controllerResourcesTemplate includes the controller resources in
+// the toolchain chart.
+const controllerResourcesTemplate = `{{- range $path, $_ := .Files.Glob "trustacks-controllers/*.yaml" }}
+---
+{{ $.Files.Get $path }}
+{{- end }}
+`
+
+// controllerInstaller returns true if the components are installed by
+// a gitops controller.
+func (tc *toolchain) controllerInstaller() bool {
+	installer := tc.installer()
+	return installer == installerArgoCD || installer == installerFlux
+}
+
+// resetControllerResources removes the controller resources of the
+// toolchain chart and adds the template that includes them.
+func (tc *toolchain) resetControllerResources() error {
+	chart := filepath.Join(tc.path(), "chart")
+	if err := os.RemoveAll(filepath.Join(chart, controllerResourcesDir)); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(chart, controllerResourcesDir), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(chart, "templates", "trustacks-controllers.yaml"), []byte(controllerResourcesTemplate), 0644)
+}
+
+// addControllerResources adds the argo cd applications or the flux
+// helm releases of the components to the toolchain chart.
+//
+// The override values are inlined in the resources. The credentials
+// and certificates of the component repositories are added as
+// repository secrets. Components with catalog hooks are not supported,
+// because the controllers install the charts from their repositories,
+// so the hooks can not run with the component.
+func (tc *toolchain) addControllerResources(ctx context.Context, components []string, catalog *componentCatalog) error {
+	var hooks []string
+	for _, name := range components {
+		c := tc.component(name, catalog)
+		if !c.helm() {
+			return fmt.Errorf("%s component '%s' is not supported by the %s installer", c.Type, name, tc.installer())
+		}
+		if strings.TrimSpace(c.Hooks) != "" {
+			hooks = append(hooks, name)
+		}
+	}
+	if len(hooks) > 0 {
+		return fmt.Errorf("the catalog hooks of %s are not supported by the %s installer: the controller installs the charts from their repositories after the toolchain release, so the hooks can not run before or after the components; use the helm or gitops installer instead", quoteNames(hooks), tc.installer())
+	}
+	for _, name := range components {
+		c := tc.component(name, catalog)
+		values, err := os.ReadFile(filepath.Join(tc.componentsPath(), name, "override-values.yaml"))
+		if err != nil {
+			return err
+		}
+		secret, err := tc.repositorySecret(ctx, name, c)
+		if err != nil {
+			return fmt.Errorf("error adding the '%s' repository secret: %s", name, err)
+		}
+		images, err := tc.controllerImages(name)
+		if err != nil {
+			return fmt.Errorf("error reading the '%s' images: %s", name, err)
+		}
+		var resources []map[string]interface{}
+		if secret != nil {
+			resources = append(resources, secret)
+		}
+		switch tc.installer() {
+		case installerArgoCD:
+			// argo cd can not rewrite the rendered images of a helm
+			// source, so only the images set by the values are mirrored.
+			if len(images) > 0 {
+				return fmt.Errorf("the images %s of component '%s' are not set by its values and can not be mirrored by the %s installer", quoteNames(sortedKeys(images)), name, tc.installer())
+			}
+			resources = append(resources, tc.argoApplication(name, c, values))
+		case installerFlux:
+			release, err := tc.fluxHelmRelease(name, c, values, secret, images)
+			if err != nil {
+				return fmt.Errorf("error parsing the '%s' values: %s", name, err)
+			}
+			resources = append(resources, release...)
+		}
+		var manifests []string
+		for _, resource := range resources {
+			data, err := yaml.Marshal(resource)
+			if err != nil {
+				return err
+			}
+			manifests = append(manifests, string(data))
+		}
+		dir := filepath.Join(tc.path(), "chart", controllerResourcesDir)
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("%s.yaml", name)), []byte(strings.Join(manifests, "---\n")), 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// quoteNames returns the comma separated quoted names.
+func quoteNames(names []string) string {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = fmt.Sprintf("'%s'", name)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// sortedKeys returns the sorted keys of the map.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// repositorySecretName returns the name of the repository secret of
+// the component.
+func (tc *toolchain) repositorySecretName(name string) string {
+	return fmt.Sprintf("%s-%s-repository", tc.name, name)
+}
+
+// repositorySecret returns the secret with the credentials and the
+// certificates of the component repository, or nil if the repository
+// has none.
+//
+// Argo cd reads the repositories from the secrets of its namespace
+// that are labelled as repositories. Flux reads them from the secret
+// referenced by the helm repository.
+func (tc *toolchain) repositorySecret(ctx context.Context, name string, c component) (map[string]interface{}, error) {
+	repo := tc.repository(c.Repo)
+	if repo == nil {
+		return nil, nil
+	}
+	password, err := repo.password(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving the '%s' repository password: %s", repo.URL, err)
+	}
+	files := map[string]string{}
+	for key, path := range map[string]string{"caFile": repo.CAFile, "certFile": repo.CertFile, "keyFile": repo.KeyFile} {
+		if path == "" {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		files[key] = string(data)
+	}
+	data := map[string]string{}
+	if repo.Username != "" {
+		data["username"] = repo.Username
+		data["password"] = password
+	}
+	labels := map[string]string{toolchainLabel: tc.name, componentLabel: name}
+	namespace := tc.namespace()
+	switch tc.installer() {
+	case installerArgoCD:
+		// argo cd reads the certificate authorities from its
+		// argocd-tls-certs-cm config map instead.
+		if files["certFile"] != "" {
+			data["tlsClientCertData"] = files["certFile"]
+			data["tlsClientCertKey"] = files["keyFile"]
+		}
+		if repo.InsecureSkipTLSVerify {
+			data["insecure"] = "true"
+		}
+		if len(data) == 0 {
+			return nil, nil
+		}
+		data["type"] = "helm"
+		data["name"] = fmt.Sprintf("%s-%s", tc.name, name)
+		data["url"] = argoRepoURL(c.Repo)
+		if registry.IsOCI(c.Repo) {
+			data["enableOCI"] = "true"
+		}
+		labels[argoSecretTypeLabel] = "repository"
+		namespace = tc.argoNamespace()
+	case installerFlux:
+		for key, value := range files {
+			data[key] = value
+		}
+		if len(data) == 0 {
+			return nil, nil
+		}
+	}
+	return map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Secret",
+		"metadata": map[string]interface{}{
+			"name":      tc.repositorySecretName(name),
+			"namespace": namespace,
+			"labels":    labels,
+		},
+		"type":       "Opaque",
+		"stringData": data,
+	}, nil
+}
+
+// argoSecretTypeLabel is the label of the argo cd repository and
+// cluster secrets.
+const argoSecretTypeLabel = "argocd.argoproj.io/secret-type"
+
+// argoRepoURL returns the argo cd url of the chart repository. Argo
+// cd references oci charts by the registry without a scheme.
+func argoRepoURL(repo string) string {
+	return strings.TrimPrefix(repo, fmt.Sprintf("%s://", registry.OCIScheme))
+}
+
+// controllerImages returns the mirrored names of the rendered images
+// of the component that are not mirrored by its values, by their
+// source names. The controllers render the charts themselves, so these
+// images are not rewritten by the image mirror post renderer.
+func (tc *toolchain) controllerImages(name string) (map[string]string, error) {
+	mirror := tc.registryMirror()
+	if mirror == "" {
+		return nil, nil
+	}
+	manifests, err := tc.renderComponent(name)
+	if err != nil {
+		return nil, err
+	}
+	images, err := manifestImages(manifests)
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]string{}
+	for _, image := range images {
+		if mirrored := mirrorImage(mirror, image); mirrored != image {
+			names[imageName(image)] = imageName(mirrored)
+		}
+	}
+	return names, nil
+}
+
+// imageName returns the image reference without the tag and digest.
+func imageName(image string) string {
+	image = strings.SplitN(image, "@", 2)[0]
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image = image[:i]
+	}
+	return image
+}
+
+// argoApplicationResource is the resource of the argo cd applications.
+var argoApplicationResource = schema.GroupVersionResource{Group: "argoproj.io", Version: "v1alpha1", Resource: "applications"}
+
+// argoNamespace returns the namespace of the argo cd applications.
+func (tc *toolchain) argoNamespace() string {
+	if tc.config != nil && tc.config.Installer != nil && tc.config.Installer.ArgoCD != nil && tc.config.Installer.ArgoCD.Namespace != "" {
+		return tc.config.Installer.ArgoCD.Namespace
+	}
+	return "argocd"
+}
+
+// argoApplication returns the argo cd application of the component.
+func (tc *toolchain) argoApplication(name string, c component, values []byte) map[string]interface{} {
+	config := &argoCDConfig{}
+	if tc.config.Installer.ArgoCD != nil {
+		config = tc.config.Installer.ArgoCD
+	}
+	namespace, project, server := tc.argoNamespace(), config.Project, config.Server
+	if project == "" {
+		project = "default"
+	}
+	if server == "" {
+		server = "https://kubernetes.default.svc"
+	}
+	return map[string]interface{}{
+		"apiVersion": "argoproj.io/v1alpha1",
+		"kind":       "Application",
+		"metadata": map[string]interface{}{
+			"name":       fmt.Sprintf("%s-%s", tc.name, name),
+			"namespace":  namespace,
+			"labels":     map[string]string{toolchainLabel: tc.name, componentLabel: name},
+			"finalizers": []string{"resources-finalizer.argocd.argoproj.io"},
+		},
+		"spec": map[string]interface{}{
+			"project": project,
+			"source": map[string]interface{}{
+				"repoURL":        argoRepoURL(c.Repo),
+				"chart":          c.Chart,
+				"targetRevision": c.Version,
+				"helm": map[string]interface{}{
+					"releaseName": name,
+					"values":      string(values),
+				},
+			},
+			"destination": map[string]interface{}{
+				"server":    server,
+				"namespace": tc.namespace(),
+			},
+			"syncPolicy": map[string]interface{}{
+				"automated": map[string]interface{}{"prune": true, "selfHeal": true},
+			},
+		},
+	}
+}
+
+// fluxHelmRelease returns the flux helm repository and helm release of
+// the component. The repository references the repository secret if it
+// is not nil, and the release rewrites the rendered images to their
+// mirrored names.
+func (tc *toolchain) fluxHelmRelease(name string, c component, values []byte, secret map[string]interface{}, images map[string]string) ([]map[string]interface{}, error) {
+	interval := "10m"
+	if tc.config.Installer.Flux != nil && tc.config.Installer.Flux.Interval != "" {
+		interval = tc.config.Installer.Flux.Interval
+	}
+	var releaseValues map[string]interface{}
+	if err := yaml.Unmarshal(values, &releaseValues); err != nil {
+		return nil, err
+	}
+	repositoryName := fmt.Sprintf("%s-%s", tc.name, name)
+	repositorySpec := map[string]interface{}{
+		"url":      c.Repo,
+		"interval": interval,
+	}
+	if registry.IsOCI(c.Repo) {
+		repositorySpec["type"] = "oci"
+	}
+	if secret != nil {
+		repositorySpec["secretRef"] = map[string]interface{}{"name": tc.repositorySecretName(name)}
+	}
+	labels := map[string]string{toolchainLabel: tc.name, componentLabel: name}
+	repository := map[string]interface{}{
+		"apiVersion": "source.toolkit.fluxcd.io/v1beta2",
+		"kind":       "HelmRepository",
+		"metadata": map[string]interface{}{
+			"name":      repositoryName,
+			"namespace": tc.namespace(),
+			"labels":    labels,
+		},
+		"spec": repositorySpec,
+	}
+	release := map[string]interface{}{
+		"apiVersion": "helm.toolkit.fluxcd.io/v2beta1",
+		"kind":       "HelmRelease",
+		"metadata": map[string]interface{}{
+			"name":      name,
+			"namespace": tc.namespace(),
+			"labels":    labels,
+		},
+		"spec": map[string]interface{}{
+			"interval":    interval,
+			"releaseName": name,
+			"chart": map[string]interface{}{
+				"spec": map[string]interface{}{
+					"chart":   c.Chart,
+					"version": c.Version,
+					"sourceRef": map[string]interface{}{
+						"kind": "HelmRepository",
+						"name": repositoryName,
+					},
+				},
+			},
+			"values": releaseValues,
+		},
+	}
+	if len(images) > 0 {
+		var kustomizeImages []map[string]interface{}
+		for _, image := range sortedKeys(images) {
+			kustomizeImages = append(kustomizeImages, map[string]interface{}{"name": image, "newName": images[image]})
+		}
+		release["spec"].(map[string]interface{})["postRenderers"] = []map[string]interface{}{
+			{"kustomize": map[string]interface{}{"images": kustomizeImages}},
+		}
+	}
+	return []map[string]interface{}{repository, release}, nil
+}
+
+// removeArgoApplications deletes the argo cd applications of the
+// toolchain. The applications are outside of the toolchain namespaces,
+// and their finalizer removes the resources of the components.
+func (tc *toolchain) removeArgoApplications(ctx context.Context, client dynamic.Interface) error {
+	applications := client.Resource(argoApplicationResource).Namespace(tc.argoNamespace())
+	list, err := applications.List(ctx, metav1.ListOptions{LabelSelector: fmt.Sprintf("%s=%s", toolchainLabel, tc.name)})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, app := range list.Items {
+		logger.WithField("application", app.GetName()).Info("removing the argo cd application")
+		if err := applications.Delete(ctx, app.GetName(), metav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package toolchain
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func TestAddControllerResources(t *testing.T) {
+	defer patchToolchainRoot()()
+	catalog := &componentCatalog{
+		Components: map[string]component{
+			"helloworld": {Repo: "oci://harbor.example.com/charts", Chart: "helloworld", Version: "1.0.0"},
+			"tekton":     {Type: componentTypeManifest, Source: "https://example.com/release.yaml"},
+			"sso":        {Repo: "https://charts.example.com", Chart: "sso", Version: "1.0.0", Hooks: "apiVersion: batch/v1\nkind: Job\n"},
+			"vault":      {Repo: "https://charts.example.com", Chart: "vault", Version: "1.0.0", Hooks: "apiVersion: batch/v1\nkind: Job\n"},
+		},
+	}
+	repositories := []repositoryConfig{{URL: "oci://harbor.example.com", Username: "robot", Password: "secret", InsecureSkipTLSVerify: true}}
+	for _, installer := range []string{installerArgoCD, installerFlux} {
+		tc := &toolchain{name: "test", config: &toolchainConfig{Installer: &installerConfig{Type: installer}, Repositories: repositories}}
+		newTestToolchainChart(t, tc)
+		values := "greeting: '{{ not rendered }}'\n"
+		if err := os.WriteFile(filepath.Join(tc.componentsPath(), "helloworld", "override-values.yaml"), []byte(values), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := tc.resetControllerResources(); err != nil {
+			t.Fatal(err)
+		}
+		if err := tc.addControllerResources(context.TODO(), []string{"helloworld"}, catalog); err != nil {
+			t.Fatal(err)
+		}
+		assert.Error(t, tc.addControllerResources(context.TODO(), []string{"tekton"}, catalog), "expected an error for manifest components")
+		assert.ErrorContains(t, tc.addControllerResources(context.TODO(), []string{"helloworld", "sso", "vault"}, catalog), "the catalog hooks of 'sso', 'vault' are not supported", "expected the components with hooks to be listed")
+
+		manifests, err := renderChart("trustacks-toolchain-test", filepath.Join(tc.path(), "chart"), tc.namespace(), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		objects, err := decodeObjects(manifests)
+		if err != nil {
+			t.Fatal(err)
+		}
+		kinds := make(map[string]map[string]interface{})
+		for _, obj := range objects {
+			kinds[obj.GetKind()] = obj.Object
+		}
+		secret := kinds["Secret"]["stringData"].(map[string]interface{})
+		assert.Equal(t, "robot", secret["username"], "expected the repository username")
+		assert.Equal(t, "secret", secret["password"], "expected the repository password")
+		switch installer {
+		case installerArgoCD:
+			metadata := kinds["Secret"]["metadata"].(map[string]interface{})
+			assert.Equal(t, "argocd", metadata["namespace"], "expected the repository secret in the argo cd namespace")
+			assert.Equal(t, "repository", metadata["labels"].(map[string]interface{})[argoSecretTypeLabel], "expected the repository secret label")
+			assert.Equal(t, map[string]interface{}{
+				"type":      "helm",
+				"name":      "test-helloworld",
+				"url":       "harbor.example.com/charts",
+				"enableOCI": "true",
+				"username":  "robot",
+				"password":  "secret",
+				"insecure":  "true",
+			}, secret, "got an unexpected argo cd repository secret")
+			spec := kinds["Application"]["spec"].(map[string]interface{})
+			source := spec["source"].(map[string]interface{})
+			assert.Equal(t, "harbor.example.com/charts", source["repoURL"], "expected the oci scheme to be removed")
+			assert.Equal(t, values, source["helm"].(map[string]interface{})["values"], "expected the inlined values")
+			assert.Equal(t, "trustacks-toolchain-test", spec["destination"].(map[string]interface{})["namespace"])
+		case installerFlux:
+			assert.Equal(t, "oci", kinds["HelmRepository"]["spec"].(map[string]interface{})["type"])
+			assert.Equal(t, map[string]interface{}{"name": "test-helloworld-repository"}, kinds["HelmRepository"]["spec"].(map[string]interface{})["secretRef"], "expected the repository secret reference")
+			spec := kinds["HelmRelease"]["spec"].(map[string]interface{})
+			assert.Equal(t, map[string]interface{}{"greeting": "{{ not rendered }}"}, spec["values"], "expected the inlined values")
+		}
+	}
+}
+
+func TestAddControllerResourcesMirror(t *testing.T) {
+	defer patchToolchainRoot()()
+	catalog := &componentCatalog{
+		Components: map[string]component{
+			"helloworld": {Repo: "https://charts.example.com", Chart: "helloworld", Version: "1.0.0"},
+		},
+	}
+	for _, installer := range []string{installerArgoCD, installerFlux} {
+		tc := &toolchain{name: "test", config: &toolchainConfig{Installer: &installerConfig{Type: installer}, RegistryMirror: "registry.internal"}}
+		newTestToolchainChart(t, tc)
+		if err := tc.resetControllerResources(); err != nil {
+			t.Fatal(err)
+		}
+		err := tc.addControllerResources(context.TODO(), []string{"helloworld"}, catalog)
+		if installer == installerArgoCD {
+			assert.ErrorContains(t, err, "the images 'tutum/hello-world' of component 'helloworld' are not set by its values", "expected the unmirrored images to be reported")
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(filepath.Join(tc.path(), "chart", controllerResourcesDir, "helloworld.yaml"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Contains(t, string(data), "- name: tutum/hello-world\n        newName: registry.internal/docker.io/tutum/hello-world\n", "expected the images to be rewritten by the post renderer")
+	}
+}
+
+func TestImageName(t *testing.T) {
+	assert.Equal(t, "nginx", imageName("nginx:1.23"))
+	assert.Equal(t, "localhost:5000/nginx", imageName("localhost:5000/nginx"))
+	assert.Equal(t, "quay.io/trustacks/catalog", imageName("quay.io/trustacks/catalog:latest@sha256:abc"))
+}
+
+func TestRemoveArgoApplications(t *testing.T) {
+	var objects []runtime.Object
+	for name, toolchain := range map[string]string{"test-sso": "test", "test-argo": "test", "other-sso": "other"} {
+		app := &unstructured.Unstructured{}
+		app.SetAPIVersion("argoproj.io/v1alpha1")
+		app.SetKind("Application")
+		app.SetNamespace("gitops")
+		app.SetName(name)
+		app.SetLabels(map[string]string{toolchainLabel: toolchain})
+		objects = append(objects, app)
+	}
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{argoApplicationResource: "ApplicationList"}, objects...)
+	tc := &toolchain{name: "test", config: &toolchainConfig{Installer: &installerConfig{Type: installerArgoCD, ArgoCD: &argoCDConfig{Namespace: "gitops"}}}}
+	if err := tc.removeArgoApplications(context.TODO(), client); err != nil {
+		t.Fatal(err)
+	}
+	list, err := client.Resource(argoApplicationResource).Namespace("gitops").List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, list.Items, 1) {
+		assert.Equal(t, "other-sso", list.Items[0].GetName(), "expected the applications of other toolchains to be kept")
+	}
+}
@@ -0,0 +1,483 @@
+package toolchain
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	helmclient "github.com/mittwald/go-helm-client"
+	"github.com/sirupsen/logrus"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/release"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+// drift statuses of a resource.
+const (
+	DriftChanged = "changed"
+	DriftMissing = "missing"
+	DriftExtra   = "extra"
+)
+
+// helm release ownership and resource policy annotations.
+const (
+	releaseNameAnnotation      = "meta.helm.sh/release-name"
+	resourcePolicyAnnotation   = "helm.sh/resource-policy"
+	releaseNamespaceAnnotation = "meta.helm.sh/release-namespace"
+)
+
+// driftKinds are the namespaced kinds searched for extra resources.
+var driftKinds = []schema.GroupVersionResource{
+	{Version: "v1", Resource: "configmaps"},
+	{Version: "v1", Resource: "secrets"},
+	{Version: "v1", Resource: "services"},
+	{Version: "v1", Resource: "serviceaccounts"},
+	{Version: "v1", Resource: "persistentvolumeclaims"},
+	{Group: "apps", Version: "v1", Resource: "deployments"},
+	{Group: "apps", Version: "v1", Resource: "statefulsets"},
+	{Group: "apps", Version: "v1", Resource: "daemonsets"},
+	{Group: "batch", Version: "v1", Resource: "jobs"},
+	{Group: "batch", Version: "v1", Resource: "cronjobs"},
+	{Group: "networking.k8s.io", Version: "v1", Resource: "ingresses"},
+	{Group: "rbac.authorization.k8s.io", Version: "v1", Resource: "roles"},
+	{Group: "rbac.authorization.k8s.io", Version: "v1", Resource: "rolebindings"},
+}
+
+// DriftedResource is a resource whose live state differs from the
+// rendered state.
+type DriftedResource struct {
+	// Cluster is the display name of the cluster target.
+	Cluster string
+	// Owner is the release or component of the resource.
+	Owner string
+	// Resource is the kind, namespace and name of the resource.
+	Resource string
+	// Status is one of changed, missing or extra.
+	Status string
+	// Fields are the changed field paths.
+	Fields []string
+
+	ref objectRef
+}
+
+// String returns a one line description of the drift.
+func (d DriftedResource) String() string {
+	s := fmt.Sprintf("[%s] %s %s (%s)", d.Cluster, d.Status, d.Resource, d.Owner)
+	if len(d.Fields) > 0 {
+		s += ": " + strings.Join(d.Fields, ", ")
+	}
+	return s
+}
+
+// desiredState is the rendered state of a release or a manifest
+// component.
+type desiredState struct {
+	owner   string
+	release *release.Release
+	objects []*unstructured.Unstructured
+}
+
+// driftKey identifies an object regardless of its api version.
+func driftKey(obj *unstructured.Unstructured) string {
+	gvk := obj.GroupVersionKind()
+	return strings.Join([]string{gvk.Group, gvk.Kind, obj.GetNamespace(), obj.GetName()}, "/")
+}
+
+// normalizeObject returns the comparable fields of the object. The
+// server managed metadata and the status are dropped and the secret
+// string data is encoded as data.
+func normalizeObject(obj *unstructured.Unstructured) (map[string]interface{}, error) {
+	// round trip through json so that the numbers of the decoded
+	// manifests and of the live objects have the same types.
+	data, err := json.Marshal(obj.Object)
+	if err != nil {
+		return nil, err
+	}
+	object := map[string]interface{}{}
+	if err := json.Unmarshal(data, &object); err != nil {
+		return nil, err
+	}
+	delete(object, "status")
+	if metadata, ok := object["metadata"].(map[string]interface{}); ok {
+		object["metadata"] = map[string]interface{}{
+			"labels":      metadata["labels"],
+			"annotations": metadata["annotations"],
+		}
+	}
+	if obj.GetKind() == "Secret" && obj.GroupVersionKind().Group == "" {
+		if stringData, ok := object["stringData"].(map[string]interface{}); ok {
+			secretData, _ := object["data"].(map[string]interface{})
+			if secretData == nil {
+				secretData = map[string]interface{}{}
+			}
+			for key, value := range stringData {
+				secretData[key] = base64.StdEncoding.EncodeToString([]byte(fmt.Sprint(value)))
+			}
+			object["data"] = secretData
+			delete(object, "stringData")
+		}
+	}
+	return object, nil
+}
+
+// fieldDrift returns the paths of the desired fields that are not
+// matched by the live fields. Fields that are only set on the live
+// object, such as defaults, are ignored. Desired empty lists and maps
+// match absent live fields since the api server drops them.
+func fieldDrift(desired, live interface{}, path string) []string {
+	switch d := desired.(type) {
+	case nil:
+		return nil
+	case map[string]interface{}:
+		l, ok := live.(map[string]interface{})
+		if !ok {
+			if live == nil && len(d) == 0 {
+				return nil
+			}
+			return []string{path}
+		}
+		keys := make([]string, 0, len(d))
+		for key := range d {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		var fields []string
+		for _, key := range keys {
+			fields = append(fields, fieldDrift(d[key], l[key], path+"."+key)...)
+		}
+		return fields
+	case []interface{}:
+		l, ok := live.([]interface{})
+		if !ok && live == nil && len(d) == 0 {
+			return nil
+		}
+		if !ok || len(l) != len(d) {
+			return []string{path}
+		}
+		var fields []string
+		for i := range d {
+			fields = append(fields, fieldDrift(d[i], l[i], fmt.Sprintf("%s[%d]", path, i))...)
+		}
+		return fields
+	}
+	if live == nil || !equalScalar(desired, live) {
+		return []string{path}
+	}
+	return nil
+}
+
+// equalScalar compares the scalar values. Quantities such as 1000m and
+// 1 are equal.
+func equalScalar(desired, live interface{}) bool {
+	if fmt.Sprint(desired) == fmt.Sprint(live) {
+		return true
+	}
+	d, ok := desired.(string)
+	if !ok {
+		return false
+	}
+	l, ok := live.(string)
+	if !ok {
+		return false
+	}
+	dq, err := resource.ParseQuantity(d)
+	if err != nil {
+		return false
+	}
+	lq, err := resource.ParseQuantity(l)
+	if err != nil {
+		return false
+	}
+	return dq.Cmp(lq) == 0
+}
+
+// objectDrift returns the changed field paths of the live object.
+func objectDrift(desired, live *unstructured.Unstructured) ([]string, error) {
+	d, err := normalizeObject(desired)
+	if err != nil {
+		return nil, err
+	}
+	l, err := normalizeObject(live)
+	if err != nil {
+		return nil, err
+	}
+	delete(d, "apiVersion")
+	delete(d, "kind")
+	fields := fieldDrift(d, l, "")
+	for i := range fields {
+		fields[i] = strings.TrimPrefix(fields[i], ".")
+	}
+	return fields, nil
+}
+
+// stateDrift compares the desired states with the live objects of the
+// namespace. Objects that are labelled or annotated as owned by one of
+// the states but are not rendered anymore are extra, unless helm is told
+// to keep them.
+func stateDrift(ctx context.Context, client dynamic.Interface, mapper meta.ResettableRESTMapper, toolchain, namespace string, states []*desiredState) (map[*desiredState][]DriftedResource, error) {
+	drifted := map[*desiredState][]DriftedResource{}
+	known := map[string]bool{}
+	owners := map[string]*desiredState{}
+	for _, state := range states {
+		owners[state.owner] = state
+		for _, obj := range state.objects {
+			gvk := obj.GroupVersionKind()
+			if _, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version); meta.IsNoMatchError(err) {
+				// the definition of the custom resource is gone.
+				drifted[state] = append(drifted[state], DriftedResource{Owner: state.owner, Resource: refOf(obj).String(), Status: DriftMissing})
+				continue
+			}
+			ri, err := resourceInterface(ctx, client, mapper, obj, namespace)
+			if err != nil {
+				return nil, err
+			}
+			known[driftKey(obj)] = true
+			live, err := ri.Get(ctx, obj.GetName(), metav1.GetOptions{})
+			if errors.IsNotFound(err) {
+				drifted[state] = append(drifted[state], DriftedResource{Owner: state.owner, Resource: refOf(obj).String(), Status: DriftMissing})
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			fields, err := objectDrift(obj, live)
+			if err != nil {
+				return nil, err
+			}
+			if len(fields) > 0 {
+				drifted[state] = append(drifted[state], DriftedResource{Owner: state.owner, Resource: refOf(obj).String(), Status: DriftChanged, Fields: fields})
+			}
+		}
+	}
+	for _, gvr := range driftKinds {
+		list, err := client.Resource(gvr).Namespace(namespace).List(ctx, metav1.ListOptions{})
+		if errors.IsNotFound(err) || errors.IsForbidden(err) {
+			logger.Debugf("skipping the %s extra resources: %s", gvr.Resource, err)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for i := range list.Items {
+			item := &list.Items[i]
+			if known[driftKey(item)] || len(item.GetOwnerReferences()) > 0 {
+				continue
+			}
+			// helm keeps these resources on purpose when they are removed
+			// from the chart, like the volume claims of the databases.
+			if item.GetAnnotations()[resourcePolicyAnnotation] == "keep" {
+				continue
+			}
+			state := owners[extraOwner(item, toolchain, namespace)]
+			if state == nil {
+				continue
+			}
+			drifted[state] = append(drifted[state], DriftedResource{Owner: state.owner, Resource: refOf(item).String(), Status: DriftExtra, ref: refOf(item)})
+		}
+	}
+	return drifted, nil
+}
+
+// extraOwner returns the release or the component that manages the
+// live object.
+func extraOwner(obj *unstructured.Unstructured, toolchain, namespace string) string {
+	annotations := obj.GetAnnotations()
+	if name, ok := annotations[releaseNameAnnotation]; ok && annotations[releaseNamespaceAnnotation] == namespace {
+		return name
+	}
+	labels := obj.GetLabels()
+	if labels[toolchainLabel] == toolchain {
+		return labels[componentLabel]
+	}
+	return ""
+}
+
+// desiredStates returns the deployed releases of the namespace and, in
+// the toolchain namespace, the manifest components of the cluster
+// target.
+func (tc *toolchain) desiredStates(clusterName, namespace string, cluster *clusterConfig) ([]*desiredState, error) {
+	helmClient, err := newHelmClient(namespace, cluster)
+	if err != nil {
+		return nil, err
+	}
+	releases, err := helmClient.ListDeployedReleases()
+	if err != nil {
+		return nil, err
+	}
+	var states []*desiredState
+	for _, rel := range releases {
+		if rel.Namespace != namespace {
+			continue
+		}
+		objects, err := decodeObjects([]byte(rel.Manifest))
+		if err != nil {
+			return nil, fmt.Errorf("error decoding the manifest of release '%s': %s", rel.Name, err)
+		}
+		states = append(states, &desiredState{owner: rel.Name, release: rel, objects: objects})
+	}
+	if namespace != tc.namespace() {
+		return states, nil
+	}
+	components, err := os.ReadDir(tc.componentsPath())
+	if os.IsNotExist(err) {
+		return states, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, component := range components {
+		name := component.Name()
+		if _, err := readComponentMetadata(filepath.Join(tc.componentsPath(), name)); err != nil || tc.clusterName(name) != clusterName {
+			continue
+		}
+		manifests, err := os.ReadFile(filepath.Join(tc.componentsPath(), name, manifestsFile))
+		if err != nil {
+			return nil, err
+		}
+		if manifests, err = tc.postRender(manifests); err != nil {
+			return nil, err
+		}
+		objects, err := decodeObjects(manifests)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding the manifests of '%s': %s", name, err)
+		}
+		for _, obj := range objects {
+			obj.SetLabels(mergeStringMaps(obj.GetLabels(), map[string]string{
+				"app.kubernetes.io/managed-by": fieldManager,
+				toolchainLabel:                 tc.name,
+				componentLabel:                 name,
+			}))
+		}
+		states = append(states, &desiredState{owner: name, objects: objects})
+	}
+	return states, nil
+}
+
+// fixDrift deletes the extra resources and re-applies the releases and
+// the components with changed or missing resources.
+func (tc *toolchain) fixDrift(ctx context.Context, namespace string, cluster *clusterConfig, client dynamic.Interface, mapper meta.ResettableRESTMapper, state *desiredState, drifted []DriftedResource) error {
+	log := logger.WithFields(logrus.Fields{"owner": state.owner, "cluster": clusterLabel(cluster)})
+	var extras []objectRef
+	reapply := false
+	for _, d := range drifted {
+		if d.Status != DriftExtra {
+			reapply = true
+			continue
+		}
+		extras = append(extras, d.ref)
+	}
+	if len(extras) > 0 {
+		log.Infof("deleting %d extra resource(s)", len(extras))
+		if err := deleteObjects(ctx, client, mapper, extras); err != nil {
+			return err
+		}
+	}
+	if !reapply {
+		return nil
+	}
+	if state.release == nil {
+		metadata, err := readComponentMetadata(filepath.Join(tc.componentsPath(), state.owner))
+		if err != nil {
+			return err
+		}
+		return tc.applyComponent(ctx, state.owner, namespace, cluster, metadata)
+	}
+	log.Info("re-applying the release")
+	return tc.reapplyRelease(ctx, state.release, cluster)
+}
+
+// reapplyRelease upgrades the release with its deployed chart and
+// values, which restores the changed and the missing resources.
+func (tc *toolchain) reapplyRelease(ctx context.Context, rel *release.Release, cluster *clusterConfig) error {
+	client, err := newHelmClient(rel.Namespace, cluster)
+	if err != nil {
+		return err
+	}
+	helmClient, ok := client.(*helmclient.HelmClient)
+	if !ok {
+		return fmt.Errorf("unsupported helm client")
+	}
+	upgrade := action.NewUpgrade(helmClient.ActionConfig)
+	upgrade.Namespace = rel.Namespace
+	renderer, err := tc.postRenderer()
+	if err != nil {
+		return err
+	}
+	if renderer != nil {
+		upgrade.PostRenderer = renderer
+	}
+	if _, err := upgrade.RunWithContext(ctx, rel.Name, rel.Chart, rel.Config); err != nil {
+		return fmt.Errorf("error re-applying release '%s': %s", rel.Name, err)
+	}
+	return nil
+}
+
+// Drift compares the helm releases of the toolchain and application
+// namespaces, and the manifest components, with the live objects and returns the changed,
+// missing and extra resources. The drift is corrected if fix is set.
+//
+// Resources created outside of the releases, such as the secrets
+// generated by the hooks, are not compared.
+func Drift(ctx context.Context, name string, fix bool) ([]DriftedResource, error) {
+	tc, err := newToolchainFromConfig(name)
+	if err != nil {
+		logger.Debugf("error loading the toolchain config: %s", err)
+		tc = &toolchain{name: name}
+	}
+	drifted := []DriftedResource{}
+	for _, target := range tc.clusters() {
+		client, mapper, err := newDynamicClient(target.config)
+		if err != nil {
+			return drifted, err
+		}
+		for _, ns := range tc.namespaces() {
+			if err := ctx.Err(); err != nil {
+				return drifted, err
+			}
+			d, err := tc.namespaceDrift(ctx, target.name, ns.Name, target.config, client, mapper, fix)
+			drifted = append(drifted, d...)
+			if err != nil {
+				return drifted, err
+			}
+		}
+	}
+	return drifted, nil
+}
+
+// namespaceDrift returns the drifted resources of the namespace on the
+// cluster target. The drift is corrected if fix is set.
+func (tc *toolchain) namespaceDrift(ctx context.Context, clusterName, namespace string, cluster *clusterConfig, client dynamic.Interface, mapper meta.ResettableRESTMapper, fix bool) ([]DriftedResource, error) {
+	states, err := tc.desiredStates(clusterName, namespace, cluster)
+	if err != nil {
+		return nil, err
+	}
+	stateDrifts, err := stateDrift(ctx, client, mapper, tc.name, namespace, states)
+	if err != nil {
+		return nil, err
+	}
+	var drifted []DriftedResource
+	for _, state := range states {
+		for _, d := range stateDrifts[state] {
+			d.Cluster = clusterLabel(cluster)
+			drifted = append(drifted, d)
+		}
+		if !fix || len(stateDrifts[state]) == 0 {
+			continue
+		}
+		if err := tc.fixDrift(ctx, namespace, cluster, client, mapper, state, stateDrifts[state]); err != nil {
+			return drifted, err
+		}
+	}
+	return drifted, nil
+}
@@ -0,0 +1,150 @@
+package toolchain
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func newDriftClient(objects ...runtime.Object) *dynamicfake.FakeDynamicClient {
+	listKinds := map[schema.GroupVersionResource]string{}
+	for _, gvr := range driftKinds {
+		listKinds[gvr] = gvr.Resource + "List"
+	}
+	return dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), listKinds, objects...)
+}
+
+func newDriftObject(kind, name string, fields map[string]interface{}) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{}}
+	for key, value := range fields {
+		obj.Object[key] = value
+	}
+	obj.SetAPIVersion("v1")
+	obj.SetKind(kind)
+	obj.SetNamespace("trustacks")
+	obj.SetName(name)
+	return obj
+}
+
+func TestObjectDrift(t *testing.T) {
+	desired := newDriftObject("ConfigMap", "test", map[string]interface{}{"data": map[string]interface{}{"key": "value", "replicas": int64(1)}})
+	live := newDriftObject("ConfigMap", "test", map[string]interface{}{"data": map[string]interface{}{"key": "value", "replicas": float64(1), "extra": "default"}})
+	live.SetUID("uid")
+	live.SetLabels(map[string]string{"app.kubernetes.io/managed-by": "Helm"})
+	fields, err := objectDrift(desired, live)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, fields, "expected live only and server fields to be ignored")
+
+	live.Object["data"].(map[string]interface{})["key"] = "edited"
+	desired.SetLabels(map[string]string{"app": "test"})
+	fields, err = objectDrift(desired, live)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"data.key", "metadata.labels.app"}, fields)
+
+	desired = newDriftObject("Pod", "test", map[string]interface{}{"spec": map[string]interface{}{"cpu": "1000m", "ports": []interface{}{int64(80)}}})
+	live = newDriftObject("Pod", "test", map[string]interface{}{"spec": map[string]interface{}{"cpu": "1", "ports": []interface{}{int64(80), int64(443)}}})
+	fields, err = objectDrift(desired, live)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"spec.ports"}, fields)
+
+	desired = newDriftObject("Pod", "test", map[string]interface{}{"spec": map[string]interface{}{"volumes": []interface{}{}, "nodeSelector": map[string]interface{}{}}})
+	live = newDriftObject("Pod", "test", map[string]interface{}{"spec": map[string]interface{}{}})
+	fields, err = objectDrift(desired, live)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, fields, "expected the dropped empty collections to be ignored")
+
+	live.Object["spec"] = map[string]interface{}{"volumes": "none", "nodeSelector": []interface{}{}}
+	fields, err = objectDrift(desired, live)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"spec.nodeSelector", "spec.volumes"}, fields)
+}
+
+func TestObjectDriftSecretStringData(t *testing.T) {
+	desired := newDriftObject("Secret", "sops-age", map[string]interface{}{"stringData": map[string]interface{}{"age.agekey": "secret"}})
+	live := newDriftObject("Secret", "sops-age", map[string]interface{}{"data": map[string]interface{}{"age.agekey": base64.StdEncoding.EncodeToString([]byte("secret"))}})
+	fields, err := objectDrift(desired, live)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, fields)
+
+	live.Object["data"] = map[string]interface{}{"age.agekey": base64.StdEncoding.EncodeToString([]byte("rotated"))}
+	fields, err = objectDrift(desired, live)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"data.age.agekey"}, fields)
+}
+
+func TestStateDrift(t *testing.T) {
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}, meta.RESTScopeNamespace)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Secret"}, meta.RESTScopeNamespace)
+
+	changed := newDriftObject("ConfigMap", "changed", map[string]interface{}{"data": map[string]interface{}{"key": "edited"}})
+	unchanged := newDriftObject("ConfigMap", "unchanged", map[string]interface{}{"data": map[string]interface{}{"key": "value"}})
+	extra := newDriftObject("ConfigMap", "extra", nil)
+	extra.SetAnnotations(map[string]string{releaseNameAnnotation: "release", releaseNamespaceAnnotation: "trustacks"})
+	kept := newDriftObject("ConfigMap", "kept", nil)
+	kept.SetAnnotations(map[string]string{releaseNameAnnotation: "release", releaseNamespaceAnnotation: "trustacks", resourcePolicyAnnotation: "keep"})
+	componentExtra := newDriftObject("Secret", "component-extra", nil)
+	componentExtra.SetLabels(map[string]string{toolchainLabel: "test", componentLabel: "component"})
+	foreign := newDriftObject("Secret", "foreign", nil)
+	foreign.SetLabels(map[string]string{toolchainLabel: "other", componentLabel: "component"})
+	generated := newDriftObject("Secret", "generated", nil)
+	generated.SetLabels(map[string]string{toolchainLabel: "test", componentLabel: "component"})
+	generated.SetOwnerReferences([]metav1.OwnerReference{{APIVersion: "v1", Kind: "ConfigMap", Name: "unchanged", UID: "uid"}})
+	client := newDriftClient(changed, unchanged, extra, kept, componentExtra, foreign, generated)
+
+	release := &desiredState{owner: "release", objects: []*unstructured.Unstructured{
+		newDriftObject("ConfigMap", "changed", map[string]interface{}{"data": map[string]interface{}{"key": "value"}}),
+		newDriftObject("ConfigMap", "unchanged", map[string]interface{}{"data": map[string]interface{}{"key": "value"}}),
+		newDriftObject("Secret", "missing", nil),
+	}}
+	component := &desiredState{owner: "component"}
+	crd := &desiredState{owner: "crd", objects: []*unstructured.Unstructured{newDriftObject("Widget", "test", nil)}}
+	crd.objects[0].SetAPIVersion("example.com/v1")
+
+	drifted, err := stateDrift(context.TODO(), client, staticMapper{mapper}, "test", "trustacks", []*desiredState{release, component, crd})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []DriftedResource{
+		{Owner: "release", Resource: "ConfigMap/trustacks/changed", Status: DriftChanged, Fields: []string{"data.key"}},
+		{Owner: "release", Resource: "Secret/trustacks/missing", Status: DriftMissing},
+		{Owner: "release", Resource: "ConfigMap/trustacks/extra", Status: DriftExtra, ref: objectRef{APIVersion: "v1", Kind: "ConfigMap", Namespace: "trustacks", Name: "extra"}},
+	}, drifted[release])
+	assert.Equal(t, []DriftedResource{
+		{Owner: "component", Resource: "Secret/trustacks/component-extra", Status: DriftExtra, ref: objectRef{APIVersion: "v1", Kind: "Secret", Namespace: "trustacks", Name: "component-extra"}},
+	}, drifted[component])
+	assert.Equal(t, []DriftedResource{
+		{Owner: "crd", Resource: "Widget/trustacks/test", Status: DriftMissing},
+	}, drifted[crd])
+
+	if err := deleteObjects(context.TODO(), client, staticMapper{mapper}, []objectRef{drifted[component][0].ref}); err != nil {
+		t.Fatal(err)
+	}
+	drifted, err = stateDrift(context.TODO(), client, staticMapper{mapper}, "test", "trustacks", []*desiredState{component})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, drifted[component], "expected the extra resource to be deleted")
+}
@@ -0,0 +1,522 @@
+package toolchain
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"filippo.io/age"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/release"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// export archive layout.
+const (
+	exportManifestFile   = "export.json"
+	exportToolchainDir   = "toolchain"
+	exportClustersDir    = "clusters"
+	generatedSecretsFile = "secrets.json.age"
+	releaseSecretsFile   = "releases.json.age"
+)
+
+// encryptedSuffix is the suffix of the encrypted toolchain files in
+// the export archive.
+const encryptedSuffix = ".age"
+
+// encryptedFiles are the patterns of the toolchain files that contain
+// credentials, such as the config, the component values, the
+// controller resources and the application secrets. They are encrypted
+// in the export archive.
+var encryptedFiles = []string{
+	"toolchain-config.yaml",
+	"parameter-overrides.yaml",
+	filepath.Join("components", "*", "override-values.yaml"),
+	filepath.Join("chart", controllerResourcesDir, "*.yaml"),
+	filepath.Join("applications", "*", "templates", "application-secret.yaml"),
+}
+
+// releaseSecretType is the type of the helm release storage secrets.
+const releaseSecretType = "helm.sh/release.v1"
+
+// exportManifest indexes the contents of an export archive.
+type exportManifest struct {
+	Name string `json:"name"`
+	// Recipient is the age public key that the secrets are
+	// encrypted with.
+	Recipient string `json:"recipient"`
+	// Clusters are the cluster target names. An empty name is the
+	// default cluster.
+	Clusters []string `json:"clusters"`
+}
+
+// exportClusterDir returns the archive directory of the cluster
+// target secrets.
+func exportClusterDir(clusterName string) string {
+	if clusterName == "" {
+		clusterName = "default"
+	}
+	return filepath.Join(exportClustersDir, clusterName)
+}
+
+// exportedSecrets returns the secrets generated in the namespaces,
+// such as the hook credentials, and the helm release storage secrets.
+// The secrets of the releases, of the service accounts and those owned
+// by other objects are recreated on install and are not exported.
+func exportedSecrets(ctx context.Context, clientset kubernetes.Interface, namespaces []string) ([]corev1.Secret, []corev1.Secret, error) {
+	var generated, releases []corev1.Secret
+	for _, namespace := range namespaces {
+		secrets, err := clientset.CoreV1().Secrets(namespace).List(ctx, metav1.ListOptions{})
+		if errors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, secret := range secrets.Items {
+			switch {
+			case secret.Type == releaseSecretType:
+				releases = append(releases, cleanSecret(secret))
+			case secret.Type == corev1.SecretTypeServiceAccountToken:
+			case len(secret.OwnerReferences) > 0:
+			case secret.Annotations[releaseNameAnnotation] != "":
+			default:
+				generated = append(generated, cleanSecret(secret))
+			}
+		}
+	}
+	return generated, releases, nil
+}
+
+// cleanSecret drops the server managed fields of the secret.
+func cleanSecret(secret corev1.Secret) corev1.Secret {
+	return corev1.Secret{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        secret.Name,
+			Namespace:   secret.Namespace,
+			Labels:      secret.Labels,
+			Annotations: secret.Annotations,
+		},
+		Type: secret.Type,
+		Data: secret.Data,
+	}
+}
+
+// encryptFile writes the data encrypted for the age recipient.
+func encryptFile(path string, data []byte, recipient age.Recipient) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w, err := age.Encrypt(f, recipient)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// decryptFile reads the data encrypted for the age identity.
+func decryptFile(path string, identity age.Identity) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, err := age.Decrypt(f, identity)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting %s: %s", filepath.Base(path), err)
+	}
+	return io.ReadAll(r)
+}
+
+// encryptSecrets writes the secrets encrypted for the age recipient.
+func encryptSecrets(path string, secrets []corev1.Secret, recipient age.Recipient) error {
+	data, err := json.Marshal(secrets)
+	if err != nil {
+		return err
+	}
+	return encryptFile(path, data, recipient)
+}
+
+// decryptSecrets reads the secrets encrypted for the age identity.
+func decryptSecrets(path string, identity age.Identity) ([]corev1.Secret, error) {
+	data, err := decryptFile(path, identity)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var secrets []corev1.Secret
+	if err := json.Unmarshal(data, &secrets); err != nil {
+		return nil, err
+	}
+	return secrets, nil
+}
+
+// encryptFiles replaces the credential files of the toolchain
+// directory with their encrypted copies.
+func encryptFiles(dir string, recipient age.Recipient) error {
+	for _, pattern := range encryptedFiles {
+		paths, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return err
+		}
+		for _, path := range paths {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			if err := encryptFile(path+encryptedSuffix, data, recipient); err != nil {
+				return err
+			}
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// decryptFiles replaces the encrypted credential files of the
+// toolchain directory with their decrypted contents.
+func decryptFiles(dir string, identity age.Identity) error {
+	for _, pattern := range encryptedFiles {
+		paths, err := filepath.Glob(filepath.Join(dir, pattern+encryptedSuffix))
+		if err != nil {
+			return err
+		}
+		for _, path := range paths {
+			data, err := decryptFile(path, identity)
+			if err != nil {
+				return err
+			}
+			if err := os.WriteFile(strings.TrimSuffix(path, encryptedSuffix), data, 0600); err != nil {
+				return err
+			}
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// exportToolchainFiles copies the toolchain directory to the export
+// directory. The age key is left out and the credential files are
+// encrypted for the recipient.
+func (tc *toolchain) exportToolchainFiles(dir string, recipient age.Recipient) error {
+	dst := filepath.Join(dir, exportToolchainDir)
+	if err := copyDir(tc.path(), dst); err != nil {
+		return err
+	}
+	// the age key is only written to the key file.
+	key, err := filepath.Rel(tc.path(), tc.ageKeySecretPath())
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(dst, key)); err != nil {
+		return err
+	}
+	return encryptFiles(dst, recipient)
+}
+
+// writeAgeKey writes the age identity in the age-keygen format.
+func writeAgeKey(path string, identity *age.X25519Identity) error {
+	data := fmt.Sprintf("# public key: %s\n%s\n", identity.Recipient(), identity)
+	return os.WriteFile(path, []byte(data), 0600)
+}
+
+// readAgeKey reads the age identity of an age-keygen key file.
+func readAgeKey(path string) (*age.X25519Identity, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	identities, err := age.ParseIdentities(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	for _, identity := range identities {
+		if x25519, ok := identity.(*age.X25519Identity); ok {
+			return x25519, nil
+		}
+	}
+	return nil, fmt.Errorf("%s does not contain an X25519 identity", path)
+}
+
+// restoreSecrets creates the secrets or overwrites the existing ones
+// with the exported data.
+func restoreSecrets(ctx context.Context, clientset kubernetes.Interface, secrets []corev1.Secret) error {
+	for i := range secrets {
+		secret := &secrets[i]
+		client := clientset.CoreV1().Secrets(secret.Namespace)
+		_, err := client.Create(ctx, secret, metav1.CreateOptions{})
+		if !errors.IsAlreadyExists(err) {
+			if err != nil {
+				return fmt.Errorf("error restoring secret '%s/%s': %s", secret.Namespace, secret.Name, err)
+			}
+			continue
+		}
+		existing, err := client.Get(ctx, secret.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		secret.ResourceVersion = existing.ResourceVersion
+		if _, err := client.Update(ctx, secret, metav1.UpdateOptions{}); err != nil {
+			return fmt.Errorf("error restoring secret '%s/%s': %s", secret.Namespace, secret.Name, err)
+		}
+	}
+	return nil
+}
+
+// installCRDs creates the custom resource definitions of the chart and
+// its dependencies, which are not installed by upgrades.
+func installCRDs(ctx context.Context, client dynamic.Interface, mapper meta.ResettableRESTMapper, ch *chart.Chart) error {
+	for _, crd := range ch.CRDObjects() {
+		objects, err := decodeObjects(crd.File.Data)
+		if err != nil {
+			return fmt.Errorf("error decoding %s: %s", crd.Filename, err)
+		}
+		for _, obj := range objects {
+			ri, err := resourceInterface(ctx, client, mapper, obj, "")
+			if err != nil {
+				return err
+			}
+			if _, err := ri.Create(ctx, obj, metav1.CreateOptions{}); err != nil && !errors.IsAlreadyExists(err) {
+				return fmt.Errorf("%s: %s", refOf(obj), err)
+			}
+		}
+	}
+	mapper.Reset()
+	return nil
+}
+
+// namespaceNames returns the names of the toolchain and application
+// namespaces.
+func (tc *toolchain) namespaceNames() []string {
+	var names []string
+	for _, namespace := range tc.namespaces() {
+		names = append(names, namespace.Name)
+	}
+	return names
+}
+
+// restoreReleases re-applies the restored helm releases and the
+// kustomize and manifest components. The toolchain chart is applied
+// first on each cluster target.
+func (tc *toolchain) restoreReleases(ctx context.Context) error {
+	slug := fmt.Sprintf("trustacks-toolchain-%s", tc.name)
+	for _, target := range tc.clusters() {
+		cluster := target.config
+		client, mapper, err := newDynamicClient(cluster)
+		if err != nil {
+			return err
+		}
+		var releases []*release.Release
+		for _, namespace := range tc.namespaceNames() {
+			helmClient, err := newHelmClient(namespace, cluster)
+			if err != nil {
+				return err
+			}
+			deployed, err := helmClient.ListDeployedReleases()
+			if err != nil {
+				return err
+			}
+			for _, rel := range deployed {
+				if rel.Namespace == namespace {
+					releases = append(releases, rel)
+				}
+			}
+		}
+		sort.SliceStable(releases, func(i, j int) bool {
+			return releases[i].Name == slug && releases[j].Name != slug
+		})
+		for _, rel := range releases {
+			logger.WithField("cluster", clusterLabel(cluster)).Infof("restoring release '%s'", rel.Name)
+			if err := installCRDs(ctx, client, mapper, rel.Chart); err != nil {
+				return fmt.Errorf("error installing the '%s' crds: %s", rel.Name, err)
+			}
+			if err := tc.reapplyRelease(ctx, rel, cluster); err != nil {
+				return err
+			}
+		}
+	}
+	components, err := os.ReadDir(tc.componentsPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, component := range components {
+		name := component.Name()
+		metadata, err := readComponentMetadata(filepath.Join(tc.componentsPath(), name))
+		if err != nil {
+			continue
+		}
+		if err := tc.applyComponent(ctx, name, tc.namespace(), tc.cluster(name), metadata); err != nil {
+			return fmt.Errorf("error restoring '%s': %s", name, err)
+		}
+	}
+	return nil
+}
+
+// Export writes the toolchain directory, the generated secrets and the
+// helm release state of the toolchain to an archive. The secrets, and
+// the toolchain files that contain credentials, are encrypted with the
+// toolchain age key, which is written to keyOutput instead of the
+// archive.
+func Export(ctx context.Context, name, output, keyOutput string) error {
+	tc, err := newToolchainFromConfig(name)
+	if err != nil {
+		return fmt.Errorf("error loading toolchain '%s': %s", name, err)
+	}
+	if tc.installer() == installerGitOps {
+		return fmt.Errorf("toolchains installed with the gitops installer are restored from the gitops repository")
+	}
+	identity, err := tc.ageIdentity()
+	if err != nil {
+		return fmt.Errorf("error reading the age key: %s", err)
+	}
+	dir, err := os.MkdirTemp("", "trustacks-export-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	if err := tc.exportToolchainFiles(dir, identity.Recipient()); err != nil {
+		return fmt.Errorf("error exporting the toolchain files: %s", err)
+	}
+	manifest := &exportManifest{Name: tc.name, Recipient: identity.Recipient().String()}
+	for _, target := range tc.clusters() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		clientset, err := newClientset(target.config)
+		if err != nil {
+			return err
+		}
+		generated, releases, err := exportedSecrets(ctx, clientset, tc.namespaceNames())
+		if err != nil {
+			return fmt.Errorf("cluster '%s': error listing the secrets: %s", clusterLabel(target.config), err)
+		}
+		logger.WithField("cluster", clusterLabel(target.config)).Infof("exporting %d generated secret(s) and %d release revision(s)", len(generated), len(releases))
+		clusterDir := filepath.Join(dir, exportClusterDir(target.name))
+		if err := os.MkdirAll(clusterDir, 0700); err != nil {
+			return err
+		}
+		if err := encryptSecrets(filepath.Join(clusterDir, generatedSecretsFile), generated, identity.Recipient()); err != nil {
+			return err
+		}
+		if err := encryptSecrets(filepath.Join(clusterDir, releaseSecretsFile), releases, identity.Recipient()); err != nil {
+			return err
+		}
+		manifest.Clusters = append(manifest.Clusters, target.name)
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, exportManifestFile), data, 0644); err != nil {
+		return err
+	}
+	if err := writeArchive(dir, output); err != nil {
+		return fmt.Errorf("error writing the archive: %s", err)
+	}
+	return writeAgeKey(keyOutput, identity)
+}
+
+// Import restores an exported toolchain to the clusters of its config.
+// The generated secrets and the helm release state are restored before
+// the releases are re-applied, so the credentials are not rotated and
+// the install hooks are not run again.
+func Import(ctx context.Context, input, keyPath string, force bool) (string, error) {
+	dir, err := os.MkdirTemp("", "trustacks-import-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+	if err := extractArchive(input, dir); err != nil {
+		return "", fmt.Errorf("error extracting the archive: %s", err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, exportManifestFile))
+	if err != nil {
+		return "", err
+	}
+	manifest := &exportManifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return "", err
+	}
+	identity, err := readAgeKey(keyPath)
+	if err != nil {
+		return "", fmt.Errorf("error reading the age key: %s", err)
+	}
+	if identity.Recipient().String() != manifest.Recipient {
+		return "", fmt.Errorf("the age key does not match the archive key '%s'", manifest.Recipient)
+	}
+	tc := &toolchain{name: manifest.Name}
+	if _, err := os.Stat(tc.path()); !os.IsNotExist(err) {
+		if !force {
+			return "", fmt.Errorf("error: toolchain '%s' already exists", tc.name)
+		}
+		if err := os.RemoveAll(tc.path()); err != nil {
+			return "", err
+		}
+	}
+	if err := copyDir(filepath.Join(dir, exportToolchainDir), tc.path()); err != nil {
+		return "", err
+	}
+	if err := decryptFiles(tc.path(), identity); err != nil {
+		return "", err
+	}
+	if err := tc.writeAgeKeySecret(identity); err != nil {
+		return "", err
+	}
+	if tc, err = newToolchainFromConfig(manifest.Name); err != nil {
+		return "", err
+	}
+	for _, target := range tc.clusters() {
+		if err := ctx.Err(); err != nil {
+			return tc.name, err
+		}
+		clusterDir := filepath.Join(dir, exportClusterDir(target.name))
+		generated, err := decryptSecrets(filepath.Join(clusterDir, generatedSecretsFile), identity)
+		if err != nil {
+			return tc.name, err
+		}
+		releases, err := decryptSecrets(filepath.Join(clusterDir, releaseSecretsFile), identity)
+		if err != nil {
+			return tc.name, err
+		}
+		clientset, err := newClientset(target.config)
+		if err != nil {
+			return tc.name, err
+		}
+		for _, namespace := range tc.namespaces() {
+			if err := ensureNamespace(ctx, clientset, namespace); err != nil {
+				return tc.name, fmt.Errorf("cluster '%s': %s", clusterLabel(target.config), err)
+			}
+		}
+		logger.WithField("cluster", clusterLabel(target.config)).Infof("restoring %d generated secret(s) and %d release revision(s)", len(generated), len(releases))
+		if err := restoreSecrets(ctx, clientset, append(generated, releases...)); err != nil {
+			return tc.name, err
+		}
+	}
+	return tc.name, tc.restoreReleases(ctx)
+}
@@ -0,0 +1,224 @@
+package toolchain
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newExportSecret(name string, secretType corev1.SecretType) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "trustacks", ResourceVersion: "1", UID: "uid"},
+		Type:       secretType,
+		Data:       map[string][]byte{"password": []byte(name)},
+	}
+}
+
+func TestExportedSecrets(t *testing.T) {
+	managed := newExportSecret("managed", corev1.SecretTypeOpaque)
+	managed.Annotations = map[string]string{releaseNameAnnotation: "trustacks-toolchain-test"}
+	owned := newExportSecret("owned", corev1.SecretTypeOpaque)
+	owned.OwnerReferences = []metav1.OwnerReference{{Name: "owner"}}
+	clientset := fake.NewSimpleClientset(
+		newExportSecret("oidc-client", corev1.SecretTypeOpaque),
+		newExportSecret("sh.helm.release.v1.test.v1", releaseSecretType),
+		newExportSecret("token", corev1.SecretTypeServiceAccountToken),
+		managed,
+		owned,
+	)
+	generated, releases, err := exportedSecrets(context.TODO(), clientset, []string{"trustacks", "other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, generated, 1) {
+		assert.Equal(t, "oidc-client", generated[0].Name)
+		assert.Empty(t, generated[0].ResourceVersion)
+		assert.Empty(t, generated[0].UID)
+	}
+	if assert.Len(t, releases, 1) {
+		assert.Equal(t, "sh.helm.release.v1.test.v1", releases[0].Name)
+	}
+}
+
+func TestEncryptSecrets(t *testing.T) {
+	d, err := os.MkdirTemp("", "test-export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(d, generatedSecretsFile)
+	secrets := []corev1.Secret{cleanSecret(*newExportSecret("oidc-client", corev1.SecretTypeOpaque))}
+	if err := encryptSecrets(path, secrets, identity.Recipient()); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotContains(t, string(data), "oidc-client")
+	decrypted, err := decryptSecrets(path, identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, secrets, decrypted)
+
+	other, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = decryptSecrets(path, other)
+	assert.Error(t, err, "expected the secrets to be unreadable with another key")
+
+	missing, err := decryptSecrets(filepath.Join(d, releaseSecretsFile), identity)
+	assert.NoError(t, err)
+	assert.Empty(t, missing)
+}
+
+func TestExportToolchainFiles(t *testing.T) {
+	defer patchToolchainRoot()()
+	tc := &toolchain{name: "test", config: &toolchainConfig{Name: "test", Parameters: map[string]interface{}{"password": "config-s3cr3t"}}}
+	if err := tc.createAgeKeySecret(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.saveConfig(); err != nil {
+		t.Fatal(err)
+	}
+	app := &application{toolchain: tc, name: "web"}
+	if err := os.MkdirAll(filepath.Join(app.path(), "templates"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.addSecrets(map[string]string{"token": "app-s3cr3t"}); err != nil {
+		t.Fatal(err)
+	}
+	identity, err := tc.ageIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := os.MkdirTemp("", "test-export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	if err := tc.exportToolchainFiles(filepath.Join(d, "export"), identity.Recipient()); err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(d, "export.tar.gz")
+	if err := writeArchive(filepath.Join(d, "export"), archive); err != nil {
+		t.Fatal(err)
+	}
+	// the archive contents are searched for the secret values.
+	f, err := os.Open(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var contents bytes.Buffer
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents.WriteString(header.Name + "\n")
+		if _, err := io.Copy(&contents, tr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, secret := range []string{"config-s3cr3t", "app-s3cr3t", base64.StdEncoding.EncodeToString([]byte("app-s3cr3t")), "AGE-SECRET-KEY"} {
+		assert.NotContains(t, contents.String(), secret, "expected the archive not to contain the secret")
+	}
+	assert.Contains(t, contents.String(), "toolchain/toolchain-config.yaml.age")
+
+	restored := filepath.Join(d, "restored")
+	if err := os.Mkdir(restored, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := extractArchive(archive, restored); err != nil {
+		t.Fatal(err)
+	}
+	if err := decryptFiles(filepath.Join(restored, exportToolchainDir), identity); err != nil {
+		t.Fatal(err)
+	}
+	config, err := os.ReadFile(filepath.Join(restored, exportToolchainDir, "toolchain-config.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, string(config), "config-s3cr3t")
+	assert.FileExists(t, filepath.Join(restored, exportToolchainDir, "applications", "web", "templates", "application-secret.yaml"))
+	assert.NoFileExists(t, filepath.Join(restored, exportToolchainDir, "toolchain-config.yaml.age"))
+}
+
+func TestAgeKey(t *testing.T) {
+	defer patchToolchainRoot()()
+	tc := &toolchain{name: "test"}
+	if err := tc.createAgeKeySecret(); err != nil {
+		t.Fatal(err)
+	}
+	identity, err := tc.ageIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(tc.path(), "age.key")
+	if err := writeAgeKey(path, identity); err != nil {
+		t.Fatal(err)
+	}
+	read, err := readAgeKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, identity.String(), read.String())
+
+	// the restored secret template keeps the exported key.
+	restored := &toolchain{name: "restored"}
+	if err := restored.writeAgeKeySecret(read); err != nil {
+		t.Fatal(err)
+	}
+	restoredIdentity, err := restored.ageIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, identity.String(), restoredIdentity.String())
+}
+
+func TestRestoreSecrets(t *testing.T) {
+	existing := newExportSecret("oidc-client", corev1.SecretTypeOpaque)
+	existing.Data = map[string][]byte{"password": []byte("rotated")}
+	clientset := fake.NewSimpleClientset(existing)
+	secrets := []corev1.Secret{
+		cleanSecret(*newExportSecret("oidc-client", corev1.SecretTypeOpaque)),
+		cleanSecret(*newExportSecret("sh.helm.release.v1.test.v1", releaseSecretType)),
+	}
+	if err := restoreSecrets(context.TODO(), clientset, secrets); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"oidc-client", "sh.helm.release.v1.test.v1"} {
+		secret, err := clientset.CoreV1().Secrets("trustacks").Get(context.TODO(), name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, []byte(name), secret.Data["password"])
+	}
+}
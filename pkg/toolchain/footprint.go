@@ -0,0 +1,207 @@
+package toolchain
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// footprint is the resource footprint of rendered manifests.
+type footprint struct {
+	CPU     resource.Quantity
+	Memory  resource.Quantity
+	Storage resource.Quantity
+	// NodeCPU and NodeMemory are the requests of the daemon set pods,
+	// which run on every node.
+	NodeCPU    resource.Quantity
+	NodeMemory resource.Quantity
+}
+
+// add adds the other footprint.
+func (f *footprint) add(other *footprint) {
+	f.CPU.Add(other.CPU)
+	f.Memory.Add(other.Memory)
+	f.Storage.Add(other.Storage)
+	f.NodeCPU.Add(other.NodeCPU)
+	f.NodeMemory.Add(other.NodeMemory)
+}
+
+// onNodes returns the cpu and memory requests of the footprint on the
+// number of nodes.
+func (f *footprint) onNodes(nodes int) (cpu, memory resource.Quantity) {
+	cpu, memory = f.CPU.DeepCopy(), f.Memory.DeepCopy()
+	for i := 0; i < nodes; i++ {
+		cpu.Add(f.NodeCPU)
+		memory.Add(f.NodeMemory)
+	}
+	return cpu, memory
+}
+
+// String returns the footprint quantities.
+func (f *footprint) String() string {
+	return fmt.Sprintf("cpu: %s, memory: %s, storage: %s, cpu per node: %s, memory per node: %s", f.CPU.String(), f.Memory.String(), f.Storage.String(), f.NodeCPU.String(), f.NodeMemory.String())
+}
+
+// podRequests returns the effective requests of the pod spec, which are
+// the sum of the container requests or the highest init container
+// request. The limits are used for containers without requests.
+func podRequests(spec *corev1.PodSpec) (cpu, memory resource.Quantity) {
+	request := func(c corev1.Container, name corev1.ResourceName) resource.Quantity {
+		if q, ok := c.Resources.Requests[name]; ok {
+			return q
+		}
+		return c.Resources.Limits[name]
+	}
+	for _, c := range spec.Containers {
+		cpu.Add(request(c, corev1.ResourceCPU))
+		memory.Add(request(c, corev1.ResourceMemory))
+	}
+	for _, c := range spec.InitContainers {
+		if q := request(c, corev1.ResourceCPU); q.Cmp(cpu) > 0 {
+			cpu = q
+		}
+		if q := request(c, corev1.ResourceMemory); q.Cmp(memory) > 0 {
+			memory = q
+		}
+	}
+	return cpu, memory
+}
+
+// claimStorage returns the requested storage of the claim spec.
+func claimStorage(spec *corev1.PersistentVolumeClaimSpec) resource.Quantity {
+	return spec.Resources.Requests[corev1.ResourceStorage]
+}
+
+// workload contains the fields of the workload kinds that make up
+// their footprint.
+type workload struct {
+	Spec struct {
+		Replicas             *int32                         `json:"replicas"`
+		Template             corev1.PodTemplateSpec         `json:"template"`
+		VolumeClaimTemplates []corev1.PersistentVolumeClaim `json:"volumeClaimTemplates"`
+	} `json:"spec"`
+}
+
+// objectFootprint returns the footprint of the object. Daemon sets are
+// counted per node, and hooks, jobs and cron jobs are not counted, as
+// they do not run permanently.
+func objectFootprint(obj *unstructured.Unstructured) (*footprint, error) {
+	f := &footprint{}
+	if _, ok := obj.GetAnnotations()["helm.sh/hook"]; ok {
+		return f, nil
+	}
+	switch obj.GetKind() {
+	case "Pod":
+		pod := &corev1.Pod{}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, pod); err != nil {
+			return nil, err
+		}
+		f.CPU, f.Memory = podRequests(&pod.Spec)
+	case "DaemonSet":
+		w := &workload{}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, w); err != nil {
+			return nil, err
+		}
+		f.NodeCPU, f.NodeMemory = podRequests(&w.Spec.Template.Spec)
+	case "Deployment", "StatefulSet", "ReplicaSet", "ReplicationController":
+		w := &workload{}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, w); err != nil {
+			return nil, err
+		}
+		replicas := int64(1)
+		if w.Spec.Replicas != nil {
+			replicas = int64(*w.Spec.Replicas)
+		}
+		cpu, memory := podRequests(&w.Spec.Template.Spec)
+		for i := int64(0); i < replicas; i++ {
+			f.CPU.Add(cpu)
+			f.Memory.Add(memory)
+			for _, claim := range w.Spec.VolumeClaimTemplates {
+				f.Storage.Add(claimStorage(&claim.Spec))
+			}
+		}
+	case "PersistentVolumeClaim":
+		claim := &corev1.PersistentVolumeClaim{}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, claim); err != nil {
+			return nil, err
+		}
+		f.Storage = claimStorage(&claim.Spec)
+	}
+	return f, nil
+}
+
+// manifestFootprint returns the footprint of the manifests.
+func manifestFootprint(manifests []byte) (*footprint, error) {
+	objects, err := decodeObjects(manifests)
+	if err != nil {
+		return nil, err
+	}
+	total := &footprint{}
+	for _, obj := range objects {
+		f, err := objectFootprint(obj)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", refOf(obj), err)
+		}
+		total.add(f)
+	}
+	return total, nil
+}
+
+// footprints returns the footprint of each component, rendered with
+// its values and the post render pipeline.
+func (tc *toolchain) footprints(components []string) (map[string]*footprint, error) {
+	footprints := make(map[string]*footprint, len(components))
+	for _, name := range components {
+		manifests, err := tc.renderComponent(name)
+		if err != nil {
+			return nil, fmt.Errorf("error rendering '%s': %s", name, err)
+		}
+		if manifests, err = tc.postRender(manifests); err != nil {
+			return nil, fmt.Errorf("error rendering '%s': %s", name, err)
+		}
+		f, err := manifestFootprint(manifests)
+		if err != nil {
+			return nil, fmt.Errorf("error reading the '%s' footprint: %s", name, err)
+		}
+		footprints[name] = f
+	}
+	return footprints, nil
+}
+
+// clusterFootprints sums the component footprints of each cluster
+// target.
+func (tc *toolchain) clusterFootprints(footprints map[string]*footprint) map[string]*footprint {
+	totals := map[string]*footprint{}
+	for name, f := range footprints {
+		clusterName := tc.clusterName(name)
+		if totals[clusterName] == nil {
+			totals[clusterName] = &footprint{}
+		}
+		totals[clusterName].add(f)
+	}
+	return totals
+}
+
+// describeFootprints returns a table of the component footprints.
+func describeFootprints(footprints map[string]*footprint) string {
+	names := make([]string, 0, len(footprints))
+	for name := range footprints {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	total := &footprint{}
+	fmt.Fprintf(&b, "%-30s %10s %10s %10s %10s %12s\n", "COMPONENT", "CPU", "MEMORY", "STORAGE", "NODE CPU", "NODE MEMORY")
+	for _, name := range names {
+		f := footprints[name]
+		total.add(f)
+		fmt.Fprintf(&b, "%-30s %10s %10s %10s %10s %12s\n", name, f.CPU.String(), f.Memory.String(), f.Storage.String(), f.NodeCPU.String(), f.NodeMemory.String())
+	}
+	fmt.Fprintf(&b, "%-30s %10s %10s %10s %10s %12s", "TOTAL", total.CPU.String(), total.Memory.String(), total.Storage.String(), total.NodeCPU.String(), total.NodeMemory.String())
+	return b.String()
+}
@@ -0,0 +1,176 @@
+package toolchain
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const testFootprintManifests = `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  replicas: 2
+  template:
+    spec:
+      initContainers:
+      - name: migrate
+        resources:
+          requests:
+            memory: 1Gi
+      containers:
+      - name: web
+        resources:
+          requests:
+            cpu: 250m
+            memory: 256Mi
+      - name: sidecar
+        resources:
+          limits:
+            cpu: 100m
+            memory: 64Mi
+---
+apiVersion: apps/v1
+kind: StatefulSet
+metadata:
+  name: db
+spec:
+  template:
+    spec:
+      containers:
+      - name: db
+        resources:
+          requests:
+            cpu: "1"
+            memory: 2Gi
+  volumeClaimTemplates:
+  - metadata:
+      name: data
+    spec:
+      resources:
+        requests:
+          storage: 8Gi
+---
+apiVersion: apps/v1
+kind: DaemonSet
+metadata:
+  name: agent
+spec:
+  template:
+    spec:
+      containers:
+      - name: agent
+        resources:
+          requests:
+            cpu: 50m
+---
+apiVersion: v1
+kind: PersistentVolumeClaim
+metadata:
+  name: cache
+spec:
+  resources:
+    requests:
+      storage: 2Gi
+---
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: setup
+  annotations:
+    helm.sh/hook: post-install
+spec:
+  template:
+    spec:
+      containers:
+      - name: setup
+        resources:
+          requests:
+            cpu: "8"
+`
+
+func TestManifestFootprint(t *testing.T) {
+	f, err := manifestFootprint([]byte(testFootprintManifests))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// web: 2 x max(350m + 320Mi, 1Gi init), db: 1 + 2Gi, agent: 50m per node.
+	assert.Equal(t, "1700m", f.CPU.String())
+	assert.Equal(t, "50m", f.NodeCPU.String())
+	assert.Equal(t, "4Gi", f.Memory.String())
+	assert.Equal(t, "10Gi", f.Storage.String())
+}
+
+func TestFootprints(t *testing.T) {
+	defer patchToolchainRoot()()
+	tc := &toolchain{name: "test", config: &toolchainConfig{
+		Clusters: map[string]clusterConfig{"edge": {Context: "edge", Components: []string{"rbac"}}},
+	}}
+	newTestToolchainChart(t, tc)
+	if err := os.MkdirAll(filepath.Join(tc.componentsPath(), "db"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(tc.componentsPath(), "db", componentMetadataFile), []byte("type: manifest\nversion: 1.0.0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(tc.componentsPath(), "db", manifestsFile), []byte(testFootprintManifests), 0644); err != nil {
+		t.Fatal(err)
+	}
+	footprints, err := tc.footprints([]string{"helloworld", "rbac", "db"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, footprints, 3)
+	assert.True(t, footprints["helloworld"].CPU.IsZero(), "expected the chart without requests to be empty")
+	totals := tc.clusterFootprints(footprints)
+	assert.Equal(t, "4Gi", totals[""].Memory.String())
+	assert.True(t, totals["edge"].Memory.IsZero())
+	assert.Contains(t, describeFootprints(footprints), "TOTAL")
+
+	clientset := newPreflightClientset(newPreflightNode("node", "2", "2Gi", true))
+	checks := &preflightChecks{ctx: context.TODO(), clientset: clientset, namespace: &namespaceConfig{Name: "trustacks"}, footprint: totals[""]}
+	assert.Equal(t, []string{
+		"footprint: the components request 4Gi memory but the schedulable nodes have 2Gi free of 2Gi allocatable. disable components, lower their requests or add nodes",
+	}, failedChecks(checks.run(nil)))
+}
+
+func TestCheckFootprint(t *testing.T) {
+	newPod := func(namespace, name, node, cpu string, phase corev1.PodPhase) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+			Spec: corev1.PodSpec{NodeName: node, Containers: []corev1.Container{{
+				Name:      name,
+				Resources: corev1.ResourceRequirements{Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse(cpu)}},
+			}}},
+			Status: corev1.PodStatus{Phase: phase},
+		}
+	}
+	f := &footprint{CPU: resource.MustParse("1"), NodeCPU: resource.MustParse("500m")}
+	objects := []runtime.Object{
+		newPreflightNode("node-1", "2", "4Gi", true),
+		newPreflightNode("node-2", "2", "4Gi", true),
+		newPreflightNode("node-3", "2", "4Gi", false),
+		newPod("default", "app", "node-1", "1500m", corev1.PodRunning),
+		newPod("default", "done", "node-1", "2", corev1.PodSucceeded),
+		newPod("default", "elsewhere", "node-3", "2", corev1.PodRunning),
+		newPod("trustacks", "replaced", "node-2", "2", corev1.PodRunning),
+	}
+	checks := &preflightChecks{ctx: context.TODO(), clientset: newPreflightClientset(objects...), namespace: &namespaceConfig{Name: "trustacks"}, footprint: f}
+	checks.checkFootprint()
+	assert.Empty(t, failedChecks(checks.results), "expected the footprint to fit the free capacity")
+
+	objects = append(objects, newPod("default", "worker", "node-2", "1", corev1.PodPending))
+	checks = &preflightChecks{ctx: context.TODO(), clientset: newPreflightClientset(objects...), namespace: &namespaceConfig{Name: "trustacks"}, footprint: f}
+	checks.checkFootprint()
+	assert.Equal(t, []string{
+		"footprint: the components request 2 cpu but the schedulable nodes have 1500m free of 4 allocatable. disable components, lower their requests or add nodes",
+	}, failedChecks(checks.results))
+}
@@ -0,0 +1,406 @@
+package toolchain
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/yaml"
+)
+
+// installer backends.
+const (
+	// installerHelm installs the toolchain as helm releases.
+	installerHelm = "helm"
+	// installerGitOps commits the rendered manifests to a git
+	// repository.
+	installerGitOps = "gitops"
+)
+
+// installerConfig contains the installer backend of the toolchain.
+type installerConfig struct {
+	// Type is the installer backend. The toolchain is installed with
+	// helm if it is empty.
+	Type string `json:"type"`
+	// GitOps is the repository of the gitops installer.
+	GitOps *gitOpsConfig `json:"gitops" yaml:"gitops"`
+	// ArgoCD contains the settings of the argocd installer.
+	ArgoCD *argoCDConfig `json:"argocd" yaml:"argocd"`
+	// Flux contains the settings of the flux installer.
+	Flux *fluxConfig `json:"flux"`
+}
+
+// gitOpsConfig contains the git repository that the rendered
+// manifests are committed to.
+type gitOpsConfig struct {
+	// URL is the https url of the repository.
+	URL string `json:"url"`
+	// Branch is the branch that the manifests are committed to.
+	Branch string `json:"branch"`
+	// Path is the repository directory of the manifests. It defaults
+	// to toolchains/<toolchain name>.
+	Path     string `json:"path"`
+	Username string `json:"username"`
+	// PasswordEnv is the environment variable containing the password
+	// or access token.
+	PasswordEnv string `json:"passwordEnv" yaml:"passwordEnv"`
+	// PasswordFile is the file containing the password or access
+	// token.
+	PasswordFile string `json:"passwordFile" yaml:"passwordFile"`
+	// IncludeSecrets commits the rendered secrets. The secrets are
+	// written to the toolchain directory instead if it is false.
+	IncludeSecrets bool   `json:"includeSecrets" yaml:"includeSecrets"`
+	AuthorName     string `json:"authorName" yaml:"authorName"`
+	AuthorEmail    string `json:"authorEmail" yaml:"authorEmail"`
+}
+
+// clusterScopedKinds are the built-in kinds without a namespace.
+var clusterScopedKinds = map[string]bool{
+	"APIService":                     true,
+	"CSIDriver":                      true,
+	"CSINode":                        true,
+	"CertificateSigningRequest":      true,
+	"ClusterRole":                    true,
+	"ClusterRoleBinding":             true,
+	"CustomResourceDefinition":       true,
+	"IngressClass":                   true,
+	"MutatingWebhookConfiguration":   true,
+	"Namespace":                      true,
+	"Node":                           true,
+	"PersistentVolume":               true,
+	"PodSecurityPolicy":              true,
+	"PriorityClass":                  true,
+	"RuntimeClass":                   true,
+	"StorageClass":                   true,
+	"ValidatingWebhookConfiguration": true,
+	"VolumeAttachment":               true,
+}
+
+// installer returns the installer backend of the toolchain config.
+func (tc *toolchain) installer() string {
+	if tc.config == nil || tc.config.Installer == nil || tc.config.Installer.Type == "" {
+		return installerHelm
+	}
+	return tc.config.Installer.Type
+}
+
+// validateInstaller validates the installer backend of the config.
+func validateInstaller(config *toolchainConfig) error {
+	if config.Installer == nil {
+		return nil
+	}
+	switch config.Installer.Type {
+	case "", installerHelm:
+		return nil
+	case installerArgoCD, installerFlux:
+		// the controller resources of all components are part of the
+		// toolchain chart, which is installed on every cluster target.
+		if len(config.Clusters) > 0 {
+			return fmt.Errorf("cluster targets are not supported by the %s installer", config.Installer.Type)
+		}
+		return nil
+	case installerGitOps:
+		if config.Installer.GitOps == nil || config.Installer.GitOps.URL == "" {
+			return fmt.Errorf("the %s installer requires a repository url", config.Installer.Type)
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported installer '%s'", config.Installer.Type)
+}
+
+// gitOpsPath returns the repository directory of the manifests.
+func (tc *toolchain) gitOpsPath() string {
+	if p := tc.config.Installer.GitOps.Path; p != "" {
+		return p
+	}
+	return filepath.Join("toolchains", tc.name)
+}
+
+// postRender passes the manifests through the post render pipeline.
+func (tc *toolchain) postRender(manifests []byte) ([]byte, error) {
+	renderer, err := tc.postRenderer()
+	if err != nil || renderer == nil {
+		return manifests, err
+	}
+	rendered, err := renderer.Run(bytes.NewBuffer(manifests))
+	if err != nil {
+		return nil, err
+	}
+	return rendered.Bytes(), nil
+}
+
+// renderedObjects contains the rendered manifests of a cluster.
+type renderedObjects struct {
+	// files maps the manifest file names to the objects.
+	files map[string][]*unstructured.Unstructured
+	// secrets are the secrets that are not committed.
+	secrets []*unstructured.Unstructured
+}
+
+// renderCluster renders the toolchain chart and the components and
+// application charts of the cluster to plain manifests.
+//
+// The toolchain or application namespace is set on the objects without
+// a namespace that are not of a built-in cluster scoped kind.
+func (tc *toolchain) renderCluster(clusterName string, includeSecrets bool) (*renderedObjects, error) {
+	namespace := tc.namespaceConfig()
+	rendered := &renderedObjects{files: make(map[string][]*unstructured.Unstructured)}
+	add := func(file string, manifests []byte, namespace string) error {
+		manifests, err := tc.postRender(manifests)
+		if err != nil {
+			return err
+		}
+		objects, err := decodeObjects(manifests)
+		if err != nil {
+			return err
+		}
+		for _, obj := range objects {
+			if obj.GetNamespace() == "" && !clusterScopedKinds[obj.GetKind()] {
+				obj.SetNamespace(namespace)
+			}
+			if obj.GetKind() == "Secret" && !includeSecrets {
+				rendered.secrets = append(rendered.secrets, obj)
+				continue
+			}
+			rendered.files[file] = append(rendered.files[file], obj)
+		}
+		return nil
+	}
+	addNamespace := func(namespace *namespaceConfig) {
+		if namespace.Existing {
+			return
+		}
+		ns := &unstructured.Unstructured{}
+		ns.SetAPIVersion("v1")
+		ns.SetKind("Namespace")
+		ns.SetName(namespace.Name)
+		ns.SetLabels(namespace.Labels)
+		ns.SetAnnotations(namespace.Annotations)
+		rendered.files["namespace.yaml"] = append(rendered.files["namespace.yaml"], ns)
+	}
+	addNamespace(namespace)
+	manifests, err := renderChart(fmt.Sprintf("trustacks-toolchain-%s", tc.name), filepath.Join(tc.path(), "chart"), namespace.Name, "")
+	if err != nil {
+		return nil, fmt.Errorf("error rendering the toolchain chart: %s", err)
+	}
+	if err := add("toolchain.yaml", manifests, namespace.Name); err != nil {
+		return nil, err
+	}
+	components, err := os.ReadDir(tc.componentsPath())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, component := range components {
+		name := component.Name()
+		if tc.clusterName(name) != clusterName {
+			continue
+		}
+		manifests, err := tc.renderComponent(name)
+		if err != nil {
+			return nil, fmt.Errorf("error rendering '%s': %s", name, err)
+		}
+		if err := add(fmt.Sprintf("%s.yaml", name), manifests, namespace.Name); err != nil {
+			return nil, fmt.Errorf("error rendering '%s': %s", name, err)
+		}
+	}
+	apps, err := os.ReadDir(tc.applicationsPath())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, entry := range apps {
+		app := &application{name: entry.Name(), toolchain: tc}
+		if app.clusterName() != clusterName {
+			continue
+		}
+		appNamespace := app.namespaceConfig()
+		if appNamespace.Name != namespace.Name {
+			addNamespace(appNamespace)
+		}
+		manifests, err := renderChart(app.releaseName(), app.path(), appNamespace.Name, "")
+		if err != nil {
+			return nil, fmt.Errorf("error rendering application '%s': %s", app.name, err)
+		}
+		if err := add(fmt.Sprintf("application-%s.yaml", app.name), manifests, appNamespace.Name); err != nil {
+			return nil, fmt.Errorf("error rendering application '%s': %s", app.name, err)
+		}
+	}
+	return rendered, nil
+}
+
+// encodeObjects encodes the objects as a multi document manifest.
+func encodeObjects(objects []*unstructured.Unstructured) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, obj := range objects {
+		data, err := yaml.Marshal(obj.Object)
+		if err != nil {
+			return nil, err
+		}
+		buf.WriteString("---\n")
+		buf.Write(data)
+	}
+	return buf.Bytes(), nil
+}
+
+// writeRendered writes the rendered manifests and a kustomization of
+// the manifests to the directory. The directory is replaced so that
+// the removed components are pruned by the gitops controller.
+func writeRendered(dir string, rendered *renderedObjects) error {
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	files := make([]string, 0, len(rendered.files))
+	for file := range rendered.files {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		data, err := encodeObjects(rendered.files[file])
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(dir, file), data, 0644); err != nil {
+			return err
+		}
+	}
+	kustomization, err := yaml.Marshal(map[string]interface{}{
+		"apiVersion": "kustomize.config.k8s.io/v1beta1",
+		"kind":       "Kustomization",
+		"resources":  files,
+	})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "kustomization.yaml"), kustomization, 0644)
+}
+
+// gitOpsAuth returns the basic auth of the gitops repository.
+func gitOpsAuth(ctx context.Context, config *gitOpsConfig) (*http.BasicAuth, error) {
+	if config.Username == "" {
+		return nil, nil
+	}
+	password, err := (&repositoryConfig{PasswordEnv: config.PasswordEnv, PasswordFile: config.PasswordFile}).password(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &http.BasicAuth{Username: config.Username, Password: password}, nil
+}
+
+// publish renders the toolchain to plain manifests and commits them to
+// the gitops repository.
+//
+// The manifests of each cluster are written to the <path>/<cluster>
+// directory of the repository, where the default cluster directory is
+// named default. The secrets that are not committed are written to the
+// gitops-secrets directory of the toolchain so that they can be sealed
+// or applied out of band.
+func (tc *toolchain) publish(ctx context.Context, cloneFunc func(string, bool, *git.CloneOptions) (*git.Repository, error)) error {
+	config := tc.config.Installer.GitOps
+	auth, err := gitOpsAuth(ctx, config)
+	if err != nil {
+		return fmt.Errorf("error resolving the repository credentials: %s", err)
+	}
+	d, err := os.MkdirTemp("", "gitops")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(d)
+	opts := &git.CloneOptions{URL: config.URL, SingleBranch: true}
+	if auth != nil {
+		opts.Auth = auth
+	}
+	if config.Branch != "" {
+		opts.ReferenceName = plumbing.NewBranchReferenceName(config.Branch)
+	}
+	logger.WithField("repository", config.URL).Info("cloning the gitops repository")
+	repo, err := cloneFunc(d, false, opts)
+	if err != nil {
+		return fmt.Errorf("error cloning the gitops repository: %s", err)
+	}
+	for _, target := range tc.clusters() {
+		cluster := target.name
+		if cluster == "" {
+			cluster = "default"
+		}
+		rendered, err := tc.renderCluster(target.name, config.IncludeSecrets)
+		if err != nil {
+			return fmt.Errorf("cluster '%s': %s", cluster, err)
+		}
+		if err := writeRendered(filepath.Join(d, tc.gitOpsPath(), cluster), rendered); err != nil {
+			return err
+		}
+		if len(rendered.secrets) > 0 {
+			secrets, err := encodeObjects(rendered.secrets)
+			if err != nil {
+				return err
+			}
+			path := filepath.Join(tc.path(), "gitops-secrets", fmt.Sprintf("%s.yaml", cluster))
+			if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+				return err
+			}
+			if err := os.WriteFile(path, secrets, 0600); err != nil {
+				return err
+			}
+			logger.WithField("cluster", cluster).Warnf("%d secret(s) were not committed and were written to %s", len(rendered.secrets), path)
+		}
+	}
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return err
+	}
+	if err := worktree.AddWithOptions(&git.AddOptions{All: true}); err != nil {
+		return err
+	}
+	status, err := worktree.Status()
+	if err != nil {
+		return err
+	}
+	// the deleted files are not staged by the add.
+	for path, fileStatus := range status {
+		if fileStatus.Worktree != git.Deleted {
+			continue
+		}
+		if _, err := worktree.Remove(path); err != nil {
+			return err
+		}
+	}
+	if status, err = worktree.Status(); err != nil {
+		return err
+	}
+	if status.IsClean() {
+		logger.Info("the gitops repository is up to date")
+		return nil
+	}
+	author := &object.Signature{Name: config.AuthorName, Email: config.AuthorEmail, When: time.Now()}
+	if author.Name == "" {
+		author.Name = "tsctl"
+	}
+	if author.Email == "" {
+		author.Email = "tsctl@trustacks.io"
+	}
+	message := fmt.Sprintf("Update toolchain %s\n\nChanged files:\n%s", tc.name, strings.TrimSpace(status.String()))
+	if _, err := worktree.Commit(message, &git.CommitOptions{Author: author}); err != nil {
+		return err
+	}
+	logger.WithField("repository", config.URL).Info("pushing the rendered manifests")
+	pushOpts := &git.PushOptions{}
+	if auth != nil {
+		pushOpts.Auth = auth
+	}
+	if err := repo.PushContext(ctx, pushOpts); err != nil {
+		return fmt.Errorf("error pushing the rendered manifests: %s", err)
+	}
+	return nil
+}
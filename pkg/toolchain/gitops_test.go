@@ -0,0 +1,178 @@
+package toolchain
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestToolchainChart creates a toolchain with a chart, a helm
+// component and a manifest component.
+func newTestToolchainChart(t *testing.T, tc *toolchain) {
+	templates := filepath.Join(tc.path(), "chart", "templates")
+	if err := os.MkdirAll(templates, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(tc.path(), "chart", "Chart.yaml"), []byte("apiVersion: v2\nname: toolchain\nversion: 1.0.0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	secret := "apiVersion: v1\nkind: Secret\nmetadata:\n  name: sops-age\nstringData:\n  age.agekey: secret\n"
+	if err := os.WriteFile(filepath.Join(templates, "secret.yaml"), []byte(secret), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := copyDir(filepath.Join("testdata", "helloworld"), filepath.Join(tc.componentsPath(), "helloworld")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(tc.componentsPath(), "helloworld", "override-values.yaml"), []byte(""), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(tc.componentsPath(), "rbac"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(tc.componentsPath(), "rbac", componentMetadataFile), []byte("type: manifest\nversion: 1.0.0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	role := "apiVersion: rbac.authorization.k8s.io/v1\nkind: ClusterRole\nmetadata:\n  name: test\n"
+	if err := os.WriteFile(filepath.Join(tc.componentsPath(), "rbac", manifestsFile), []byte(role), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRenderCluster(t *testing.T) {
+	defer patchToolchainRoot()()
+	tc := &toolchain{name: "test", config: &toolchainConfig{
+		Clusters: map[string]clusterConfig{"shared": {Context: "shared", Components: []string{"rbac"}}},
+	}}
+	newTestToolchainChart(t, tc)
+	rendered, err := tc.renderCluster("", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, rendered.files, "namespace.yaml")
+	assert.Contains(t, rendered.files, "helloworld.yaml")
+	assert.NotContains(t, rendered.files, "rbac.yaml", "expected the component of the shared cluster to be excluded")
+	assert.NotContains(t, rendered.files, "toolchain.yaml", "expected the secret to be excluded")
+	if assert.Len(t, rendered.secrets, 1) {
+		assert.Equal(t, "trustacks-toolchain-test", rendered.secrets[0].GetNamespace(), "expected the toolchain namespace")
+	}
+	for _, obj := range rendered.files["helloworld.yaml"] {
+		assert.Equal(t, "trustacks-toolchain-test", obj.GetNamespace(), "expected the toolchain namespace")
+	}
+
+	rendered, err = tc.renderCluster("shared", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, rendered.files["rbac.yaml"], 1) {
+		assert.Empty(t, rendered.files["rbac.yaml"][0].GetNamespace(), "expected cluster scoped objects to have no namespace")
+	}
+	assert.Len(t, rendered.files["toolchain.yaml"], 1, "expected the secret to be included")
+}
+
+func TestPublish(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	defer patchToolchainRoot()()
+	remote := t.TempDir()
+	seed := t.TempDir()
+	for _, args := range [][]string{
+		{"init", "--bare", "--initial-branch=main", remote},
+		{"clone", remote, seed},
+		{"-C", seed, "commit", "--allow-empty", "-m", "initial commit"},
+		{"-C", seed, "push", "origin", "HEAD:main"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com", "GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %s", args, out)
+		}
+	}
+	tc := &toolchain{name: "test", config: &toolchainConfig{
+		Installer: &installerConfig{Type: installerGitOps, GitOps: &gitOpsConfig{URL: remote, Branch: "main"}},
+	}}
+	newTestToolchainChart(t, tc)
+	if err := tc.publish(context.Background(), git.PlainClone); err != nil {
+		t.Fatal(err)
+	}
+	// publishing the unchanged manifests does not create a commit.
+	if err := tc.publish(context.Background(), git.PlainClone); err != nil {
+		t.Fatal(err)
+	}
+	assert.FileExists(t, filepath.Join(tc.path(), "gitops-secrets", "default.yaml"), "expected the secrets to be written locally")
+
+	checkout := t.TempDir()
+	repo, err := git.PlainClone(checkout, false, &git.CloneOptions{URL: remote})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{"kustomization.yaml", "namespace.yaml", "helloworld.yaml", "rbac.yaml"} {
+		assert.FileExists(t, filepath.Join(checkout, "toolchains", "test", "default", file))
+	}
+	commits, err := repo.Log(&git.LogOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	if err := commits.ForEach(func(*object.Commit) error { count++; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, count, "expected a single manifest commit")
+
+	// the manifests of removed components are deleted.
+	if err := os.RemoveAll(filepath.Join(tc.componentsPath(), "rbac")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.publish(context.Background(), git.PlainClone); err != nil {
+		t.Fatal(err)
+	}
+	checkout = t.TempDir()
+	if _, err := git.PlainClone(checkout, false, &git.CloneOptions{URL: remote}); err != nil {
+		t.Fatal(err)
+	}
+	assert.NoFileExists(t, filepath.Join(checkout, "toolchains", "test", "default", "rbac.yaml"), "expected the removed component manifests to be deleted")
+}
+
+func TestValidateInstaller(t *testing.T) {
+	assert.NoError(t, validateInstaller(&toolchainConfig{}))
+	assert.Error(t, validateInstaller(&toolchainConfig{Installer: &installerConfig{Type: installerGitOps}}), "expected an error without a repository")
+	assert.Error(t, validateInstaller(&toolchainConfig{Installer: &installerConfig{Type: "unknown"}}))
+	assert.NoError(t, validateInstaller(&toolchainConfig{Installer: &installerConfig{Type: installerFlux}}))
+	assert.Error(t, validateInstaller(&toolchainConfig{
+		Installer: &installerConfig{Type: installerArgoCD},
+		Clusters:  map[string]clusterConfig{"edge": {Context: "edge"}},
+	}), "expected an error for cluster targets")
+}
+
+func TestRenderClusterApplications(t *testing.T) {
+	defer patchToolchainRoot()()
+	tc := &toolchain{name: "test", config: &toolchainConfig{
+		Applications: []applicationConfig{{Name: "web", Namespace: &namespaceConfig{Name: "web"}}},
+	}}
+	newTestToolchainChart(t, tc)
+	app := &application{name: "web", toolchain: tc}
+	if err := app.createChart(); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.addVars(map[string]string{"env": "dev"}); err != nil {
+		t.Fatal(err)
+	}
+	rendered, err := tc.renderCluster("", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, rendered.files["namespace.yaml"], 2) {
+		assert.Equal(t, "web", rendered.files["namespace.yaml"][1].GetName(), "expected the application namespace")
+	}
+	if assert.NotEmpty(t, rendered.files["application-web.yaml"]) {
+		for _, obj := range rendered.files["application-web.yaml"] {
+			assert.Equal(t, "web", obj.GetNamespace(), "expected the application namespace")
+		}
+	}
+}
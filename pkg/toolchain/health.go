@@ -0,0 +1,580 @@
+package toolchain
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"helm.sh/helm/v3/pkg/release"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// componentHealthFile is the rendered health checks of a
+	// component.
+	componentHealthFile = "trustacks-health.yaml"
+	// releaseApplied is the release state of an applied kustomize or
+	// manifest component.
+	releaseApplied = "applied"
+	// releaseNotInstalled is the release state of a component that is
+	// not installed.
+	releaseNotInstalled = "not installed"
+)
+
+var (
+	// healthCheckTimeout is the timeout of a single health check.
+	healthCheckTimeout = 2 * time.Minute
+	// healthPollInterval is the interval of the health checks while
+	// waiting for the components.
+	healthPollInterval = 10 * time.Second
+)
+
+// healthCheck is a functional readiness check of a component. Exactly
+// one of HTTP, Job or Condition is set.
+type healthCheck struct {
+	// Name identifies the check in the status report.
+	Name string `json:"name"`
+	// HTTP requests an endpoint of the component.
+	HTTP *httpCheck `json:"http,omitempty"`
+	// Job is a job manifest template. The check passes if the job
+	// succeeds.
+	Job string `json:"job,omitempty"`
+	// Condition checks a status condition of a component resource.
+	Condition *conditionCheck `json:"condition,omitempty"`
+}
+
+// httpCheck requests a url, usually through the component ingress, or
+// a service port through the kubernetes api server proxy.
+type httpCheck struct {
+	// URL is requested from the cli host.
+	URL string `json:"url,omitempty"`
+	// Service is the name of the service requested through the api
+	// server proxy if the url is empty.
+	Service string `json:"service,omitempty"`
+	// Port is the name or number of the service port.
+	Port string `json:"port,omitempty"`
+	// Scheme is the scheme of the service port. It is http if empty.
+	Scheme string `json:"scheme,omitempty"`
+	// Path is the requested path of the service.
+	Path string `json:"path,omitempty"`
+	// Status is the expected response status. Any 2xx status passes if
+	// it is zero.
+	Status int `json:"status,omitempty"`
+	// Contains is a string that the response body must contain.
+	Contains string `json:"contains,omitempty"`
+	// Insecure skips the certificate verification of the url.
+	Insecure bool `json:"insecure,omitempty"`
+}
+
+// conditionCheck checks a status condition of a resource in the
+// toolchain namespace.
+type conditionCheck struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Name       string `json:"name"`
+	// Type is the condition type, such as Ready or Available.
+	Type string `json:"type"`
+	// Status is the expected condition status. It is True if empty.
+	Status string `json:"status,omitempty"`
+}
+
+// validate checks that the check has a single type.
+func (c *healthCheck) validate() error {
+	if c.Name == "" {
+		return fmt.Errorf("the health check name is missing")
+	}
+	types := 0
+	for _, set := range []bool{c.HTTP != nil, c.Job != "", c.Condition != nil} {
+		if set {
+			types++
+		}
+	}
+	if types != 1 {
+		return fmt.Errorf("health check '%s' must have one of http, job or condition", c.Name)
+	}
+	if c.HTTP != nil && c.HTTP.URL == "" && c.HTTP.Service == "" {
+		return fmt.Errorf("health check '%s' must have a url or service", c.Name)
+	}
+	return nil
+}
+
+// renderHealthCheck renders the templated fields of the check.
+func renderHealthCheck(check healthCheck, params map[string]interface{}) (healthCheck, error) {
+	var fields []*string
+	if check.HTTP != nil {
+		h := *check.HTTP
+		check.HTTP = &h
+		fields = append(fields, &h.URL, &h.Service, &h.Path)
+	}
+	if check.Condition != nil {
+		condition := *check.Condition
+		check.Condition = &condition
+		fields = append(fields, &condition.Name)
+	}
+	fields = append(fields, &check.Job)
+	for _, field := range fields {
+		var buf bytes.Buffer
+		t, err := template.New("health").Parse(*field)
+		if err != nil {
+			return check, err
+		}
+		if err := t.Execute(&buf, params); err != nil {
+			return check, err
+		}
+		*field = buf.String()
+	}
+	return check, nil
+}
+
+// addHealthChecks renders the health checks of the components.
+func (tc *toolchain) addHealthChecks(components []string, catalog *componentCatalog, params map[string]interface{}) error {
+	for _, name := range components {
+		c := catalog.Components[name]
+		if len(c.Health) == 0 {
+			continue
+		}
+		params["image"] = mirrorImage(tc.registryMirror(), catalog.HookSource)
+		checks := make([]healthCheck, 0, len(c.Health))
+		for _, check := range c.Health {
+			if err := check.validate(); err != nil {
+				return fmt.Errorf("component '%s': %s", name, err)
+			}
+			rendered, err := renderHealthCheck(check, params)
+			if err != nil {
+				return fmt.Errorf("error rendering the '%s' health check '%s': %s", name, check.Name, err)
+			}
+			if rendered.Job != "" {
+				rendered.Job = string(tc.mirrorHooks([]byte(rendered.Job)))
+			}
+			checks = append(checks, rendered)
+		}
+		data, err := yaml.Marshal(checks)
+		if err != nil {
+			return err
+		}
+		dir := filepath.Join(tc.componentsPath(), name)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(dir, componentHealthFile), data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// componentHealthChecks returns the rendered health checks of the
+// component.
+func (tc *toolchain) componentHealthChecks(component string) ([]healthCheck, error) {
+	data, err := os.ReadFile(filepath.Join(tc.componentsPath(), component, componentHealthFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var checks []healthCheck
+	if err := yaml.Unmarshal(data, &checks); err != nil {
+		return nil, fmt.Errorf("error reading the '%s' health checks: %s", component, err)
+	}
+	return checks, nil
+}
+
+// HealthResult is the result of a component health check.
+type HealthResult struct {
+	// Check is the name of the check.
+	Check string
+	// Healthy is true if the check passed.
+	Healthy bool
+	// Message describes the result.
+	Message string
+}
+
+// ComponentStatus is the release state and functional readiness of a
+// toolchain component.
+type ComponentStatus struct {
+	// Cluster is the display name of the cluster target.
+	Cluster string
+	// Component is the name of the component.
+	Component string
+	// Release is the helm release status of chart components, or
+	// applied for kustomize and manifest components.
+	Release string
+	// Checks are the results of the component health checks.
+	Checks []HealthResult
+}
+
+// Ready returns true if the component release is deployed and its
+// health checks passed.
+func (s ComponentStatus) Ready() bool {
+	if s.Release != string(release.StatusDeployed) && s.Release != releaseApplied {
+		return false
+	}
+	for _, check := range s.Checks {
+		if !check.Healthy {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns the component status and the check results.
+func (s ComponentStatus) String() string {
+	status := "READY"
+	if !s.Ready() {
+		status = "NOT READY"
+	}
+	lines := []string{fmt.Sprintf("[%s] %s %s (release: %s)", s.Cluster, status, s.Component, s.Release)}
+	for _, check := range s.Checks {
+		result := "PASS"
+		if !check.Healthy {
+			result = "FAIL"
+		}
+		lines = append(lines, fmt.Sprintf("  %s %s: %s", result, check.Check, check.Message))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// healthChecks evaluates the health checks of a component.
+type healthChecks struct {
+	ctx       context.Context
+	clientset kubernetes.Interface
+	client    dynamic.Interface
+	mapper    meta.ResettableRESTMapper
+	namespace string
+	component string
+}
+
+// run evaluates the checks.
+func (h *healthChecks) run(checks []healthCheck) []HealthResult {
+	results := make([]HealthResult, 0, len(checks))
+	for _, check := range checks {
+		var err error
+		switch {
+		case check.HTTP != nil:
+			err = h.checkHTTP(check.HTTP)
+		case check.Job != "":
+			err = h.checkJob(check.Name, check.Job)
+		case check.Condition != nil:
+			err = h.checkCondition(check.Condition)
+		default:
+			err = fmt.Errorf("the check has no type")
+		}
+		result := HealthResult{Check: check.Name, Healthy: err == nil, Message: "healthy"}
+		if err != nil {
+			result.Message = err.Error()
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// checkResponse checks the response status and body.
+func checkResponse(check *httpCheck, status int, body []byte) error {
+	if check.Status != 0 && status != check.Status {
+		return fmt.Errorf("the response status is %d instead of %d", status, check.Status)
+	}
+	if check.Status == 0 && (status < 200 || status > 299) {
+		return fmt.Errorf("the response status is %d", status)
+	}
+	if check.Contains != "" && !bytes.Contains(body, []byte(check.Contains)) {
+		return fmt.Errorf("the response does not contain '%s'", check.Contains)
+	}
+	return nil
+}
+
+// checkHTTP requests the url or the service through the api server
+// proxy.
+func (h *healthChecks) checkHTTP(check *httpCheck) error {
+	ctx, cancel := context.WithTimeout(h.ctx, healthCheckTimeout)
+	defer cancel()
+	if check.URL == "" {
+		scheme := check.Scheme
+		if scheme == "" {
+			scheme = "http"
+		}
+		body, err := h.clientset.CoreV1().Services(h.namespace).ProxyGet(scheme, check.Service, check.Port, check.Path, nil).DoRaw(ctx)
+		status := http.StatusOK
+		if err != nil {
+			statusErr, ok := err.(*errors.StatusError)
+			if !ok {
+				return fmt.Errorf("service '%s': %s", check.Service, err)
+			}
+			status = int(statusErr.Status().Code)
+		}
+		return checkResponse(check, status, body)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, check.URL, nil)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{}
+	if check.Insecure {
+		client.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	return checkResponse(check, resp.StatusCode, body)
+}
+
+// invalidNameChars are the characters replaced in the health job names.
+var invalidNameChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// healthJobName returns the job name of a health check.
+func healthJobName(component, check string) string {
+	name := invalidNameChars.ReplaceAllString(strings.ToLower(fmt.Sprintf("trustacks-health-%s-%s", component, check)), "-")
+	if len(name) > 63 {
+		name = name[:63]
+	}
+	return strings.TrimRight(name, "-")
+}
+
+// checkJob runs the job and waits for it to succeed.
+func (h *healthChecks) checkJob(name, manifest string) error {
+	job, err := componentJob(manifest, healthJobName(h.component, name), h.component)
+	if err != nil {
+		return err
+	}
+	jobs := h.clientset.BatchV1().Jobs(h.namespace)
+	propagation := metav1.DeletePropagationBackground
+	remove := func() {
+		if err := jobs.Delete(context.Background(), job.Name, metav1.DeleteOptions{PropagationPolicy: &propagation}); err != nil && !errors.IsNotFound(err) {
+			logger.WithField("job", job.Name).Warnf("error deleting the health check job: %s", err)
+		}
+	}
+	// the job of an interrupted check is replaced.
+	remove()
+	if _, err := jobs.Create(h.ctx, job, metav1.CreateOptions{}); err != nil {
+		return err
+	}
+	defer remove()
+	ctx, cancel := context.WithTimeout(h.ctx, healthCheckTimeout)
+	defer cancel()
+	return waitForJob(ctx, h.clientset, h.namespace, job.Name)
+}
+
+// checkCondition checks the status condition of the resource.
+func (h *healthChecks) checkCondition(check *conditionCheck) error {
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion(check.APIVersion)
+	obj.SetKind(check.Kind)
+	obj.SetName(check.Name)
+	ri, err := resourceInterface(h.ctx, h.client, h.mapper, obj, h.namespace)
+	if err != nil {
+		return err
+	}
+	live, err := ri.Get(h.ctx, check.Name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	expected := check.Status
+	if expected == "" {
+		expected = string(metav1.ConditionTrue)
+	}
+	conditions, _, err := unstructured.NestedSlice(live.Object, "status", "conditions")
+	if err != nil {
+		return err
+	}
+	for _, c := range conditions {
+		condition, ok := c.(map[string]interface{})
+		if !ok || condition["type"] != check.Type {
+			continue
+		}
+		if condition["status"] == expected {
+			return nil
+		}
+		message := fmt.Sprintf("%s %s condition %s is %v", check.Kind, check.Name, check.Type, condition["status"])
+		if reason, ok := condition["message"].(string); ok && reason != "" {
+			message += ": " + reason
+		}
+		return fmt.Errorf("%s", message)
+	}
+	return fmt.Errorf("%s %s has no %s condition", check.Kind, check.Name, check.Type)
+}
+
+// statusClients are the clients of a cluster target.
+type statusClients struct {
+	clientset kubernetes.Interface
+	client    dynamic.Interface
+	mapper    meta.ResettableRESTMapper
+}
+
+// argoApplicationState returns the release state of a component
+// installed by argo cd, which is deployed once the application is
+// synced and healthy.
+func (tc *toolchain) argoApplicationState(ctx context.Context, name string, client dynamic.Interface) (string, error) {
+	app, err := client.Resource(argoApplicationResource).Namespace(tc.argoNamespace()).Get(ctx, fmt.Sprintf("%s-%s", tc.name, name), metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return releaseNotInstalled, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	sync, _, _ := unstructured.NestedString(app.Object, "status", "sync", "status")
+	health, _, _ := unstructured.NestedString(app.Object, "status", "health", "status")
+	if sync == "Synced" && health == "Healthy" {
+		return string(release.StatusDeployed), nil
+	}
+	return fmt.Sprintf("argo cd application %s/%s", strings.ToLower(sync), strings.ToLower(health)), nil
+}
+
+// releaseState returns the release state of the component.
+func (tc *toolchain) releaseState(ctx context.Context, name string, clients *statusClients) (string, error) {
+	namespace := tc.namespace()
+	if _, err := readComponentMetadata(filepath.Join(tc.componentsPath(), name)); err == nil {
+		refs, err := readInventory(ctx, clients.clientset, namespace, name)
+		if err != nil {
+			return "", err
+		}
+		if refs == nil {
+			return releaseNotInstalled, nil
+		}
+		return releaseApplied, nil
+	}
+	if tc.installer() == installerArgoCD {
+		return tc.argoApplicationState(ctx, name, clients.client)
+	}
+	helmClient, err := newHelmClient(namespace, tc.cluster(name))
+	if err != nil {
+		return "", err
+	}
+	rel, err := helmClient.GetRelease(name)
+	if err != nil {
+		logger.WithField("component", name).Debugf("error getting the release: %s", err)
+		return releaseNotInstalled, nil
+	}
+	return string(rel.Info.Status), nil
+}
+
+// status returns the release state and health check results of the
+// toolchain components.
+func (tc *toolchain) status(ctx context.Context) ([]ComponentStatus, error) {
+	components, err := os.ReadDir(tc.componentsPath())
+	if err != nil {
+		return nil, err
+	}
+	clients := map[string]*statusClients{}
+	statuses := make([]ComponentStatus, 0, len(components))
+	for _, component := range components {
+		name := component.Name()
+		if err := ctx.Err(); err != nil {
+			return statuses, err
+		}
+		cluster := tc.cluster(name)
+		c, ok := clients[tc.clusterName(name)]
+		if !ok {
+			clientset, err := newClientset(cluster)
+			if err != nil {
+				return nil, err
+			}
+			client, mapper, err := newDynamicClient(cluster)
+			if err != nil {
+				return nil, err
+			}
+			c = &statusClients{clientset: clientset, client: client, mapper: mapper}
+			clients[tc.clusterName(name)] = c
+		}
+		state, err := tc.releaseState(ctx, name, c)
+		if err != nil {
+			return nil, fmt.Errorf("error reading the '%s' release state: %s", name, err)
+		}
+		status := ComponentStatus{Cluster: clusterLabel(cluster), Component: name, Release: state}
+		checks, err := tc.componentHealthChecks(name)
+		if err != nil {
+			return nil, err
+		}
+		// the checks of a component that is not installed would fail.
+		if state == string(release.StatusDeployed) || state == releaseApplied {
+			h := &healthChecks{ctx: ctx, clientset: c.clientset, client: c.client, mapper: c.mapper, namespace: tc.namespace(), component: name}
+			status.Checks = h.run(checks)
+		}
+		statuses = append(statuses, status)
+	}
+	sort.SliceStable(statuses, func(i, j int) bool {
+		return statuses[i].Cluster < statuses[j].Cluster
+	})
+	return statuses, nil
+}
+
+// describeNotReady returns the components that are not ready and
+// their failed checks.
+func describeNotReady(statuses []ComponentStatus) string {
+	var summary []string
+	for _, s := range statuses {
+		if s.Ready() {
+			continue
+		}
+		reasons := []string{"release " + s.Release}
+		for _, check := range s.Checks {
+			if !check.Healthy {
+				reasons = append(reasons, fmt.Sprintf("%s: %s", check.Check, check.Message))
+			}
+		}
+		summary = append(summary, fmt.Sprintf("'%s' (%s)", s.Component, strings.Join(reasons, "; ")))
+	}
+	return strings.Join(summary, ", ")
+}
+
+// waitReady waits for the components to be ready until the timeout.
+func (tc *toolchain) waitReady(ctx context.Context, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	logger.WithField("timeout", timeout.String()).Info("waiting for the components to be ready")
+	var statuses []ComponentStatus
+	for {
+		current, err := tc.status(ctx)
+		if err == nil {
+			statuses = current
+			notReady := describeNotReady(statuses)
+			if notReady == "" {
+				logger.Info("the components are ready")
+				return nil
+			}
+			logger.WithFields(logrus.Fields{"components": notReady}).Debug("components are not ready")
+		} else if ctx.Err() == nil {
+			logger.Debugf("error reading the component status: %s", err)
+		}
+		select {
+		case <-ctx.Done():
+			if statuses == nil {
+				return fmt.Errorf("the component status could not be read before the timeout")
+			}
+			return fmt.Errorf("components not ready after %s: %s", timeout, describeNotReady(statuses))
+		case <-time.After(healthPollInterval):
+		}
+	}
+}
+
+// Status returns the release state and functional readiness of the
+// toolchain components.
+func Status(ctx context.Context, name string) ([]ComponentStatus, error) {
+	tc, err := newToolchainFromConfig(name)
+	if err != nil {
+		return nil, fmt.Errorf("error loading the toolchain '%s': %s", name, err)
+	}
+	return tc.status(ctx)
+}
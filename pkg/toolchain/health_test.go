@@ -0,0 +1,203 @@
+package toolchain
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	batchv1 "k8s.io/api/batch/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const testHealthJob = `apiVersion: batch/v1
+kind: Job
+metadata:
+  name: oidc
+spec:
+  template:
+    spec:
+      containers:
+      - name: check
+        image: {{ .image }}
+        command: ["curl", "-f", "http://authentik/application/o/{{ .application }}/.well-known/openid-configuration"]
+`
+
+// proxyResponse is the response of a fake service proxy request.
+type proxyResponse struct {
+	body []byte
+	err  error
+}
+
+func (r proxyResponse) DoRaw(context.Context) ([]byte, error) {
+	return r.body, r.err
+}
+
+func (r proxyResponse) Stream(context.Context) (io.ReadCloser, error) {
+	return nil, r.err
+}
+
+var _ rest.ResponseWrapper = proxyResponse{}
+
+func TestAddHealthChecks(t *testing.T) {
+	defer patchToolchainRoot()()
+	catalog := &componentCatalog{
+		HookSource: "quay.io/trustacks/hooks:1.0.0",
+		Components: map[string]component{
+			"authentik": {Health: []healthCheck{
+				{Name: "oidc", HTTP: &httpCheck{URL: "https://sso.{{ .domain }}/application/o/{{ .application }}/.well-known/openid-configuration"}},
+				{Name: "job", Job: testHealthJob},
+				{Name: "server", Condition: &conditionCheck{APIVersion: "apps/v1", Kind: "Deployment", Name: "authentik-server", Type: "Available"}},
+			}},
+			"none": {},
+		},
+	}
+	tc := &toolchain{name: "test", config: &toolchainConfig{RegistryMirror: "registry.local"}}
+	params := map[string]interface{}{"domain": "example.com", "application": "trustacks"}
+	if err := tc.addHealthChecks([]string{"authentik", "none"}, catalog, params); err != nil {
+		t.Fatal(err)
+	}
+	checks, err := tc.componentHealthChecks("authentik")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, checks, 3) {
+		assert.Equal(t, "https://sso.example.com/application/o/trustacks/.well-known/openid-configuration", checks[0].HTTP.URL)
+		assert.Contains(t, checks[1].Job, "image: registry.local/quay.io/trustacks/hooks:1.0.0")
+		assert.Equal(t, "authentik-server", checks[2].Condition.Name)
+	}
+	// the catalog checks are not modified by the rendering.
+	assert.Contains(t, catalog.Components["authentik"].Health[0].HTTP.URL, "{{ .domain }}")
+	checks, err = tc.componentHealthChecks("none")
+	assert.NoError(t, err)
+	assert.Nil(t, checks)
+
+	catalog.Components["invalid"] = component{Health: []healthCheck{{Name: "both", Job: testHealthJob, HTTP: &httpCheck{URL: "https://example.com"}}}}
+	assert.Error(t, tc.addHealthChecks([]string{"invalid"}, catalog, params))
+}
+
+func TestHealthChecks(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/.well-known/openid-configuration" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if _, err := w.Write([]byte(`{"issuer": "https://sso.example.com"}`)); err != nil {
+			t.Fatal(err)
+		}
+	}))
+	defer ts.Close()
+
+	clientset := fake.NewSimpleClientset()
+	clientset.PrependProxyReactor("services", func(action k8stesting.Action) (bool, rest.ResponseWrapper, error) {
+		if action.(k8stesting.ProxyGetAction).GetName() == "authentik" {
+			return true, proxyResponse{body: []byte("ok")}, nil
+		}
+		return true, proxyResponse{err: errors.NewServiceUnavailable("no endpoints available")}, nil
+	})
+	clientset.PrependReactor("get", "jobs", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		name := action.(k8stesting.GetAction).GetName()
+		return true, &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "trustacks"}, Status: batchv1.JobStatus{Succeeded: 1}}, nil
+	})
+	deployment := &unstructured.Unstructured{Object: map[string]interface{}{
+		"status": map[string]interface{}{
+			"conditions": []interface{}{
+				map[string]interface{}{"type": "Available", "status": "True"},
+				map[string]interface{}{"type": "Progressing", "status": "False", "message": "deadline exceeded"},
+			},
+		},
+	}}
+	deployment.SetAPIVersion("apps/v1")
+	deployment.SetKind("Deployment")
+	deployment.SetNamespace("trustacks")
+	deployment.SetName("authentik-server")
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}, meta.RESTScopeNamespace)
+	h := &healthChecks{
+		ctx:       context.TODO(),
+		clientset: clientset,
+		client:    dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), deployment),
+		mapper:    staticMapper{mapper},
+		namespace: "trustacks",
+		component: "authentik",
+	}
+	results := h.run([]healthCheck{
+		{Name: "oidc", HTTP: &httpCheck{URL: ts.URL + "/.well-known/openid-configuration", Contains: "issuer"}},
+		{Name: "missing", HTTP: &httpCheck{URL: ts.URL + "/missing"}},
+		{Name: "proxy", HTTP: &httpCheck{Service: "authentik", Port: "http", Path: "/-/health/ready/"}},
+		{Name: "unavailable", HTTP: &httpCheck{Service: "redis", Port: "6379"}},
+		{Name: "job", Job: strings.ReplaceAll(testHealthJob, "{{ .image }}", "curlimages/curl")},
+		{Name: "available", Condition: &conditionCheck{APIVersion: "apps/v1", Kind: "Deployment", Name: "authentik-server", Type: "Available"}},
+		{Name: "progressing", Condition: &conditionCheck{APIVersion: "apps/v1", Kind: "Deployment", Name: "authentik-server", Type: "Progressing"}},
+		{Name: "replica failure", Condition: &conditionCheck{APIVersion: "apps/v1", Kind: "Deployment", Name: "authentik-server", Type: "ReplicaFailure"}},
+	})
+	assert.Equal(t, []HealthResult{
+		{Check: "oidc", Healthy: true, Message: "healthy"},
+		{Check: "missing", Message: "the response status is 404"},
+		{Check: "proxy", Healthy: true, Message: "healthy"},
+		{Check: "unavailable", Message: "the response status is 503"},
+		{Check: "job", Healthy: true, Message: "healthy"},
+		{Check: "available", Healthy: true, Message: "healthy"},
+		{Check: "progressing", Message: "Deployment authentik-server condition Progressing is False: deadline exceeded"},
+		{Check: "replica failure", Message: "Deployment authentik-server has no ReplicaFailure condition"},
+	}, results)
+	// the job is deleted after the check.
+	actions := clientset.Actions()
+	last := actions[len(actions)-1]
+	assert.True(t, last.Matches("delete", "jobs"), "expected the job to be deleted")
+	assert.Equal(t, "trustacks-health-authentik-job", last.(k8stesting.DeleteAction).GetName())
+}
+
+func TestHealthJobName(t *testing.T) {
+	assert.Equal(t, "trustacks-health-authentik-oidc-discovery", healthJobName("authentik", "OIDC discovery"))
+	assert.Len(t, healthJobName("authentik", "a very long health check name that exceeds the kubernetes limit"), 63)
+}
+
+func TestComponentStatus(t *testing.T) {
+	statuses := []ComponentStatus{
+		{Cluster: "default", Component: "argo-cd", Release: "deployed"},
+		{Cluster: "default", Component: "manifests", Release: releaseApplied, Checks: []HealthResult{{Check: "crd", Healthy: true}}},
+		{Cluster: "default", Component: "authentik", Release: "deployed", Checks: []HealthResult{{Check: "oidc", Message: "the response status is 502"}}},
+		{Cluster: "edge", Component: "sonarqube", Release: "pending-install"},
+	}
+	assert.True(t, statuses[0].Ready())
+	assert.True(t, statuses[1].Ready())
+	assert.False(t, statuses[2].Ready())
+	assert.False(t, statuses[3].Ready())
+	assert.Equal(t, "[default] NOT READY authentik (release: deployed)\n  FAIL oidc: the response status is 502", statuses[2].String())
+	assert.Equal(t, "'authentik' (release deployed; oidc: the response status is 502), 'sonarqube' (release pending-install)", describeNotReady(statuses))
+	assert.Empty(t, describeNotReady(statuses[:2]))
+}
+
+func TestArgoApplicationState(t *testing.T) {
+	app := &unstructured.Unstructured{Object: map[string]interface{}{
+		"status": map[string]interface{}{
+			"sync":   map[string]interface{}{"status": "Synced"},
+			"health": map[string]interface{}{"status": "Progressing"},
+		},
+	}}
+	app.SetAPIVersion("argoproj.io/v1alpha1")
+	app.SetKind("Application")
+	app.SetNamespace("argocd")
+	app.SetName("test-authentik")
+	client := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), app)
+	tc := &toolchain{name: "test", config: &toolchainConfig{Installer: &installerConfig{Type: installerArgoCD}}}
+	state, err := tc.argoApplicationState(context.TODO(), "authentik", client)
+	assert.NoError(t, err)
+	assert.Equal(t, "argo cd application synced/progressing", state)
+	state, err = tc.argoApplicationState(context.TODO(), "sonarqube", client)
+	assert.NoError(t, err)
+	assert.Equal(t, releaseNotInstalled, state)
+}
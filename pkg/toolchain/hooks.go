@@ -0,0 +1,154 @@
+package toolchain
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"helm.sh/helm/v3/pkg/release"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// hookLogTailLines is the number of log lines collected from each
+// failed hook pod.
+var hookLogTailLines int64 = 100
+
+// hookError wraps a release error with the logs of the failed hook
+// jobs.
+type hookError struct {
+	err  error
+	logs map[string]string
+}
+
+// Error returns the release error followed by the hook job logs.
+func (e *hookError) Error() string {
+	var b strings.Builder
+	b.WriteString(e.err.Error())
+	jobs := make([]string, 0, len(e.logs))
+	for job := range e.logs {
+		jobs = append(jobs, job)
+	}
+	sort.Strings(jobs)
+	for _, job := range jobs {
+		fmt.Fprintf(&b, "\n--- hook job '%s' logs ---\n%s", job, strings.TrimSpace(e.logs[job]))
+	}
+	return b.String()
+}
+
+// Unwrap returns the release error.
+func (e *hookError) Unwrap() error {
+	return e.err
+}
+
+// jobFailed returns true if the job has a failed condition or failed
+// pods.
+func jobFailed(job batchv1.Job) bool {
+	for _, condition := range job.Status.Conditions {
+		if condition.Type == batchv1.JobFailed && condition.Status == corev1.ConditionTrue {
+			return true
+		}
+	}
+	return job.Status.Failed > 0
+}
+
+// releaseHookJobs returns the names of the hook jobs of the release.
+func releaseHookJobs(rel *release.Release) map[string]bool {
+	jobs := make(map[string]bool)
+	for _, hook := range rel.Hooks {
+		if hook.Kind == "Job" {
+			jobs[hook.Name] = true
+		}
+	}
+	return jobs
+}
+
+// failedHookJobLogs collects the pod logs of the failed hook jobs of
+// the release that were created in the namespace since the release
+// operation started. The failed hooks of the other releases, which may
+// be installed concurrently in the namespace, and of the earlier
+// operations are left out.
+func failedHookJobLogs(ctx context.Context, clientset kubernetes.Interface, namespace string, hooks map[string]bool, since time.Time) (map[string]string, error) {
+	// the creation timestamps have a precision of a second.
+	since = since.Truncate(time.Second)
+	jobs, err := clientset.BatchV1().Jobs(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	logs := make(map[string]string)
+	for _, job := range jobs.Items {
+		if !hooks[job.Name] || !jobFailed(job) {
+			continue
+		}
+		if job.CreationTimestamp.Time.Before(since) {
+			continue
+		}
+		l, err := jobLogs(ctx, clientset, namespace, job.Name)
+		if err != nil {
+			return nil, err
+		}
+		logs[job.Name] = l
+	}
+	return logs, nil
+}
+
+// jobLogs collects the tail of the pod logs of the job.
+func jobLogs(ctx context.Context, clientset kubernetes.Interface, namespace, job string) (string, error) {
+	pods, err := clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("job-name=%s", job),
+	})
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for _, pod := range pods.Items {
+		data, err := clientset.CoreV1().Pods(namespace).GetLogs(pod.Name, &corev1.PodLogOptions{
+			TailLines: &hookLogTailLines,
+		}).DoRaw(ctx)
+		if err != nil {
+			fmt.Fprintf(&b, "[%s] error fetching logs: %s\n", pod.Name, err)
+			continue
+		}
+		fmt.Fprintf(&b, "[%s]\n%s\n", pod.Name, data)
+	}
+	return b.String(), nil
+}
+
+// withHookLogs wraps the release error with the logs of the hook jobs
+// of the release that failed in the namespace of the cluster since the
+// release operation started.
+//
+// The original error is returned if the logs cannot be collected.
+func withHookLogs(err error, releaseName string, started time.Time, namespace string, cluster *clusterConfig) error {
+	if err == nil {
+		return nil
+	}
+	helmClient, clientErr := newHelmClient(namespace, cluster)
+	if clientErr != nil {
+		logger.Debugf("error creating helm client for the hook logs: %s", clientErr)
+		return err
+	}
+	rel, relErr := helmClient.GetRelease(releaseName)
+	if relErr != nil {
+		logger.Debugf("error getting the '%s' release hooks: %s", releaseName, relErr)
+		return err
+	}
+	clientset, clientErr := newClientset(cluster)
+	if clientErr != nil {
+		logger.Debugf("error creating clientset for the hook logs: %s", clientErr)
+		return err
+	}
+	logs, logsErr := failedHookJobLogs(context.Background(), clientset, namespace, releaseHookJobs(rel), started)
+	if logsErr != nil {
+		logger.Debugf("error collecting hook logs: %s", logsErr)
+		return err
+	}
+	if len(logs) == 0 {
+		return err
+	}
+	return &hookError{err: err, logs: logs}
+}
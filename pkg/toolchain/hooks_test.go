@@ -0,0 +1,102 @@
+package toolchain
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"helm.sh/helm/v3/pkg/release"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestFailedHookJobLogs(t *testing.T) {
+	started := time.Now()
+	clientset := fake.NewSimpleClientset(
+		&batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              "test-pre-install",
+				Namespace:         "test",
+				Annotations:       map[string]string{"helm.sh/hook": "pre-install"},
+				CreationTimestamp: metav1.NewTime(started),
+			},
+			Status: batchv1.JobStatus{Failed: 1},
+		},
+		&batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              "test-post-install",
+				Namespace:         "test",
+				Annotations:       map[string]string{"helm.sh/hook": "post-install"},
+				CreationTimestamp: metav1.NewTime(started),
+			},
+			Status: batchv1.JobStatus{Succeeded: 1},
+		},
+		&batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              "test-job",
+				Namespace:         "test",
+				CreationTimestamp: metav1.NewTime(started),
+			},
+			Status: batchv1.JobStatus{Failed: 1},
+		},
+		&batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              "test-post-upgrade",
+				Namespace:         "test",
+				Annotations:       map[string]string{"helm.sh/hook": "post-upgrade"},
+				CreationTimestamp: metav1.NewTime(started.Add(-time.Hour)),
+			},
+			Status: batchv1.JobStatus{Failed: 1},
+		},
+		// the failed hook of a release installed concurrently in the
+		// namespace.
+		&batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              "other-pre-install",
+				Namespace:         "test",
+				Annotations:       map[string]string{"helm.sh/hook": "pre-install"},
+				CreationTimestamp: metav1.NewTime(started),
+			},
+			Status: batchv1.JobStatus{Failed: 1},
+		},
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "test-pre-install-abcde",
+				Namespace: "test",
+				Labels:    map[string]string{"job-name": "test-pre-install"},
+			},
+		},
+	)
+	rel := &release.Release{Name: "test", Hooks: []*release.Hook{
+		{Name: "test-pre-install", Kind: "Job"},
+		{Name: "test-post-install", Kind: "Job"},
+		{Name: "test-post-upgrade", Kind: "Job"},
+		{Name: "test-config", Kind: "ConfigMap"},
+	}}
+	hooks := releaseHookJobs(rel)
+	assert.Len(t, hooks, 3, "expected only the hook jobs of the release")
+	logs, err := failedHookJobLogs(context.Background(), clientset, "test", hooks, started)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, logs, 1, "expected only the hook job logs of the failed operation")
+	assert.Contains(t, logs["test-pre-install"], "[test-pre-install-abcde]", "expected the pod name")
+	assert.Contains(t, logs["test-pre-install"], "fake logs", "expected the pod logs")
+}
+
+func TestHookError(t *testing.T) {
+	releaseErr := errors.New("job failed: BackoffLimitExceeded")
+	err := &hookError{
+		err:  releaseErr,
+		logs: map[string]string{"test-pre-install": "[test-pre-install-abcde]\nerror: connection refused\n"},
+	}
+	assert.ErrorIs(t, err, releaseErr, "expected the release error to be wrapped")
+	assert.Equal(t, `job failed: BackoffLimitExceeded
+--- hook job 'test-pre-install' logs ---
+[test-pre-install-abcde]
+error: connection refused`, err.Error(), "got an unexpected error message")
+}
@@ -0,0 +1,81 @@
+package toolchain
+
+import (
+	"os"
+	"path/filepath"
+
+	helmclient "github.com/mittwald/go-helm-client"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// kubeconfigPath returns the path of the default kubeconfig file.
+func kubeconfigPath() string {
+	return filepath.Join(os.Getenv("HOME"), ".kube", "config")
+}
+
+// restConfig creates the rest config of the cluster.
+//
+// The current context of the default kubeconfig is used if the cluster
+// is nil.
+func restConfig(cluster *clusterConfig) (*rest.Config, error) {
+	rules := &clientcmd.ClientConfigLoadingRules{ExplicitPath: kubeconfigPath()}
+	overrides := &clientcmd.ConfigOverrides{}
+	if cluster != nil {
+		if cluster.Kubeconfig != "" {
+			rules.ExplicitPath = cluster.Kubeconfig
+		}
+		overrides.CurrentContext = cluster.Context
+	}
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
+}
+
+// newHelmClient creates a helm client for the namespace in the
+// cluster.
+func newHelmClient(namespace string, cluster *clusterConfig) (helmclient.Client, error) {
+	config, err := restConfig(cluster)
+	if err != nil {
+		return nil, err
+	}
+	return helmclient.NewClientFromRestConf(&helmclient.RestConfClientOptions{
+		Options: &helmclient.Options{
+			Namespace: namespace,
+			DebugLog:  helmDebugLog,
+		},
+		RestConfig: config,
+	})
+}
+
+// newClientset creates a kubernetes clientset for the cluster.
+func newClientset(cluster *clusterConfig) (kubernetes.Interface, error) {
+	config, err := restConfig(cluster)
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(config)
+}
+
+// newDynamicClient creates a dynamic client and the discovery rest
+// mapper of the cluster.
+func newDynamicClient(cluster *clusterConfig) (dynamic.Interface, meta.ResettableRESTMapper, error) {
+	config, err := restConfig(cluster)
+	if err != nil {
+		return nil, nil, err
+	}
+	client, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	mapper := restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(discoveryClient))
+	return client, mapper, nil
+}
@@ -0,0 +1,19 @@
+package toolchain
+
+import (
+	"github.com/sirupsen/logrus"
+)
+
+// logger is the toolchain package logger.
+var logger = logrus.New()
+
+// SetLogger replaces the toolchain package logger.
+func SetLogger(l *logrus.Logger) {
+	logger = l
+}
+
+// helmDebugLog routes the helm action debug output through the
+// package logger.
+func helmDebugLog(format string, v ...interface{}) {
+	logger.WithField("source", "helm").Debugf(format, v...)
+}
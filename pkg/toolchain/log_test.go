@@ -0,0 +1,28 @@
+package toolchain
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHelmDebugLog(t *testing.T) {
+	previousLogger := logger
+	defer SetLogger(previousLogger)
+
+	var buf bytes.Buffer
+	l := logrus.New()
+	l.SetOutput(&buf)
+	l.SetFormatter(&logrus.JSONFormatter{})
+	SetLogger(l)
+
+	helmDebugLog("creating %d resource(s)", 3)
+	assert.Empty(t, buf.String(), "expected debug output to be suppressed at the info level")
+
+	l.SetLevel(logrus.DebugLevel)
+	helmDebugLog("creating %d resource(s)", 3)
+	assert.Contains(t, buf.String(), `"msg":"creating 3 resource(s)"`, "expected the helm debug message")
+	assert.Contains(t, buf.String(), `"source":"helm"`, "expected the helm source field")
+}
@@ -0,0 +1,492 @@
+package toolchain
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+	"helm.sh/helm/v3/pkg/releaseutil"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/kustomize/api/krusty"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+)
+
+// component types.
+const (
+	componentTypeHelm      = "helm"
+	componentTypeKustomize = "kustomize"
+	componentTypeManifest  = "manifest"
+)
+
+const (
+	// manifestsFile contains the rendered manifests of a kustomize or
+	// manifest component.
+	manifestsFile = "manifests.yaml"
+	// componentMetadataFile contains the metadata of a kustomize or
+	// manifest component.
+	componentMetadataFile = "component.yaml"
+	// fieldManager is the server-side apply field manager.
+	fieldManager = "tsctl"
+	// toolchainLabel is the label of the owning toolchain.
+	toolchainLabel = "trustacks.io/toolchain"
+	// componentLabel is the label of the owning component.
+	componentLabel = "trustacks.io/component"
+)
+
+// helm returns true if the component is a helm chart.
+func (c component) helm() bool {
+	return c.Type == "" || c.Type == componentTypeHelm
+}
+
+// source returns the component source with the component version.
+func (c component) source() (string, error) {
+	t, err := template.New("source").Parse(c.Source)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, map[string]string{"Version": c.Version}); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// componentMetadata contains the metadata of a kustomize or manifest
+// component.
+type componentMetadata struct {
+	Type    string `yaml:"type"`
+	Version string `yaml:"version"`
+	Source  string `yaml:"source"`
+}
+
+// readComponentMetadata reads the metadata of the component in the
+// directory. An error is returned for helm components.
+func readComponentMetadata(dir string) (*componentMetadata, error) {
+	data, err := os.ReadFile(filepath.Join(dir, componentMetadataFile))
+	if err != nil {
+		return nil, err
+	}
+	var metadata *componentMetadata
+	if err := yaml.Unmarshal(data, &metadata); err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// readManifestSource reads the manifests from an http url or a local
+// file.
+func readManifestSource(ctx context.Context, source string) ([]byte, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		return os.ReadFile(source)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status '%s'", resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// buildKustomization builds the kustomization of a local directory or
+// a remote kustomize target.
+func buildKustomization(source string) ([]byte, error) {
+	resources, err := krusty.MakeKustomizer(krusty.MakeDefaultOptions()).Run(filesys.MakeFsOnDisk(), source)
+	if err != nil {
+		return nil, err
+	}
+	return resources.AsYaml()
+}
+
+// fetchManifests renders the kustomize or manifest component into the
+// components directory.
+//
+// The manifests are rendered when the component is fetched so that
+// the installs, and the bundles, do not depend on the source.
+func (tc *toolchain) fetchManifests(ctx context.Context, name string, c component) error {
+	source, err := c.source()
+	if err != nil {
+		return fmt.Errorf("error rendering the '%s' source: %s", name, err)
+	}
+	var manifests []byte
+	switch c.Type {
+	case componentTypeManifest:
+		manifests, err = readManifestSource(ctx, source)
+	case componentTypeKustomize:
+		manifests, err = buildKustomization(source)
+	default:
+		return fmt.Errorf("unsupported component type '%s'", c.Type)
+	}
+	if err != nil {
+		return fmt.Errorf("error fetching '%s': %s", source, err)
+	}
+	dir := filepath.Join(tc.componentsPath(), name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, manifestsFile), manifests, 0644); err != nil {
+		return err
+	}
+	metadata, err := yaml.Marshal(&componentMetadata{Type: c.Type, Version: c.Version, Source: source})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, componentMetadataFile), metadata, 0644)
+}
+
+// objectRef identifies an applied object.
+type objectRef struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Namespace  string `json:"namespace,omitempty"`
+	Name       string `json:"name"`
+}
+
+// String returns the kind and name of the object.
+func (r objectRef) String() string {
+	if r.Namespace == "" {
+		return fmt.Sprintf("%s/%s", r.Kind, r.Name)
+	}
+	return fmt.Sprintf("%s/%s/%s", r.Kind, r.Namespace, r.Name)
+}
+
+// refOf returns the reference of the object.
+func refOf(obj *unstructured.Unstructured) objectRef {
+	return objectRef{
+		APIVersion: obj.GetAPIVersion(),
+		Kind:       obj.GetKind(),
+		Namespace:  obj.GetNamespace(),
+		Name:       obj.GetName(),
+	}
+}
+
+// decodeObjects decodes the objects of a multi document manifest.
+func decodeObjects(manifests []byte) ([]*unstructured.Unstructured, error) {
+	var objects []*unstructured.Unstructured
+	decoder := utilyaml.NewYAMLOrJSONDecoder(bytes.NewReader(manifests), 4096)
+	for {
+		obj := &unstructured.Unstructured{}
+		if err := decoder.Decode(&obj.Object); err != nil {
+			if err == io.EOF {
+				return objects, nil
+			}
+			return nil, err
+		}
+		if len(obj.Object) == 0 {
+			continue
+		}
+		objects = append(objects, obj)
+	}
+}
+
+// sortObjects sorts the objects in the kind order.
+func sortObjects(objects []*unstructured.Unstructured, order releaseutil.KindSortOrder) {
+	rank := make(map[string]int, len(order))
+	for i, kind := range order {
+		rank[kind] = i
+	}
+	kindRank := func(kind string) int {
+		if r, ok := rank[kind]; ok {
+			return r
+		}
+		return len(order)
+	}
+	sort.SliceStable(objects, func(i, j int) bool {
+		return kindRank(objects[i].GetKind()) < kindRank(objects[j].GetKind())
+	})
+}
+
+// checkOwner returns an error if the existing object is not owned by
+// the toolchain component.
+func checkOwner(existing *unstructured.Unstructured, toolchain, component string) error {
+	labels := existing.GetLabels()
+	if labels[toolchainLabel] == toolchain && labels[componentLabel] == component {
+		return nil
+	}
+	ref := refOf(existing)
+	if owner, ok := labels[componentLabel]; ok {
+		return fmt.Errorf("%s is owned by component '%s' of toolchain '%s'", ref, owner, labels[toolchainLabel])
+	}
+	return fmt.Errorf("%s already exists and is not managed by the toolchain", ref)
+}
+
+// resourceInterface returns the dynamic resource interface of the
+// object. The default namespace is set on namespaced objects without a
+// namespace.
+func resourceInterface(ctx context.Context, client dynamic.Interface, mapper meta.ResettableRESTMapper, obj *unstructured.Unstructured, namespace string) (dynamic.ResourceInterface, error) {
+	gvk := obj.GroupVersionKind()
+	var (
+		mapping *meta.RESTMapping
+		err     error
+	)
+	// the mapping of a custom resource is available once its
+	// definition is established.
+	for i := 0; i < 10; i++ {
+		mapping, err = mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+		if !meta.IsNoMatchError(err) {
+			break
+		}
+		mapper.Reset()
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if mapping.Scope.Name() != meta.RESTScopeNameNamespace {
+		return client.Resource(mapping.Resource), nil
+	}
+	if obj.GetNamespace() == "" {
+		obj.SetNamespace(namespace)
+	}
+	return client.Resource(mapping.Resource).Namespace(obj.GetNamespace()), nil
+}
+
+// applyObjects server-side applies the objects with the ownership
+// labels of the toolchain component.
+func applyObjects(ctx context.Context, client dynamic.Interface, mapper meta.ResettableRESTMapper, objects []*unstructured.Unstructured, toolchain, component, namespace string) ([]objectRef, error) {
+	sortObjects(objects, releaseutil.InstallOrder)
+	force := true
+	refs := make([]objectRef, 0, len(objects))
+	for _, obj := range objects {
+		ri, err := resourceInterface(ctx, client, mapper, obj, namespace)
+		if err != nil {
+			return refs, fmt.Errorf("%s: %s", refOf(obj), err)
+		}
+		existing, err := ri.Get(ctx, obj.GetName(), metav1.GetOptions{})
+		if err == nil {
+			if err := checkOwner(existing, toolchain, component); err != nil {
+				return refs, err
+			}
+		} else if !errors.IsNotFound(err) {
+			return refs, err
+		}
+		obj.SetLabels(mergeStringMaps(obj.GetLabels(), map[string]string{
+			"app.kubernetes.io/managed-by": fieldManager,
+			toolchainLabel:                 toolchain,
+			componentLabel:                 component,
+		}))
+		data, err := json.Marshal(obj.Object)
+		if err != nil {
+			return refs, err
+		}
+		if _, err := ri.Patch(ctx, obj.GetName(), types.ApplyPatchType, data, metav1.PatchOptions{FieldManager: fieldManager, Force: &force}); err != nil {
+			return refs, fmt.Errorf("%s: %s", refOf(obj), err)
+		}
+		refs = append(refs, refOf(obj))
+	}
+	return refs, nil
+}
+
+// deleteObjects deletes the referenced objects in the uninstall order.
+func deleteObjects(ctx context.Context, client dynamic.Interface, mapper meta.ResettableRESTMapper, refs []objectRef) error {
+	objects := make([]*unstructured.Unstructured, 0, len(refs))
+	for _, ref := range refs {
+		obj := &unstructured.Unstructured{}
+		obj.SetAPIVersion(ref.APIVersion)
+		obj.SetKind(ref.Kind)
+		obj.SetNamespace(ref.Namespace)
+		obj.SetName(ref.Name)
+		objects = append(objects, obj)
+	}
+	sortObjects(objects, releaseutil.UninstallOrder)
+	for _, obj := range objects {
+		mapping, err := mapper.RESTMapping(schema.FromAPIVersionAndKind(obj.GetAPIVersion(), obj.GetKind()).GroupKind(), obj.GroupVersionKind().Version)
+		if meta.IsNoMatchError(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		var ri dynamic.ResourceInterface = client.Resource(mapping.Resource)
+		if obj.GetNamespace() != "" {
+			ri = client.Resource(mapping.Resource).Namespace(obj.GetNamespace())
+		}
+		logger.Debugf("deleting %s", refOf(obj))
+		if err := ri.Delete(ctx, obj.GetName(), metav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("%s: %s", refOf(obj), err)
+		}
+	}
+	return nil
+}
+
+// pruneTargets returns the previously applied objects that are no
+// longer in the component manifests.
+func pruneTargets(previous, current []objectRef) []objectRef {
+	applied := make(map[objectRef]bool, len(current))
+	for _, ref := range current {
+		applied[ref] = true
+	}
+	var targets []objectRef
+	for _, ref := range previous {
+		if !applied[ref] {
+			targets = append(targets, ref)
+		}
+	}
+	return targets
+}
+
+// inventoryName returns the name of the inventory config map of the
+// component.
+func inventoryName(component string) string {
+	return fmt.Sprintf("trustacks-component-%s", component)
+}
+
+// readInventory returns the objects applied by the previous install of
+// the component.
+func readInventory(ctx context.Context, clientset kubernetes.Interface, namespace, component string) ([]objectRef, error) {
+	cm, err := clientset.CoreV1().ConfigMaps(namespace).Get(ctx, inventoryName(component), metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var refs []objectRef
+	if err := json.Unmarshal([]byte(cm.Data["objects"]), &refs); err != nil {
+		return nil, fmt.Errorf("error reading the '%s' inventory: %s", component, err)
+	}
+	return refs, nil
+}
+
+// writeInventory stores the objects applied by the component install.
+func writeInventory(ctx context.Context, clientset kubernetes.Interface, namespace, toolchain, component, version string, refs []objectRef) error {
+	data, err := json.Marshal(refs)
+	if err != nil {
+		return err
+	}
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: inventoryName(component),
+			Labels: map[string]string{
+				"app.kubernetes.io/managed-by": fieldManager,
+				toolchainLabel:                 toolchain,
+				componentLabel:                 component,
+			},
+		},
+		Data: map[string]string{"objects": string(data), "version": version},
+	}
+	configMaps := clientset.CoreV1().ConfigMaps(namespace)
+	_, err = configMaps.Update(ctx, cm, metav1.UpdateOptions{})
+	if errors.IsNotFound(err) {
+		_, err = configMaps.Create(ctx, cm, metav1.CreateOptions{})
+	}
+	return err
+}
+
+// applyComponent applies the manifests of a kustomize or manifest
+// component and prunes the objects removed since the previous install.
+func (tc *toolchain) applyComponent(ctx context.Context, name, namespace string, cluster *clusterConfig, metadata *componentMetadata) error {
+	manifests, err := os.ReadFile(filepath.Join(tc.componentsPath(), name, manifestsFile))
+	if err != nil {
+		return err
+	}
+	renderer, err := tc.postRenderer()
+	if err != nil {
+		return err
+	}
+	if renderer != nil {
+		rendered, err := renderer.Run(bytes.NewBuffer(manifests))
+		if err != nil {
+			return err
+		}
+		manifests = rendered.Bytes()
+	}
+	objects, err := decodeObjects(manifests)
+	if err != nil {
+		return fmt.Errorf("error decoding the manifests: %s", err)
+	}
+	client, mapper, err := newDynamicClient(cluster)
+	if err != nil {
+		return err
+	}
+	clientset, err := newClientset(cluster)
+	if err != nil {
+		return err
+	}
+	previous, err := readInventory(ctx, clientset, namespace, name)
+	if err != nil {
+		return err
+	}
+	logger.WithFields(logrus.Fields{"component": name, "cluster": clusterLabel(cluster)}).Infof("applying %d %s object(s)", len(objects), metadata.Type)
+	refs, err := applyObjects(ctx, client, mapper, objects, tc.name, name, namespace)
+	if err != nil {
+		// the objects applied before the error are added to the
+		// inventory so that they are pruned or removed later.
+		if werr := writeInventory(ctx, clientset, namespace, tc.name, name, metadata.Version, append(previous, pruneTargets(refs, previous)...)); werr != nil {
+			logger.WithField("component", name).Warnf("error updating the inventory: %s", werr)
+		}
+		return err
+	}
+	if targets := pruneTargets(previous, refs); len(targets) > 0 {
+		logger.WithField("component", name).Infof("pruning %d object(s)", len(targets))
+		if err := deleteObjects(ctx, client, mapper, targets); err != nil {
+			return fmt.Errorf("error pruning the removed objects: %s", err)
+		}
+	}
+	return writeInventory(ctx, clientset, namespace, tc.name, name, metadata.Version, refs)
+}
+
+// removeManifests deletes the objects of the kustomize and manifest
+// components.
+func (tc *toolchain) removeManifests(ctx context.Context) error {
+	components, err := os.ReadDir(tc.componentsPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, component := range components {
+		name := component.Name()
+		if _, err := readComponentMetadata(filepath.Join(tc.componentsPath(), name)); err != nil {
+			continue
+		}
+		cluster := tc.cluster(name)
+		clientset, err := newClientset(cluster)
+		if err != nil {
+			return err
+		}
+		refs, err := readInventory(ctx, clientset, tc.namespace(), name)
+		if err != nil {
+			return err
+		}
+		client, mapper, err := newDynamicClient(cluster)
+		if err != nil {
+			return err
+		}
+		if err := deleteObjects(ctx, client, mapper, refs); err != nil {
+			return fmt.Errorf("error removing '%s': %s", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package toolchain
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"helm.sh/helm/v3/pkg/releaseutil"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// staticMapper is a rest mapper without discovery.
+type staticMapper struct {
+	meta.RESTMapper
+}
+
+func (staticMapper) Reset() {}
+
+func newStaticMapper() staticMapper {
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}, meta.RESTScopeNamespace)
+	mapper.Add(schema.GroupVersionKind{Group: "rbac.authorization.k8s.io", Version: "v1", Kind: "ClusterRole"}, meta.RESTScopeRoot)
+	return staticMapper{mapper}
+}
+
+func TestFetchManifests(t *testing.T) {
+	defer patchToolchainRoot()()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1.0.0/install.yaml" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if _, err := w.Write([]byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: test\n")); err != nil {
+			t.Fatal(err)
+		}
+	}))
+	defer ts.Close()
+	catalog := &componentCatalog{
+		Components: map[string]component{
+			"manifest":  {Type: componentTypeManifest, Source: fmt.Sprintf("%s/v{{ .Version }}/install.yaml", ts.URL), Version: "1.0.0"},
+			"kustomize": {Type: componentTypeKustomize, Source: filepath.Join("testdata", "kustomize-base"), Version: "2.0.0", Hooks: "unsupported"},
+		},
+	}
+	tc := &toolchain{name: "test"}
+	if err := tc.addComponents(context.TODO(), []string{"manifest", "kustomize"}, catalog); err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]string{"manifest": "test", "kustomize": "test-config"} {
+		manifests, err := os.ReadFile(filepath.Join(tc.componentsPath(), name, manifestsFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		objects, err := decodeObjects(manifests)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if assert.Len(t, objects, 1) {
+			assert.Equal(t, expected, objects[0].GetName(), "got an unexpected '%s' object", name)
+		}
+	}
+	version, err := componentVersion(filepath.Join(tc.componentsPath(), "kustomize"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "2.0.0", version, "got an unexpected component version")
+	if err := tc.addHooks([]string{"kustomize"}, catalog, map[string]interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.addSubChartValues([]string{"kustomize"}, catalog, map[string]interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+	assert.NoFileExists(t, filepath.Join(tc.componentsPath(), "kustomize", "override-values.yaml"), "expected no values for kustomize components")
+}
+
+func TestSortObjects(t *testing.T) {
+	objects, err := decodeObjects([]byte(`apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: test
+---
+apiVersion: example.com/v1
+kind: Widget
+metadata:
+  name: test
+---
+apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: widgets.example.com
+---
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: test
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sortObjects(objects, releaseutil.InstallOrder)
+	var kinds []string
+	for _, obj := range objects {
+		kinds = append(kinds, obj.GetKind())
+	}
+	assert.Equal(t, []string{"Namespace", "CustomResourceDefinition", "Deployment", "Widget"}, kinds, "got an unexpected install order")
+}
+
+func TestCheckOwner(t *testing.T) {
+	obj := &unstructured.Unstructured{}
+	obj.SetKind("ConfigMap")
+	obj.SetName("test")
+	assert.Error(t, checkOwner(obj, "test", "concourse"), "expected an error for an unmanaged object")
+	obj.SetLabels(map[string]string{toolchainLabel: "test", componentLabel: "authentik"})
+	assert.ErrorContains(t, checkOwner(obj, "test", "concourse"), "owned by component 'authentik'")
+	assert.NoError(t, checkOwner(obj, "test", "authentik"))
+}
+
+func TestPruneTargets(t *testing.T) {
+	previous := []objectRef{
+		{APIVersion: "v1", Kind: "ConfigMap", Namespace: "test", Name: "a"},
+		{APIVersion: "v1", Kind: "ConfigMap", Namespace: "test", Name: "b"},
+	}
+	current := []objectRef{previous[1]}
+	assert.Equal(t, []objectRef{previous[0]}, pruneTargets(previous, current))
+	assert.Empty(t, pruneTargets(current, previous))
+}
+
+func TestInventory(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	refs, err := readInventory(context.Background(), clientset, "test", "concourse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, refs, "expected an empty inventory")
+	expected := []objectRef{{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "ClusterRole", Name: "test"}}
+	for i := 0; i < 2; i++ {
+		if err := writeInventory(context.Background(), clientset, "test", "test", "concourse", "1.0.0", expected); err != nil {
+			t.Fatal(err)
+		}
+	}
+	refs, err = readInventory(context.Background(), clientset, "test", "concourse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, expected, refs)
+}
+
+func TestApplyObjectsOwnership(t *testing.T) {
+	existing := &unstructured.Unstructured{}
+	existing.SetAPIVersion("v1")
+	existing.SetKind("ConfigMap")
+	existing.SetNamespace("test")
+	existing.SetName("test")
+	client := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), existing)
+
+	obj := existing.DeepCopy()
+	obj.SetNamespace("")
+	_, err := applyObjects(context.Background(), client, newStaticMapper(), []*unstructured.Unstructured{obj}, "test", "concourse", "test")
+	assert.ErrorContains(t, err, "not managed by the toolchain", "expected unmanaged objects to be left untouched")
+	assert.Equal(t, "test", obj.GetNamespace(), "expected the default namespace to be set")
+}
+
+func TestDeleteObjects(t *testing.T) {
+	existing := &unstructured.Unstructured{}
+	existing.SetAPIVersion("rbac.authorization.k8s.io/v1")
+	existing.SetKind("ClusterRole")
+	existing.SetName("test")
+	client := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), existing)
+	refs := []objectRef{
+		refOf(existing),
+		{APIVersion: "v1", Kind: "ConfigMap", Namespace: "test", Name: "missing"},
+		{APIVersion: "example.com/v1", Kind: "Widget", Name: "unknown"},
+	}
+	if err := deleteObjects(context.Background(), client, newStaticMapper(), refs); err != nil {
+		t.Fatal(err)
+	}
+	gvr := schema.GroupVersionResource{Group: "rbac.authorization.k8s.io", Version: "v1", Resource: "clusterroles"}
+	_, err := client.Resource(gvr).Get(context.Background(), "test", metav1.GetOptions{})
+	assert.Error(t, err, "expected the cluster role to be deleted")
+}
@@ -0,0 +1,116 @@
+package toolchain
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// documentSeparator matches the separators of a multi document
+// manifest.
+var documentSeparator = regexp.MustCompile(`(?m)^---[ \t]*$`)
+
+// registryMirror returns the registry mirror of the toolchain config.
+func (tc *toolchain) registryMirror() string {
+	if tc.config == nil {
+		return ""
+	}
+	return strings.TrimSuffix(tc.config.RegistryMirror, "/")
+}
+
+// mirrorImage rewrites the image reference to pull from the registry
+// mirror.
+//
+// The source registry is kept as the first path segment of the mirror
+// repository, so quay.io/trustacks/catalog:latest is pulled from
+// <mirror>/quay.io/trustacks/catalog:latest and docker hub images such
+// as nginx:1.23 are pulled from <mirror>/docker.io/library/nginx:1.23.
+func mirrorImage(mirror, image string) string {
+	if mirror == "" || image == "" || strings.HasPrefix(image, mirror+"/") || strings.Contains(image, "{{") {
+		return image
+	}
+	parts := strings.SplitN(image, "/", 2)
+	if len(parts) == 1 || !(strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		// the image is a docker hub image.
+		if len(parts) == 1 {
+			image = fmt.Sprintf("library/%s", image)
+		}
+		image = fmt.Sprintf("docker.io/%s", image)
+	}
+	return fmt.Sprintf("%s/%s", mirror, image)
+}
+
+// mirrorManifests rewrites the container images of the manifest
+// documents to the registry mirror.
+func mirrorManifests(mirror string, manifests []byte) ([]byte, error) {
+	return mirrorDocuments(mirror, manifests, walkImages)
+}
+
+// mirrorValues rewrites the image keys of the chart values to the
+// registry mirror.
+func mirrorValues(mirror string, values []byte) ([]byte, error) {
+	return mirrorDocuments(mirror, values, walkValueImages)
+}
+
+// mirrorDocuments rewrites the image references found by walk in the
+// documents to the registry mirror.
+//
+// Only the documents that reference images are re-encoded. The other
+// documents are returned unchanged.
+func mirrorDocuments(mirror string, data []byte, walk func(interface{}, func(string) string)) ([]byte, error) {
+	if mirror == "" {
+		return data, nil
+	}
+	documents := documentSeparator.Split(string(data), -1)
+	for i, document := range documents {
+		var obj map[string]interface{}
+		if err := yaml.Unmarshal([]byte(document), &obj); err != nil {
+			return nil, err
+		}
+		rewritten := false
+		walk(obj, func(image string) string {
+			mirrored := mirrorImage(mirror, image)
+			rewritten = rewritten || mirrored != image
+			return mirrored
+		})
+		if !rewritten {
+			continue
+		}
+		data, err := yaml.Marshal(obj)
+		if err != nil {
+			return nil, err
+		}
+		documents[i] = "\n" + string(data)
+	}
+	return []byte(strings.Join(documents, "---")), nil
+}
+
+// imageMirror is a helm post renderer that rewrites the image
+// references of the rendered manifests to the registry mirror.
+type imageMirror struct {
+	mirror string
+}
+
+// Run rewrites the rendered manifests.
+func (m *imageMirror) Run(renderedManifests *bytes.Buffer) (*bytes.Buffer, error) {
+	manifests, err := mirrorManifests(m.mirror, renderedManifests.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("error rewriting the manifest images: %s", err)
+	}
+	return bytes.NewBuffer(manifests), nil
+}
+
+// mirrorHooks rewrites the image references of the rendered hook
+// manifests. The hooks are returned unchanged if they can not be
+// parsed, which is the case when they contain helm template actions.
+func (tc *toolchain) mirrorHooks(hooks []byte) []byte {
+	mirrored, err := mirrorManifests(tc.registryMirror(), hooks)
+	if err != nil {
+		logger.Debugf("the hook images were not rewritten: %s", err)
+		return hooks
+	}
+	return mirrored
+}
@@ -0,0 +1,140 @@
+package toolchain
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+func TestMirrorImage(t *testing.T) {
+	mirror := "registry.internal/mirror"
+	for image, expected := range map[string]string{
+		"nginx":                               "registry.internal/mirror/docker.io/library/nginx",
+		"nginx:1.23":                          "registry.internal/mirror/docker.io/library/nginx:1.23",
+		"bitnami/postgresql:14":               "registry.internal/mirror/docker.io/bitnami/postgresql:14",
+		"quay.io/trustacks/catalog:latest":    "registry.internal/mirror/quay.io/trustacks/catalog:latest",
+		"localhost:5000/test@sha256:abc":      "registry.internal/mirror/localhost:5000/test@sha256:abc",
+		"registry.internal/mirror/test:1.0.0": "registry.internal/mirror/test:1.0.0",
+		"{{ .Values.image }}":                 "{{ .Values.image }}",
+	} {
+		assert.Equal(t, expected, mirrorImage(mirror, image), "got an unexpected mirror image for '%s'", image)
+	}
+	assert.Equal(t, "nginx", mirrorImage("", "nginx"), "expected the image to be unchanged without a mirror")
+}
+
+func TestMirrorManifests(t *testing.T) {
+	manifests := []byte(`# Source: test/templates/configmap.yaml
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: test
+data:
+  image: nginx
+---
+# Source: test/templates/pod.yaml
+apiVersion: v1
+kind: Pod
+metadata:
+  name: test
+spec:
+  containers:
+  - name: test
+    image: quay.io/trustacks/catalog:latest
+`)
+	mirrored, err := mirrorManifests("registry.internal", manifests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects, err := decodeManifests(mirrored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, objects, 2)
+	images, err := manifestImages(mirrored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"registry.internal/quay.io/trustacks/catalog:latest"}, images)
+	assert.Contains(t, string(mirrored), "image: nginx\n", "expected the configmap data to be unchanged")
+
+	out, err := (&imageMirror{mirror: "registry.internal"}).Run(bytes.NewBuffer(manifests))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, out.String(), "image: registry.internal/quay.io/trustacks/catalog:latest", "expected the post renderer to rewrite the images")
+}
+
+func TestToolchainMirrorHooks(t *testing.T) {
+	defer patchToolchainRoot()()
+	hooksManifest, err := os.ReadFile(filepath.Join("testdata", "hooks.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	catalog := &componentCatalog{
+		HookSource: "quay.io/trustacks/test-catalog:latest",
+		Components: map[string]component{
+			"helloworld": {Hooks: string(hooksManifest), Values: "image: nginx:1.23\n"},
+		},
+	}
+	tc := &toolchain{config: &toolchainConfig{RegistryMirror: "registry.internal/"}}
+	if err := os.MkdirAll(filepath.Join(tc.componentsPath(), "helloworld", "templates"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.addHooks([]string{"helloworld"}, catalog, map[string]interface{}{"testParam": "test"}); err != nil {
+		t.Fatal(err)
+	}
+	hooks, err := os.ReadFile(filepath.Join(tc.componentsPath(), "helloworld", "templates", "trustacks-hooks.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, string(hooks), "image: registry.internal/quay.io/trustacks/test-catalog:latest", "expected the hook source to be mirrored")
+	if err := tc.addSubChartValues([]string{"helloworld"}, catalog, map[string]interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+	values, err := os.ReadFile(filepath.Join(tc.componentsPath(), "helloworld", "override-values.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, string(values), "image: registry.internal/docker.io/library/nginx:1.23", "expected the value images to be mirrored")
+}
+
+func TestMirrorValuesImageMaps(t *testing.T) {
+	values := []byte(`image:
+  registry: docker.io
+  repository: bitnami/postgresql
+  tag: 14.4.0
+metrics:
+  image:
+    repository: quay.io/prometheus/postgres-exporter
+    tag: v0.10.1
+exporter:
+  image:
+    registry: registry.internal
+    repository: quay.io/trustacks/exporter
+`)
+	mirrored, err := mirrorValues("registry.internal", values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var obj map[string]interface{}
+	if err := yaml.Unmarshal(mirrored, &obj); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, map[string]interface{}{
+		"registry":   "registry.internal",
+		"repository": "docker.io/bitnami/postgresql",
+		"tag":        "14.4.0",
+	}, obj["image"], "expected the registry to be the mirror")
+	assert.Equal(t, map[string]interface{}{
+		"repository": "registry.internal/quay.io/prometheus/postgres-exporter",
+		"tag":        "v0.10.1",
+	}, obj["metrics"].(map[string]interface{})["image"], "expected the repository to be mirrored")
+	assert.Equal(t, map[string]interface{}{
+		"registry":   "registry.internal",
+		"repository": "quay.io/trustacks/exporter",
+	}, obj["exporter"].(map[string]interface{})["image"], "expected the mirrored image to be unchanged")
+}
@@ -0,0 +1,212 @@
+package toolchain
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"helm.sh/helm/v3/pkg/action"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// namespaceConfig contains the configuration of a toolchain or
+// application namespace.
+type namespaceConfig struct {
+	// Name is the name of the namespace.
+	Name string `json:"name"`
+	// Labels are added to the namespace.
+	Labels map[string]string `json:"labels"`
+	// Annotations are added to the namespace.
+	Annotations map[string]string `json:"annotations"`
+	// Existing indicates that the namespace is provisioned outside of
+	// the toolchain. Existing namespaces must exist before the install
+	// and are neither modified nor deleted.
+	Existing bool `json:"existing"`
+}
+
+// ensureNamespace creates the namespace, or updates the labels and
+// annotations of the namespace if it already exists.
+func ensureNamespace(ctx context.Context, clientset kubernetes.Interface, config *namespaceConfig) error {
+	ns, err := clientset.CoreV1().Namespaces().Get(ctx, config.Name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		if config.Existing {
+			return fmt.Errorf("namespace '%s' does not exist", config.Name)
+		}
+		_, err = clientset.CoreV1().Namespaces().Create(ctx, &corev1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        config.Name,
+				Labels:      config.Labels,
+				Annotations: config.Annotations,
+			},
+		}, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if config.Existing || (len(config.Labels) == 0 && len(config.Annotations) == 0) {
+		return nil
+	}
+	if ns.Labels == nil {
+		ns.Labels = map[string]string{}
+	}
+	for k, v := range config.Labels {
+		ns.Labels[k] = v
+	}
+	if ns.Annotations == nil {
+		ns.Annotations = map[string]string{}
+	}
+	for k, v := range config.Annotations {
+		ns.Annotations[k] = v
+	}
+	_, err = clientset.CoreV1().Namespaces().Update(ctx, ns, metav1.UpdateOptions{})
+	return err
+}
+
+// removeNamespace deletes the namespace, or uninstalls the toolchain
+// releases in the namespace if it is an existing namespace. The other
+// releases of an existing namespace are left untouched.
+func removeNamespace(ctx context.Context, clientset kubernetes.Interface, config *namespaceConfig, cluster *clusterConfig, owned map[string]bool) error {
+	if !config.Existing {
+		err := clientset.CoreV1().Namespaces().Delete(ctx, config.Name, metav1.DeleteOptions{})
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	helmClient, err := newHelmClient(config.Name, cluster)
+	if err != nil {
+		return err
+	}
+	releases, err := helmClient.ListReleasesByStateMask(action.ListAll)
+	if err != nil {
+		return err
+	}
+	for _, rel := range releases {
+		if !owned[rel.Name] {
+			continue
+		}
+		logger.WithField("release", rel.Name).Info("uninstalling release from the existing namespace")
+		if err := helmClient.UninstallReleaseByName(rel.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseNames returns the names of the helm releases installed by
+// the toolchain: the toolchain chart, the chart components and the
+// application charts.
+func (tc *toolchain) releaseNames() (map[string]bool, error) {
+	names := map[string]bool{fmt.Sprintf("trustacks-toolchain-%s", tc.name): true}
+	components, err := os.ReadDir(tc.componentsPath())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, component := range components {
+		if _, err := readComponentMetadata(filepath.Join(tc.componentsPath(), component.Name())); err == nil {
+			continue
+		}
+		names[component.Name()] = true
+	}
+	applications, err := os.ReadDir(tc.applicationsPath())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, app := range applications {
+		names[(&application{name: app.Name(), toolchain: tc}).releaseName()] = true
+	}
+	return names, nil
+}
+
+// namespaceConfig returns the toolchain namespace configuration.
+//
+// The namespace defaults to trustacks-toolchain-<name>.
+func (tc *toolchain) namespaceConfig() *namespaceConfig {
+	config := &namespaceConfig{}
+	if tc.config != nil && tc.config.Namespace != nil {
+		*config = *tc.config.Namespace
+	}
+	if config.Name == "" {
+		config.Name = fmt.Sprintf("trustacks-toolchain-%s", tc.name)
+	}
+	return config
+}
+
+// namespace returns the toolchain namespace.
+func (tc *toolchain) namespace() string {
+	return tc.namespaceConfig().Name
+}
+
+// applicationNamespaceConfig returns the namespace configuration of
+// the application. The toolchain namespace is used if the application
+// does not have a namespace. Isolated applications default to the
+// <toolchain namespace>-<application> namespace.
+//
+// Application namespaces inherit the labels and annotations of the
+// toolchain namespace.
+func (tc *toolchain) applicationNamespaceConfig(app *applicationConfig) *namespaceConfig {
+	toolchainNamespace := tc.namespaceConfig()
+	config := namespaceConfig{}
+	if app != nil && app.Namespace != nil {
+		config = *app.Namespace
+	}
+	if config.Name == "" && app.isolated() {
+		config.Name = fmt.Sprintf("%s-%s", toolchainNamespace.Name, app.Name)
+	}
+	if config.Name == "" || config.Name == toolchainNamespace.Name {
+		return toolchainNamespace
+	}
+	config.Labels = mergeStringMaps(toolchainNamespace.Labels, config.Labels)
+	config.Annotations = mergeStringMaps(toolchainNamespace.Annotations, config.Annotations)
+	return &config
+}
+
+// findApplication returns the stored configuration of the
+// application.
+func (tc *toolchain) findApplication(name string) *applicationConfig {
+	if tc.config == nil {
+		return nil
+	}
+	for i := range tc.config.Applications {
+		if tc.config.Applications[i].Name == name {
+			return &tc.config.Applications[i]
+		}
+	}
+	return nil
+}
+
+// namespaces returns the toolchain namespace followed by the distinct
+// application namespaces.
+func (tc *toolchain) namespaces() []*namespaceConfig {
+	namespaces := []*namespaceConfig{tc.namespaceConfig()}
+	seen := map[string]bool{namespaces[0].Name: true}
+	if tc.config == nil {
+		return namespaces
+	}
+	for i := range tc.config.Applications {
+		ns := tc.applicationNamespaceConfig(&tc.config.Applications[i])
+		if seen[ns.Name] {
+			continue
+		}
+		seen[ns.Name] = true
+		namespaces = append(namespaces, ns)
+	}
+	return namespaces
+}
+
+// mergeStringMaps returns the union of the maps. Values in the later
+// maps take precedence.
+func mergeStringMaps(maps ...map[string]string) map[string]string {
+	merged := map[string]string{}
+	for _, m := range maps {
+		for k, v := range m {
+			merged[k] = v
+		}
+	}
+	return merged
+}
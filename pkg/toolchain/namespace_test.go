@@ -0,0 +1,104 @@
+package toolchain
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestEnsureNamespace(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "platform",
+			Labels: map[string]string{"team": "platform"},
+		},
+	})
+	ctx := context.Background()
+
+	// test create a new namespace
+	config := &namespaceConfig{
+		Name:        "trustacks-toolchain-test",
+		Labels:      map[string]string{"cost-center": "ci"},
+		Annotations: map[string]string{"owner": "platform"},
+	}
+	if err := ensureNamespace(ctx, clientset, config); err != nil {
+		t.Fatal(err)
+	}
+	ns, err := clientset.CoreV1().Namespaces().Get(ctx, "trustacks-toolchain-test", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "ci", ns.Labels["cost-center"], "got an unexpected namespace label")
+	assert.Equal(t, "platform", ns.Annotations["owner"], "got an unexpected namespace annotation")
+
+	// test update the labels of a namespace
+	if err := ensureNamespace(ctx, clientset, &namespaceConfig{Name: "platform", Labels: map[string]string{"cost-center": "ci"}}); err != nil {
+		t.Fatal(err)
+	}
+	ns, err = clientset.CoreV1().Namespaces().Get(ctx, "platform", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, map[string]string{"team": "platform", "cost-center": "ci"}, ns.Labels, "expected the labels to be merged")
+
+	// test adopt an existing namespace
+	if err := ensureNamespace(ctx, clientset, &namespaceConfig{Name: "platform", Existing: true, Labels: map[string]string{"team": "other"}}); err != nil {
+		t.Fatal(err)
+	}
+	ns, err = clientset.CoreV1().Namespaces().Get(ctx, "platform", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "platform", ns.Labels["team"], "expected the existing namespace to be unmodified")
+
+	// test adopt a missing namespace
+	err = ensureNamespace(ctx, clientset, &namespaceConfig{Name: "missing", Existing: true})
+	assert.ErrorContains(t, err, "namespace 'missing' does not exist", "expected a missing namespace error")
+}
+
+func TestToolchainNamespaces(t *testing.T) {
+	tc := &toolchain{name: "test"}
+	assert.Equal(t, "trustacks-toolchain-test", tc.namespace(), "expected the default namespace")
+
+	tc.config = &toolchainConfig{
+		Namespace: &namespaceConfig{Name: "platform-ci", Labels: map[string]string{"team": "platform"}},
+		Applications: []applicationConfig{
+			{Name: "web", Namespace: &namespaceConfig{Name: "web", Labels: map[string]string{"app": "web"}}},
+			{Name: "api"},
+		},
+	}
+	assert.Equal(t, "platform-ci", tc.namespace(), "expected the configured namespace")
+
+	web := tc.applicationNamespaceConfig(tc.findApplication("web"))
+	assert.Equal(t, "web", web.Name, "expected the application namespace")
+	assert.Equal(t, map[string]string{"team": "platform", "app": "web"}, web.Labels, "expected the toolchain labels to be inherited")
+	assert.Equal(t, "platform-ci", tc.applicationNamespaceConfig(tc.findApplication("api")).Name, "expected the toolchain namespace")
+
+	namespaces := tc.namespaces()
+	assert.Len(t, namespaces, 2, "expected the toolchain and web namespaces")
+	assert.Equal(t, "web", namespaces[1].Name, "got an unexpected application namespace")
+}
+
+func TestReleaseNames(t *testing.T) {
+	defer patchToolchainRoot()()
+	tc := &toolchain{name: "test"}
+	newTestToolchainChart(t, tc)
+	if err := os.MkdirAll(filepath.Join(tc.applicationsPath(), "web"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	names, err := tc.releaseNames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, map[string]bool{
+		"trustacks-toolchain-test":  true,
+		"helloworld":                true,
+		"trustacks-application-web": true,
+	}, names, "expected the manifest components and foreign releases to be excluded")
+}
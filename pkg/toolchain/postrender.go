@@ -0,0 +1,235 @@
+package toolchain
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	helmclient "github.com/mittwald/go-helm-client"
+	"gopkg.in/yaml.v3"
+	"helm.sh/helm/v3/pkg/postrender"
+	"sigs.k8s.io/kustomize/api/krusty"
+	"sigs.k8s.io/kustomize/api/types"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+)
+
+// postRenderConfig contains the post render pipeline of the rendered
+// toolchain, component and application manifests.
+type postRenderConfig struct {
+	// Labels are added to the rendered resources and pod templates.
+	Labels map[string]string `json:"labels"`
+	// Annotations are added to the rendered resources and pod
+	// templates.
+	Annotations map[string]string `json:"annotations"`
+	// Kustomize is the directory of a kustomize component applied to
+	// the rendered manifests.
+	Kustomize string `json:"kustomize"`
+	// Exec is an external post renderer executable.
+	Exec *execConfig `json:"exec"`
+}
+
+// resolvePaths resolves the relative kustomize directory and exec
+// command from the config file directory rather than the working
+// directory. The paths are made absolute since they are stored with
+// the toolchain config. An exec command without a path separator is
+// looked up on the $PATH and is kept as is.
+func (c *postRenderConfig) resolvePaths(dir string) error {
+	if c.Kustomize != "" {
+		path, err := resolvePath(dir, c.Kustomize)
+		if err != nil {
+			return err
+		}
+		c.Kustomize = path
+	}
+	if c.Exec != nil && strings.ContainsRune(filepath.ToSlash(c.Exec.Command), '/') {
+		path, err := resolvePath(dir, c.Exec.Command)
+		if err != nil {
+			return err
+		}
+		c.Exec.Command = path
+	}
+	return nil
+}
+
+// resolvePath returns the absolute path of the path relative to dir.
+func resolvePath(dir, path string) (string, error) {
+	if filepath.IsAbs(path) {
+		return path, nil
+	}
+	return filepath.Abs(filepath.Join(dir, path))
+}
+
+// execConfig contains the external post renderer command.
+type execConfig struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+}
+
+// postRenderChain runs the post renderers in order.
+type postRenderChain []postrender.PostRenderer
+
+// Run passes the rendered manifests through each post renderer.
+func (c postRenderChain) Run(renderedManifests *bytes.Buffer) (*bytes.Buffer, error) {
+	var err error
+	for _, r := range c {
+		renderedManifests, err = r.Run(renderedManifests)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return renderedManifests, nil
+}
+
+// metadataRenderer adds the labels and annotations to the rendered
+// resources.
+type metadataRenderer struct {
+	labels      map[string]string
+	annotations map[string]string
+}
+
+// Run adds the labels and annotations to the metadata of the rendered
+// resources and of their pod templates.
+func (m *metadataRenderer) Run(renderedManifests *bytes.Buffer) (*bytes.Buffer, error) {
+	documents := documentSeparator.Split(renderedManifests.String(), -1)
+	for i, document := range documents {
+		var obj map[string]interface{}
+		if err := yaml.Unmarshal([]byte(document), &obj); err != nil {
+			return nil, fmt.Errorf("error injecting the metadata: %s", err)
+		}
+		if obj == nil {
+			continue
+		}
+		addMetadata(obj, m.labels, m.annotations)
+		if spec, ok := obj["spec"].(map[string]interface{}); ok {
+			if template, ok := spec["template"].(map[string]interface{}); ok {
+				addMetadata(template, m.labels, m.annotations)
+			}
+		}
+		data, err := yaml.Marshal(obj)
+		if err != nil {
+			return nil, err
+		}
+		documents[i] = "\n" + string(data)
+	}
+	return bytes.NewBufferString(strings.Join(documents, "---")), nil
+}
+
+// addMetadata merges the labels and annotations into the object
+// metadata. Existing keys are left unchanged.
+func addMetadata(obj map[string]interface{}, labels, annotations map[string]string) {
+	metadata, ok := obj["metadata"].(map[string]interface{})
+	if !ok {
+		metadata = make(map[string]interface{})
+		obj["metadata"] = metadata
+	}
+	for field, values := range map[string]map[string]string{"labels": labels, "annotations": annotations} {
+		if len(values) == 0 {
+			continue
+		}
+		existing, ok := metadata[field].(map[string]interface{})
+		if !ok {
+			existing = make(map[string]interface{})
+			metadata[field] = existing
+		}
+		for k, v := range values {
+			if _, ok := existing[k]; !ok {
+				existing[k] = v
+			}
+		}
+	}
+}
+
+// kustomizeRenderer applies a kustomize component to the rendered
+// manifests.
+type kustomizeRenderer struct {
+	dir string
+}
+
+// Run builds a kustomization of the rendered manifests with the
+// kustomize component.
+func (k *kustomizeRenderer) Run(renderedManifests *bytes.Buffer) (*bytes.Buffer, error) {
+	component, err := filepath.Abs(k.dir)
+	if err != nil {
+		return nil, err
+	}
+	d, err := os.MkdirTemp("", "kustomize")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(d)
+	if err := os.WriteFile(filepath.Join(d, "rendered.yaml"), renderedManifests.Bytes(), 0600); err != nil {
+		return nil, err
+	}
+	// kustomize only loads components by relative paths.
+	component, err = filepath.Rel(d, component)
+	if err != nil {
+		return nil, err
+	}
+	kustomization, err := yaml.Marshal(map[string]interface{}{
+		"apiVersion": "kustomize.config.k8s.io/v1beta1",
+		"kind":       "Kustomization",
+		"resources":  []string{"rendered.yaml"},
+		"components": []string{component},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(d, "kustomization.yaml"), kustomization, 0600); err != nil {
+		return nil, err
+	}
+	opts := krusty.MakeDefaultOptions()
+	opts.LoadRestrictions = types.LoadRestrictionsNone
+	resources, err := krusty.MakeKustomizer(opts).Run(filesys.MakeFsOnDisk(), d)
+	if err != nil {
+		return nil, fmt.Errorf("error applying the kustomize component: %s", err)
+	}
+	manifests, err := resources.AsYaml()
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewBuffer(manifests), nil
+}
+
+// postRenderer returns the post render pipeline of the toolchain
+// config, or nil if there are no post renderers.
+//
+// The registry mirror runs last so that the images added by the other
+// post renderers are rewritten.
+func (tc *toolchain) postRenderer() (postrender.PostRenderer, error) {
+	var chain postRenderChain
+	if tc.config != nil && tc.config.PostRender != nil {
+		config := tc.config.PostRender
+		if len(config.Labels) > 0 || len(config.Annotations) > 0 {
+			chain = append(chain, &metadataRenderer{labels: config.Labels, annotations: config.Annotations})
+		}
+		if config.Kustomize != "" {
+			chain = append(chain, &kustomizeRenderer{dir: config.Kustomize})
+		}
+		if config.Exec != nil {
+			r, err := postrender.NewExec(config.Exec.Command, config.Exec.Args...)
+			if err != nil {
+				return nil, fmt.Errorf("error creating the exec post renderer: %s", err)
+			}
+			chain = append(chain, r)
+		}
+	}
+	if tc.registryMirror() != "" {
+		chain = append(chain, &imageMirror{mirror: tc.registryMirror()})
+	}
+	if len(chain) == 0 {
+		return nil, nil
+	}
+	return chain, nil
+}
+
+// helmOptions returns the helm options with the post render pipeline
+// of the toolchain config.
+func (tc *toolchain) helmOptions() (*helmclient.GenericHelmOptions, error) {
+	renderer, err := tc.postRenderer()
+	if err != nil || renderer == nil {
+		return nil, err
+	}
+	return &helmclient.GenericHelmOptions{PostRenderer: renderer}, nil
+}
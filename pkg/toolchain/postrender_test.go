@@ -0,0 +1,98 @@
+package toolchain
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const postRenderManifests = `# Source: test/templates/deployment.yaml
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: test
+  labels:
+    team: platform
+spec:
+  selector:
+    matchLabels:
+      app: test
+  template:
+    metadata:
+      labels:
+        app: test
+    spec:
+      containers:
+      - name: test
+        image: nginx:1.23
+---
+# Source: test/templates/service.yaml
+apiVersion: v1
+kind: Service
+metadata:
+  name: test
+spec:
+  ports:
+  - port: 80
+`
+
+func TestPostRenderer(t *testing.T) {
+	tc := &toolchain{config: &toolchainConfig{
+		RegistryMirror: "registry.internal",
+		PostRender: &postRenderConfig{
+			Labels:      map[string]string{"team": "trustacks", "org": "example"},
+			Annotations: map[string]string{"example.com/owner": "platform"},
+			Kustomize:   filepath.Join("testdata", "kustomize"),
+			Exec:        &execConfig{Command: "cat"},
+		},
+	}}
+	renderer, err := tc.postRenderer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := renderer.Run(bytes.NewBufferString(postRenderManifests))
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects, err := decodeManifests(out.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, objects, 2)
+	for _, obj := range objects {
+		metadata := obj["metadata"].(map[string]interface{})
+		assert.Equal(t, "example", metadata["labels"].(map[string]interface{})["org"], "expected the org label")
+		assert.Equal(t, "platform", metadata["annotations"].(map[string]interface{})["example.com/owner"], "expected the owner annotation")
+		if obj["kind"] != "Deployment" {
+			continue
+		}
+		assert.Equal(t, "platform", metadata["labels"].(map[string]interface{})["team"], "expected the existing label to be kept")
+		template := obj["spec"].(map[string]interface{})["template"].(map[string]interface{})
+		assert.Equal(t, "example", template["metadata"].(map[string]interface{})["labels"].(map[string]interface{})["org"], "expected the pod template label")
+		spec := template["spec"].(map[string]interface{})
+		assert.Equal(t, map[string]interface{}{"runAsNonRoot": true}, spec["securityContext"], "expected the kustomize patch")
+		container := spec["containers"].([]interface{})[0].(map[string]interface{})
+		assert.Equal(t, "registry.internal/docker.io/library/nginx:1.23", container["image"], "expected the image to be mirrored last")
+	}
+
+	renderer, err = (&toolchain{}).postRenderer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, renderer, "expected no post renderer without config")
+
+	tc = &toolchain{config: &toolchainConfig{PostRender: &postRenderConfig{Exec: &execConfig{Command: "trustacks-missing-post-renderer"}}}}
+	_, err = tc.helmOptions()
+	assert.Error(t, err, "expected an error for a missing executable")
+}
+
+func TestPostRenderResolvePaths(t *testing.T) {
+	config := &postRenderConfig{Kustomize: "/overlays/prod", Exec: &execConfig{Command: "render"}}
+	if err := config.resolvePaths("configs"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "/overlays/prod", config.Kustomize, "expected the absolute kustomize path to be kept")
+	assert.Equal(t, "render", config.Exec.Command, "expected the bare command to be looked up on the path")
+}
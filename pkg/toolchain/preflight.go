@@ -0,0 +1,577 @@
+package toolchain
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/version"
+	"k8s.io/client-go/kubernetes"
+)
+
+// defaultStorageClassAnnotation marks the default storage class.
+const defaultStorageClassAnnotation = "storageclass.kubernetes.io/is-default-class"
+
+// defaultStorageClass is the storage class requirement of a default
+// storage class.
+const defaultStorageClass = "default"
+
+// installPermissions are the permissions that every install needs in
+// the toolchain namespace.
+var installPermissions = []string{
+	"create secrets",
+	"create configmaps",
+	"create services",
+	"create serviceaccounts",
+	"create deployments.apps",
+	"create statefulsets.apps",
+	"create jobs.batch",
+	"create roles.rbac.authorization.k8s.io",
+	"create rolebindings.rbac.authorization.k8s.io",
+}
+
+// requirements are the cluster requirements of a catalog or a
+// component.
+type requirements struct {
+	// KubernetesVersion is the minimum kubernetes version.
+	KubernetesVersion string `json:"kubernetesVersion,omitempty"`
+	// APIs are the required <group>/<version> or
+	// <group>/<version>/<kind> apis, such as custom resources.
+	APIs []string `json:"apis,omitempty"`
+	// StorageClasses are the required storage class names. "default"
+	// requires a default storage class.
+	StorageClasses []string `json:"storageClasses,omitempty"`
+	// IngressClass requires an installed ingress controller.
+	IngressClass bool `json:"ingressClass,omitempty"`
+	// Permissions are the required "<verb> <resource>[.<group>]"
+	// permissions of the installing user.
+	Permissions []string `json:"permissions,omitempty"`
+	// CPU is the minimum allocatable cpu of the schedulable nodes.
+	CPU string `json:"cpu,omitempty"`
+	// Memory is the minimum allocatable memory of the schedulable
+	// nodes.
+	Memory string `json:"memory,omitempty"`
+}
+
+// merge adds the other requirements. The highest version is kept and
+// the capacities are summed.
+func (r *requirements) merge(other *requirements) error {
+	if other == nil {
+		return nil
+	}
+	if other.KubernetesVersion != "" {
+		v, err := version.ParseGeneric(other.KubernetesVersion)
+		if err != nil {
+			return fmt.Errorf("invalid kubernetes version '%s': %s", other.KubernetesVersion, err)
+		}
+		if r.KubernetesVersion == "" || !version.MustParseGeneric(r.KubernetesVersion).AtLeast(v) {
+			r.KubernetesVersion = other.KubernetesVersion
+		}
+	}
+	for _, list := range []struct {
+		merged *[]string
+		values []string
+	}{{&r.APIs, other.APIs}, {&r.StorageClasses, other.StorageClasses}, {&r.Permissions, other.Permissions}} {
+		if len(list.values) > 0 {
+			*list.merged = uniqueStrings(append(*list.merged, list.values...))
+		}
+	}
+	r.IngressClass = r.IngressClass || other.IngressClass
+	for _, capacity := range []struct {
+		total *string
+		value string
+	}{{&r.CPU, other.CPU}, {&r.Memory, other.Memory}} {
+		if capacity.value == "" {
+			continue
+		}
+		q, err := resource.ParseQuantity(capacity.value)
+		if err != nil {
+			return fmt.Errorf("invalid capacity '%s': %s", capacity.value, err)
+		}
+		if *capacity.total != "" {
+			q.Add(resource.MustParse(*capacity.total))
+		}
+		*capacity.total = q.String()
+	}
+	return nil
+}
+
+// addRequirements merges the requirements of the catalog and of the
+// components into the requirements of their cluster targets.
+func (tc *toolchain) addRequirements(reqs map[string]*requirements, components []string, catalog *componentCatalog) error {
+	for _, name := range components {
+		clusterName := tc.clusterName(name)
+		if reqs[clusterName] == nil {
+			reqs[clusterName] = &requirements{}
+		}
+		if err := reqs[clusterName].merge(catalog.Components[name].Requirements); err != nil {
+			return fmt.Errorf("component '%s': %s", name, err)
+		}
+	}
+	clusters := map[string]bool{}
+	for _, name := range components {
+		clusters[tc.clusterName(name)] = true
+	}
+	for clusterName := range clusters {
+		if err := reqs[clusterName].merge(catalog.Requirements); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PreflightResult is the result of a pre-flight check.
+type PreflightResult struct {
+	// Cluster is the display name of the cluster target.
+	Cluster string
+	// Check is the name of the check.
+	Check string
+	// Passed is true if the cluster meets the requirement.
+	Passed bool
+	// Message describes the result and how to fix a failure.
+	Message string
+}
+
+// String returns a one line description of the result.
+func (r PreflightResult) String() string {
+	status := "PASS"
+	if !r.Passed {
+		status = "FAIL"
+	}
+	return fmt.Sprintf("[%s] %s %s: %s", r.Cluster, status, r.Check, r.Message)
+}
+
+// preflightChecks runs the checks of the requirements against the
+// cluster.
+type preflightChecks struct {
+	ctx       context.Context
+	clientset kubernetes.Interface
+	namespace *namespaceConfig
+	// footprint is the resource footprint of the components.
+	footprint *footprint
+	results   []PreflightResult
+}
+
+// add records a check result.
+func (p *preflightChecks) add(check string, passed bool, format string, args ...interface{}) {
+	p.results = append(p.results, PreflightResult{Check: check, Passed: passed, Message: fmt.Sprintf(format, args...)})
+}
+
+// run runs the checks and returns their results.
+func (p *preflightChecks) run(req *requirements) []PreflightResult {
+	if req == nil {
+		req = &requirements{}
+	}
+	info, err := p.clientset.Discovery().ServerVersion()
+	if err != nil {
+		p.add("connectivity", false, "the cluster is unreachable: %s. check the kubeconfig context of the cluster target", err)
+		return p.results
+	}
+	p.checkVersion(info.GitVersion, req.KubernetesVersion)
+	p.checkNamespace()
+	p.checkAPIs(req.APIs)
+	p.checkStorageClasses(req.StorageClasses)
+	if req.IngressClass {
+		p.checkIngressClass()
+	}
+	p.checkPermissions(append(append([]string{}, installPermissions...), req.Permissions...))
+	p.checkCapacity(req.CPU, req.Memory)
+	p.checkFootprint()
+	return p.results
+}
+
+// checkVersion checks the minimum kubernetes version.
+func (p *preflightChecks) checkVersion(serverVersion, minVersion string) {
+	if minVersion == "" {
+		return
+	}
+	server, err := version.ParseGeneric(serverVersion)
+	if err != nil {
+		p.add("kubernetes version", false, "error parsing the server version '%s': %s", serverVersion, err)
+		return
+	}
+	min, err := version.ParseGeneric(minVersion)
+	if err != nil {
+		p.add("kubernetes version", false, "invalid minimum version '%s': %s", minVersion, err)
+		return
+	}
+	if !server.AtLeast(min) {
+		p.add("kubernetes version", false, "kubernetes %s is older than the required %s. upgrade the cluster", serverVersion, minVersion)
+		return
+	}
+	p.add("kubernetes version", true, "kubernetes %s meets the required %s", serverVersion, minVersion)
+}
+
+// checkNamespace checks that an existing namespace exists.
+func (p *preflightChecks) checkNamespace() {
+	if !p.namespace.Existing {
+		return
+	}
+	_, err := p.clientset.CoreV1().Namespaces().Get(p.ctx, p.namespace.Name, metav1.GetOptions{})
+	switch {
+	case errors.IsNotFound(err):
+		p.add("namespace", false, "the existing namespace '%s' does not exist. create it or unset namespace.existing", p.namespace.Name)
+	case err != nil:
+		p.add("namespace", false, "error reading namespace '%s': %s", p.namespace.Name, err)
+	default:
+		p.add("namespace", true, "namespace '%s' exists", p.namespace.Name)
+	}
+}
+
+// checkAPIs checks that the apis are served.
+func (p *preflightChecks) checkAPIs(apis []string) {
+	for _, api := range apis {
+		groupVersion, kind := api, ""
+		if parts := strings.Split(api, "/"); len(parts) == 3 || (len(parts) == 2 && parts[0] == "v1") {
+			groupVersion, kind = strings.Join(parts[:len(parts)-1], "/"), parts[len(parts)-1]
+		}
+		resources, err := p.clientset.Discovery().ServerResourcesForGroupVersion(groupVersion)
+		if err != nil {
+			p.add("api", false, "the %s api is not served. install the controller or custom resource definitions that provide it", api)
+			continue
+		}
+		found := kind == ""
+		for _, r := range resources.APIResources {
+			found = found || r.Kind == kind
+		}
+		if !found {
+			p.add("api", false, "the %s kind is not served by %s. install the custom resource definitions that provide it", kind, groupVersion)
+			continue
+		}
+		p.add("api", true, "%s is served", api)
+	}
+}
+
+// checkStorageClasses checks that the storage classes exist.
+func (p *preflightChecks) checkStorageClasses(storageClasses []string) {
+	if len(storageClasses) == 0 {
+		return
+	}
+	list, err := p.clientset.StorageV1().StorageClasses().List(p.ctx, metav1.ListOptions{})
+	if err != nil {
+		p.add("storage class", false, "error listing the storage classes: %s", err)
+		return
+	}
+	names := map[string]bool{}
+	for _, sc := range list.Items {
+		names[sc.Name] = true
+		if sc.Annotations[defaultStorageClassAnnotation] == "true" {
+			names[defaultStorageClass] = true
+		}
+	}
+	for _, name := range storageClasses {
+		switch {
+		case names[name]:
+			p.add("storage class", true, "storage class '%s' exists", name)
+		case name == defaultStorageClass:
+			p.add("storage class", false, "no default storage class is set. annotate a storage class with %s=true", defaultStorageClassAnnotation)
+		default:
+			p.add("storage class", false, "storage class '%s' does not exist. create it or install its provisioner", name)
+		}
+	}
+}
+
+// checkIngressClass checks that an ingress controller is installed.
+func (p *preflightChecks) checkIngressClass() {
+	list, err := p.clientset.NetworkingV1().IngressClasses().List(p.ctx, metav1.ListOptions{})
+	if err != nil {
+		p.add("ingress class", false, "error listing the ingress classes: %s", err)
+		return
+	}
+	if len(list.Items) == 0 {
+		p.add("ingress class", false, "no ingress class is installed. install an ingress controller such as ingress-nginx")
+		return
+	}
+	p.add("ingress class", true, "ingress class '%s' is installed", list.Items[0].Name)
+}
+
+// resourceScopes returns whether the resources of the cluster are
+// namespaced, keyed by <resource>.<group>.
+func (p *preflightChecks) resourceScopes() map[string]bool {
+	scopes := map[string]bool{}
+	// partial discovery failures of aggregated apis are ignored.
+	_, lists, _ := p.clientset.Discovery().ServerGroupsAndResources()
+	for _, list := range lists {
+		gv, err := schema.ParseGroupVersion(list.GroupVersion)
+		if err != nil {
+			continue
+		}
+		for _, r := range list.APIResources {
+			scopes[strings.TrimSuffix(r.Name+"."+gv.Group, ".")] = r.Namespaced
+		}
+	}
+	return scopes
+}
+
+// checkPermissions checks the permissions of the current user with
+// self subject access reviews. Unknown resources are namespaced.
+func (p *preflightChecks) checkPermissions(permissions []string) {
+	scopes := p.resourceScopes()
+	if _, err := p.clientset.CoreV1().Namespaces().Get(p.ctx, p.namespace.Name, metav1.GetOptions{}); errors.IsNotFound(err) {
+		permissions = append([]string{"create namespaces"}, permissions...)
+	}
+	var denied []string
+	for _, permission := range permissions {
+		verb, target, ok := strings.Cut(permission, " ")
+		if !ok {
+			p.add("permissions", false, "invalid permission '%s'. use '<verb> <resource>[.<group>]'", permission)
+			continue
+		}
+		resourceName, group, _ := strings.Cut(target, ".")
+		attributes := &authorizationv1.ResourceAttributes{Verb: verb, Group: group, Resource: resourceName}
+		if namespaced, ok := scopes[target]; !ok || namespaced {
+			attributes.Namespace = p.namespace.Name
+		}
+		review, err := p.clientset.AuthorizationV1().SelfSubjectAccessReviews().Create(p.ctx, &authorizationv1.SelfSubjectAccessReview{
+			Spec: authorizationv1.SelfSubjectAccessReviewSpec{ResourceAttributes: attributes},
+		}, metav1.CreateOptions{})
+		if err != nil {
+			p.add("permissions", false, "error reviewing '%s': %s", permission, err)
+			continue
+		}
+		if !review.Status.Allowed {
+			denied = append(denied, permission)
+		}
+	}
+	if len(denied) > 0 {
+		p.add("permissions", false, "the current user is denied: %s. grant the permissions or use another kubeconfig context", strings.Join(denied, ", "))
+		return
+	}
+	p.add("permissions", true, "the current user has the install permissions")
+}
+
+// schedulableNodes returns the ready and schedulable nodes.
+func schedulableNodes(ctx context.Context, clientset kubernetes.Interface) ([]corev1.Node, error) {
+	nodes, err := clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var schedulable []corev1.Node
+	for _, node := range nodes.Items {
+		if !node.Spec.Unschedulable && nodeReady(node) {
+			schedulable = append(schedulable, node)
+		}
+	}
+	return schedulable, nil
+}
+
+// allocatable returns the allocatable capacity of the nodes.
+func allocatable(nodes []corev1.Node) corev1.ResourceList {
+	total := corev1.ResourceList{corev1.ResourceCPU: resource.Quantity{}, corev1.ResourceMemory: resource.Quantity{}}
+	for _, node := range nodes {
+		for _, name := range []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory} {
+			q := total[name]
+			q.Add(node.Status.Allocatable[name])
+			total[name] = q
+		}
+	}
+	return total
+}
+
+// nodeRequests returns the requests of the running and pending pods
+// of the nodes. The pods of the excluded namespace are not counted.
+func nodeRequests(ctx context.Context, clientset kubernetes.Interface, nodes []corev1.Node, exclude string) (corev1.ResourceList, error) {
+	pods, err := clientset.CoreV1().Pods("").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]bool{}
+	for _, node := range nodes {
+		names[node.Name] = true
+	}
+	var cpu, memory resource.Quantity
+	for _, pod := range pods.Items {
+		if pod.Namespace == exclude || !names[pod.Spec.NodeName] || pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		podCPU, podMemory := podRequests(&pod.Spec)
+		cpu.Add(podCPU)
+		memory.Add(podMemory)
+	}
+	return corev1.ResourceList{corev1.ResourceCPU: cpu, corev1.ResourceMemory: memory}, nil
+}
+
+// nodeReady returns true if the node has a ready condition.
+func nodeReady(node corev1.Node) bool {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == corev1.NodeReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// checkCapacity checks the allocatable capacity of the nodes.
+func (p *preflightChecks) checkCapacity(cpu, memory string) {
+	if cpu == "" && memory == "" {
+		return
+	}
+	nodes, err := schedulableNodes(p.ctx, p.clientset)
+	if err != nil {
+		p.add("capacity", false, "error listing the nodes: %s", err)
+		return
+	}
+	total := allocatable(nodes)
+	for _, required := range []struct {
+		name  corev1.ResourceName
+		value string
+	}{{corev1.ResourceCPU, cpu}, {corev1.ResourceMemory, memory}} {
+		if required.value == "" {
+			continue
+		}
+		q, err := resource.ParseQuantity(required.value)
+		if err != nil {
+			p.add("capacity", false, "invalid %s requirement '%s': %s", required.name, required.value, err)
+			continue
+		}
+		available := total[required.name]
+		if available.Cmp(q) < 0 {
+			p.add("capacity", false, "the schedulable nodes have %s allocatable %s but %s is required. add nodes or use larger nodes", available.String(), required.name, q.String())
+			continue
+		}
+		p.add("capacity", true, "%s allocatable %s meets the required %s", available.String(), required.name, q.String())
+	}
+}
+
+// checkFootprint checks that the free capacity of the nodes fits the
+// requests of the component manifests. The free capacity is the
+// allocatable capacity less the requests of the pods outside of the
+// toolchain namespace, whose pods are replaced by the install. The
+// daemon set requests are counted on every node.
+func (p *preflightChecks) checkFootprint() {
+	if p.footprint == nil {
+		return
+	}
+	nodes, err := schedulableNodes(p.ctx, p.clientset)
+	if err != nil {
+		p.add("footprint", false, "error listing the nodes: %s", err)
+		return
+	}
+	used, err := nodeRequests(p.ctx, p.clientset, nodes, p.namespace.Name)
+	if err != nil {
+		p.add("footprint", false, "error listing the pods: %s", err)
+		return
+	}
+	total := allocatable(nodes)
+	cpu, memory := p.footprint.onNodes(len(nodes))
+	for _, requested := range []struct {
+		name     corev1.ResourceName
+		quantity resource.Quantity
+	}{{corev1.ResourceCPU, cpu}, {corev1.ResourceMemory, memory}} {
+		capacity := total[requested.name]
+		available := capacity.DeepCopy()
+		available.Sub(used[requested.name])
+		if available.Cmp(requested.quantity) < 0 {
+			p.add("footprint", false, "the components request %s %s but the schedulable nodes have %s free of %s allocatable. disable components, lower their requests or add nodes", requested.quantity.String(), requested.name, available.String(), capacity.String())
+			continue
+		}
+		p.add("footprint", true, "the components request %s of the %s free %s", requested.quantity.String(), available.String(), requested.name)
+	}
+}
+
+// preflight runs the pre-flight checks on each cluster target. The
+// component footprints of the cluster targets are compared with the
+// node capacity if they are set.
+func (tc *toolchain) preflight(ctx context.Context, reqs map[string]*requirements, footprints map[string]*footprint) ([]PreflightResult, error) {
+	var results []PreflightResult
+	for _, target := range tc.clusters() {
+		clientset, err := newClientset(target.config)
+		if err != nil {
+			return nil, err
+		}
+		checks := &preflightChecks{ctx: ctx, clientset: clientset, namespace: tc.namespaceConfig(), footprint: footprints[target.name]}
+		for _, result := range checks.run(reqs[target.name]) {
+			result.Cluster = clusterLabel(target.config)
+			results = append(results, result)
+		}
+	}
+	return results, nil
+}
+
+// preflightError returns an error listing the failed checks.
+func preflightError(results []PreflightResult) error {
+	var failed []string
+	for _, result := range results {
+		if !result.Passed {
+			failed = append(failed, result.String())
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	sort.Strings(failed)
+	return fmt.Errorf("the pre-flight checks failed:\n%s", strings.Join(failed, "\n"))
+}
+
+// PreflightOptions contains the pre-flight options.
+type PreflightOptions struct {
+	// Env is the environment overlay merged over the config file.
+	Env string
+	// Bundle is the path of an offline bundle.
+	Bundle string
+}
+
+// Preflight checks the cluster targets of the toolchain config against
+// the requirements of the toolchain catalogs.
+func Preflight(ctx context.Context, configPath string, cloneFunc func(string, bool, *git.CloneOptions) (*git.Repository, error), opts *PreflightOptions) ([]PreflightResult, error) {
+	if opts == nil {
+		opts = &PreflightOptions{}
+	}
+	config, err := loadToolchainConfig(configPath, opts.Env)
+	if err != nil {
+		return nil, fmt.Errorf("error loading the toolchain config: %s", err)
+	}
+	if err := validateClusters(config); err != nil {
+		return nil, fmt.Errorf("error validating the cluster targets: %s", err)
+	}
+	staging, err := os.MkdirTemp("", "toolchain-preflight")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(staging)
+	// the toolchain source is read outside of the toolchain root so
+	// that an installed toolchain is not modified.
+	tc := &toolchain{name: config.Name, root: staging, config: config}
+	if opts.Bundle != "" {
+		b, err := openBundle(opts.Bundle)
+		if err != nil {
+			return nil, fmt.Errorf("error opening the bundle: %s", err)
+		}
+		defer b.remove()
+		tc.bundle = b
+		cloneFunc = b.clone
+	}
+	if _, err := cloneFunc(filepath.Join(staging, config.Name), false, &git.CloneOptions{
+		URL:           config.Source,
+		Depth:         1,
+		SingleBranch:  true,
+		ReferenceName: plumbing.NewBranchReferenceName("main"),
+	}); err != nil {
+		return nil, fmt.Errorf("error cloning the toolchain source: %s", err)
+	}
+	if err := tc.readManifest(); err != nil {
+		return nil, err
+	}
+	reqs := map[string]*requirements{}
+	for _, dep := range tc.Dependencies {
+		catalog, err := tc.catalog(ctx, dep.Catalog)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching catalog: %s", err)
+		}
+		if err := tc.addRequirements(reqs, dep.Components, catalog); err != nil {
+			return nil, fmt.Errorf("error reading the catalog requirements: %s", err)
+		}
+	}
+	return tc.preflight(ctx, reqs, nil)
+}
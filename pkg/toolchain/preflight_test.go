@@ -0,0 +1,160 @@
+package toolchain
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/version"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func newPreflightClientset(objects ...runtime.Object) *fake.Clientset {
+	clientset := fake.NewSimpleClientset(objects...)
+	discovery := clientset.Discovery().(*fakediscovery.FakeDiscovery)
+	discovery.FakedServerVersion = &version.Info{GitVersion: "v1.23.4+k3s1"}
+	discovery.Resources = []*metav1.APIResourceList{
+		{GroupVersion: "v1", APIResources: []metav1.APIResource{{Name: "secrets", Kind: "Secret", Namespaced: true}, {Name: "namespaces", Kind: "Namespace"}}},
+		{GroupVersion: "cert-manager.io/v1", APIResources: []metav1.APIResource{{Name: "certificates", Kind: "Certificate", Namespaced: true}}},
+		{GroupVersion: "apiextensions.k8s.io/v1", APIResources: []metav1.APIResource{{Name: "customresourcedefinitions", Kind: "CustomResourceDefinition"}}},
+	}
+	// the current user may do anything but create cluster roles.
+	clientset.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+		review.Status.Allowed = review.Spec.ResourceAttributes.Resource != "clusterroles"
+		return true, review, nil
+	})
+	return clientset
+}
+
+func newPreflightNode(name, cpu, memory string, ready bool) *corev1.Node {
+	status := corev1.ConditionTrue
+	if !ready {
+		status = corev1.ConditionFalse
+	}
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status: corev1.NodeStatus{
+			Allocatable: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse(cpu), corev1.ResourceMemory: resource.MustParse(memory)},
+			Conditions:  []corev1.NodeCondition{{Type: corev1.NodeReady, Status: status}},
+		},
+	}
+}
+
+func failedChecks(results []PreflightResult) []string {
+	var failed []string
+	for _, result := range results {
+		if !result.Passed {
+			failed = append(failed, result.Check+": "+result.Message)
+		}
+	}
+	return failed
+}
+
+func TestRequirementsMerge(t *testing.T) {
+	req := &requirements{}
+	for _, other := range []*requirements{
+		{KubernetesVersion: "1.22", APIs: []string{"cert-manager.io/v1"}, CPU: "1", Memory: "1Gi"},
+		{KubernetesVersion: "1.21.3", APIs: []string{"cert-manager.io/v1", "apps/v1"}, CPU: "500m", IngressClass: true},
+		nil,
+	} {
+		if err := req.merge(other); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assert.Equal(t, &requirements{
+		KubernetesVersion: "1.22",
+		APIs:              []string{"apps/v1", "cert-manager.io/v1"},
+		IngressClass:      true,
+		CPU:               "1500m",
+		Memory:            "1Gi",
+	}, req)
+	assert.Error(t, req.merge(&requirements{KubernetesVersion: "latest"}))
+}
+
+func TestAddRequirements(t *testing.T) {
+	tc := &toolchain{name: "test", config: &toolchainConfig{
+		Clusters: map[string]clusterConfig{"edge": {Components: []string{"argo"}}},
+	}}
+	catalog := &componentCatalog{
+		Requirements: &requirements{KubernetesVersion: "1.22"},
+		Components: map[string]component{
+			"argo":   {Requirements: &requirements{CPU: "1"}},
+			"sso":    {Requirements: &requirements{StorageClasses: []string{"default"}}},
+			"plain":  {},
+			"unused": {Requirements: &requirements{IngressClass: true}},
+		},
+	}
+	reqs := map[string]*requirements{}
+	if err := tc.addRequirements(reqs, []string{"argo", "sso", "plain"}, catalog); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, &requirements{KubernetesVersion: "1.22", CPU: "1"}, reqs["edge"])
+	assert.Equal(t, &requirements{KubernetesVersion: "1.22", StorageClasses: []string{"default"}}, reqs[""])
+}
+
+func TestPreflightChecks(t *testing.T) {
+	defaultClass := &storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: "local-path", Annotations: map[string]string{defaultStorageClassAnnotation: "true"}}}
+	clientset := newPreflightClientset(
+		defaultClass,
+		newPreflightNode("ready", "2", "4Gi", true),
+		newPreflightNode("not-ready", "8", "32Gi", false),
+	)
+	checks := &preflightChecks{ctx: context.TODO(), clientset: clientset, namespace: &namespaceConfig{Name: "trustacks"}}
+	results := checks.run(&requirements{
+		KubernetesVersion: "1.22",
+		APIs:              []string{"cert-manager.io/v1/Certificate", "v1/Secret"},
+		StorageClasses:    []string{"default", "local-path"},
+		Permissions:       []string{"create customresourcedefinitions.apiextensions.k8s.io"},
+		CPU:               "2",
+		Memory:            "2Gi",
+	})
+	assert.Empty(t, failedChecks(results))
+
+	checks = &preflightChecks{ctx: context.TODO(), clientset: clientset, namespace: &namespaceConfig{Name: "trustacks", Existing: true}}
+	results = checks.run(&requirements{
+		KubernetesVersion: "1.24",
+		APIs:              []string{"monitoring.coreos.com/v1", "cert-manager.io/v1/Issuer"},
+		StorageClasses:    []string{"fast"},
+		IngressClass:      true,
+		Permissions:       []string{"create clusterroles.rbac.authorization.k8s.io"},
+		CPU:               "4",
+	})
+	failed := failedChecks(results)
+	assert.Len(t, failed, 8)
+	for _, expected := range []string{
+		"kubernetes version: kubernetes v1.23.4+k3s1 is older than the required 1.24",
+		"namespace: the existing namespace 'trustacks' does not exist",
+		"api: the monitoring.coreos.com/v1 api is not served",
+		"api: the Issuer kind is not served by cert-manager.io/v1",
+		"storage class: storage class 'fast' does not exist",
+		"ingress class: no ingress class is installed",
+		"permissions: the current user is denied: create clusterroles.rbac.authorization.k8s.io",
+		"capacity: the schedulable nodes have 2 allocatable cpu but 4 is required",
+	} {
+		found := false
+		for _, f := range failed {
+			found = found || strings.HasPrefix(f, expected)
+		}
+		assert.True(t, found, "expected failure: %s", expected)
+	}
+}
+
+func TestPreflightChecksDefaults(t *testing.T) {
+	clientset := newPreflightClientset(&networkingv1.IngressClass{ObjectMeta: metav1.ObjectMeta{Name: "nginx"}})
+	checks := &preflightChecks{ctx: context.TODO(), clientset: clientset, namespace: &namespaceConfig{Name: "trustacks"}}
+	results := checks.run(&requirements{StorageClasses: []string{"default"}, IngressClass: true})
+	assert.Equal(t, []string{"storage class: no default storage class is set. annotate a storage class with storageclass.kubernetes.io/is-default-class=true"}, failedChecks(results))
+	assert.NoError(t, preflightError(nil))
+	assert.Error(t, preflightError(results))
+}
@@ -0,0 +1,164 @@
+package toolchain
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	helmclient "github.com/mittwald/go-helm-client"
+	"github.com/sirupsen/logrus"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/release"
+)
+
+// pendingStates is the mask of the intermediate helm release states.
+const pendingStates = action.ListPendingInstall | action.ListPendingUpgrade | action.ListPendingRollback | action.ListUninstalling
+
+// pendingReleases returns the releases in the namespace of the cluster
+// that are in an intermediate state.
+func pendingReleases(namespace string, cluster *clusterConfig) ([]*release.Release, error) {
+	helmClient, err := newHelmClient(namespace, cluster)
+	if err != nil {
+		return nil, err
+	}
+	releases, err := helmClient.ListReleasesByStateMask(pendingStates)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(releases, func(i, j int) bool {
+		return releases[i].Name < releases[j].Name
+	})
+	return releases, nil
+}
+
+// describeReleases returns a summary of the release names and states.
+func describeReleases(releases []*release.Release) string {
+	summary := make([]string, 0, len(releases))
+	for _, rel := range releases {
+		summary = append(summary, fmt.Sprintf("%s (%s)", rel.Name, rel.Info.Status))
+	}
+	return strings.Join(summary, ", ")
+}
+
+// withInterruptedReleases wraps the error returned by an interrupted
+// operation with the releases that were left in an intermediate state
+// in the namespaces of the clusters.
+func withInterruptedReleases(err error, namespaces []*namespaceConfig, clusters []clusterTarget) error {
+	releases := []*release.Release{}
+	for _, target := range clusters {
+		for _, namespace := range namespaces {
+			pending, listErr := pendingReleases(namespace.Name, target.config)
+			if listErr != nil {
+				logger.WithField("cluster", clusterLabel(target.config)).Debugf("error listing the pending releases: %s", listErr)
+				return fmt.Errorf("%s: the release states could not be verified", err)
+			}
+			releases = append(releases, pending...)
+		}
+	}
+	if len(releases) == 0 {
+		return err
+	}
+	return fmt.Errorf("%s: releases left in an intermediate state: %s", err, describeReleases(releases))
+}
+
+// ConfirmFunc asks for the confirmation of an action described by the
+// message.
+type ConfirmFunc func(message string) bool
+
+// repair actions.
+const (
+	repairRollback  = "rollback"
+	repairUninstall = "uninstall"
+)
+
+// repairAction returns the action that recovers the stuck release.
+//
+// Releases with a previous revision are rolled back to it. Releases
+// without one, or that were being uninstalled, are uninstalled.
+func repairAction(rel *release.Release) string {
+	if rel.Info.Status == release.StatusUninstalling || rel.Version <= 1 {
+		return repairUninstall
+	}
+	return repairRollback
+}
+
+// repairReleases recovers the releases stuck in an intermediate state
+// in the namespace of the cluster, and returns the names of the
+// repaired releases.
+func repairReleases(ctx context.Context, namespace string, cluster *clusterConfig, confirm ConfirmFunc) ([]string, error) {
+	releases, err := pendingReleases(namespace, cluster)
+	if err != nil {
+		return nil, err
+	}
+	helmClient, err := newHelmClient(namespace, cluster)
+	if err != nil {
+		return nil, err
+	}
+	repaired := []string{}
+	for _, rel := range releases {
+		op := repairAction(rel)
+		if !confirm(fmt.Sprintf("%s release '%s' (%s, revision %d)", op, rel.Name, rel.Info.Status, rel.Version)) {
+			logger.WithField("release", rel.Name).Warn("skipping the release repair")
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return repaired, err
+		}
+		logger.WithFields(logrus.Fields{"release": rel.Name, "action": op}).Info("repairing the release")
+		spec := &helmclient.ChartSpec{ReleaseName: rel.Name, Namespace: namespace}
+		err := withContext(ctx, func() error {
+			if op == repairRollback {
+				return helmClient.RollbackRelease(spec)
+			}
+			return helmClient.UninstallRelease(spec)
+		})
+		if err != nil {
+			return repaired, fmt.Errorf("error repairing release '%s': %s", rel.Name, err)
+		}
+		repaired = append(repaired, rel.Name)
+	}
+	return repaired, nil
+}
+
+// withContext runs fn and returns its error, or the context error if
+// the context is done first. The helm client rollback and uninstall do
+// not take a context, so they are left to finish in the background
+// when they are interrupted.
+func withContext(ctx context.Context, fn func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Repair recovers the toolchain and application releases stuck in an
+// intermediate state in all of the toolchain clusters. confirm is
+// called before each release is rolled back or uninstalled.
+func Repair(ctx context.Context, name string, confirm ConfirmFunc) ([]string, error) {
+	tc, err := newToolchainFromConfig(name)
+	if err != nil {
+		logger.Debugf("error loading the toolchain config: %s", err)
+		tc = &toolchain{name: name}
+	}
+	repaired := []string{}
+	for _, target := range tc.clusters() {
+		for _, namespace := range tc.namespaces() {
+			if err := ctx.Err(); err != nil {
+				return repaired, err
+			}
+			r, err := repairReleases(ctx, namespace.Name, target.config, confirm)
+			repaired = append(repaired, r...)
+			if err != nil {
+				return repaired, err
+			}
+		}
+	}
+	return repaired, nil
+}
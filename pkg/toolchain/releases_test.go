@@ -0,0 +1,50 @@
+package toolchain
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"helm.sh/helm/v3/pkg/release"
+)
+
+func TestDescribeReleases(t *testing.T) {
+	releases := []*release.Release{
+		{Name: "concourse", Info: &release.Info{Status: release.StatusPendingInstall}},
+		{Name: "authentik", Info: &release.Info{Status: release.StatusPendingUpgrade}},
+	}
+	assert.Equal(t, "concourse (pending-install), authentik (pending-upgrade)", describeReleases(releases), "got an unexpected releases summary")
+}
+
+func TestRepairAction(t *testing.T) {
+	tests := []struct {
+		status  release.Status
+		version int
+		action  string
+	}{
+		{release.StatusPendingInstall, 1, repairUninstall},
+		{release.StatusPendingUpgrade, 3, repairRollback},
+		{release.StatusPendingRollback, 4, repairRollback},
+		{release.StatusUninstalling, 2, repairUninstall},
+	}
+	for _, test := range tests {
+		rel := &release.Release{Name: "test", Version: test.version, Info: &release.Info{Status: test.status}}
+		assert.Equal(t, test.action, repairAction(rel), "got an unexpected repair action for '%s'", test.status)
+	}
+}
+
+func TestWithContext(t *testing.T) {
+	err := withContext(context.TODO(), func() error { return errors.New("failed") })
+	assert.EqualError(t, err, "failed", "expected the function error")
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancel()
+	block := make(chan struct{})
+	defer close(block)
+	err = withContext(ctx, func() error {
+		<-block
+		return nil
+	})
+	assert.ErrorIs(t, err, context.Canceled, "expected the blocked function to be interrupted")
+}
@@ -0,0 +1,194 @@
+package toolchain
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	helmclient "github.com/mittwald/go-helm-client"
+	"gopkg.in/yaml.v3"
+)
+
+// renderChart renders the chart manifests, including the hooks,
+// without connecting to a cluster.
+func renderChart(releaseName, chartPath, namespace, values string) ([]byte, error) {
+	client, err := helmclient.New(&helmclient.Options{
+		Namespace: namespace,
+		DebugLog:  helmDebugLog,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return client.TemplateChart(&helmclient.ChartSpec{
+		ReleaseName: releaseName,
+		ChartName:   chartPath,
+		Namespace:   namespace,
+		ValuesYaml:  values,
+	})
+}
+
+// decodeManifests decodes the objects of a multi document manifest.
+func decodeManifests(manifests []byte) ([]map[string]interface{}, error) {
+	var objects []map[string]interface{}
+	decoder := yaml.NewDecoder(bytes.NewReader(manifests))
+	for {
+		var obj map[string]interface{}
+		if err := decoder.Decode(&obj); err != nil {
+			if errors.Is(err, io.EOF) {
+				return objects, nil
+			}
+			return nil, err
+		}
+		if obj != nil {
+			objects = append(objects, obj)
+		}
+	}
+}
+
+// containerFields are the pod spec fields that list containers.
+var containerFields = map[string]bool{
+	"containers":          true,
+	"initContainers":      true,
+	"ephemeralContainers": true,
+}
+
+// walkImages calls fn with the image of every container of the pod
+// specs in the object and replaces the image with the returned value.
+// The image keys outside of the container lists, such as configmap
+// data, are left unchanged.
+func walkImages(obj interface{}, fn func(string) string) {
+	switch o := obj.(type) {
+	case map[string]interface{}:
+		for k, v := range o {
+			if containers, ok := v.([]interface{}); ok && containerFields[k] {
+				for _, c := range containers {
+					container, ok := c.(map[string]interface{})
+					if !ok {
+						continue
+					}
+					if image, ok := container["image"].(string); ok {
+						container["image"] = fn(image)
+					}
+				}
+				continue
+			}
+			walkImages(v, fn)
+		}
+	case []interface{}:
+		for _, v := range o {
+			walkImages(v, fn)
+		}
+	}
+}
+
+// walkValueImages calls fn with every image key of the chart values
+// and replaces the image with the returned value.
+//
+// The image keys are either image references or maps of the
+// registry, the repository and the tag of the image. The registry and
+// the repository of a map are passed to fn as one reference and split
+// again at the first path segment of the returned reference.
+func walkValueImages(obj interface{}, fn func(string) string) {
+	switch o := obj.(type) {
+	case map[string]interface{}:
+		for k, v := range o {
+			if k != "image" {
+				walkValueImages(v, fn)
+				continue
+			}
+			switch image := v.(type) {
+			case string:
+				o[k] = fn(image)
+			case map[string]interface{}:
+				walkImageMap(image, fn)
+			default:
+				walkValueImages(v, fn)
+			}
+		}
+	case []interface{}:
+		for _, v := range o {
+			walkValueImages(v, fn)
+		}
+	}
+}
+
+// walkImageMap replaces the registry and the repository of the image
+// map with the image reference returned by fn.
+func walkImageMap(image map[string]interface{}, fn func(string) string) {
+	repository, ok := image["repository"].(string)
+	if !ok || repository == "" {
+		return
+	}
+	registry, hasRegistry := image["registry"].(string)
+	ref := repository
+	if registry != "" {
+		ref = registry + "/" + repository
+	}
+	rewritten := fn(ref)
+	if rewritten == ref {
+		return
+	}
+	if !hasRegistry {
+		image["repository"] = rewritten
+		return
+	}
+	parts := strings.SplitN(rewritten, "/", 2)
+	if len(parts) == 1 {
+		image["registry"] = ""
+		image["repository"] = rewritten
+		return
+	}
+	image["registry"] = parts[0]
+	image["repository"] = parts[1]
+}
+
+// manifestImages returns the sorted container images referenced in the
+// manifests.
+func manifestImages(manifests []byte) ([]string, error) {
+	objects, err := decodeManifests(manifests)
+	if err != nil {
+		return nil, err
+	}
+	var images []string
+	for _, obj := range objects {
+		walkImages(obj, func(image string) string {
+			if image != "" {
+				images = append(images, image)
+			}
+			return image
+		})
+	}
+	return uniqueStrings(images), nil
+}
+
+// uniqueStrings returns the sorted unique values.
+func uniqueStrings(values []string) []string {
+	seen := make(map[string]bool)
+	unique := []string{}
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			unique = append(unique, v)
+		}
+	}
+	sort.Strings(unique)
+	return unique
+}
+
+// renderComponent returns the manifests of the component. Helm charts
+// are rendered with the override values.
+func (tc *toolchain) renderComponent(name string) ([]byte, error) {
+	dir := filepath.Join(tc.componentsPath(), name)
+	if _, err := readComponentMetadata(dir); err == nil {
+		return os.ReadFile(filepath.Join(dir, manifestsFile))
+	}
+	values, err := os.ReadFile(filepath.Join(dir, "override-values.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	return renderChart(name, dir, tc.namespace(), string(values))
+}
@@ -0,0 +1,65 @@
+package toolchain
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderChart(t *testing.T) {
+	manifests, err := renderChart("helloworld", filepath.Join("testdata", "helloworld"), "trustacks", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	images, err := manifestImages(manifests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"tutum/hello-world:latest"}, images, "got unexpected chart images")
+}
+
+func TestManifestImages(t *testing.T) {
+	manifests := []byte(`apiVersion: apps/v1
+kind: Deployment
+spec:
+  template:
+    spec:
+      initContainers:
+      - image: busybox:1.35
+      containers:
+      - image: nginx:1.23
+      - image: busybox:1.35
+---
+# empty document
+---
+apiVersion: batch/v1
+kind: Job
+spec:
+  template:
+    spec:
+      containers:
+      - image: quay.io/trustacks/catalog:latest
+---
+apiVersion: v1
+kind: Pod
+spec:
+  ephemeralContainers:
+  - image: busybox:1.36
+---
+apiVersion: v1
+kind: ConfigMap
+data:
+  image: redis:7
+---
+apiVersion: example.com/v1
+kind: Database
+spec:
+  image: postgres:14
+`)
+	images, err := manifestImages(manifests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"busybox:1.35", "busybox:1.36", "nginx:1.23", "quay.io/trustacks/catalog:latest"}, images, "got unexpected manifest images")
+}
@@ -0,0 +1,283 @@
+package toolchain
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/containerd/containerd/remotes/docker"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/registry"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	dockerauth "oras.land/oras-go/pkg/auth/docker"
+	"oras.land/oras-go/pkg/content"
+	"oras.land/oras-go/pkg/oras"
+)
+
+// repositoryConfig contains the credentials and tls options of a chart
+// repository.
+type repositoryConfig struct {
+	// URL is the repository url. It applies to every component
+	// repository that it prefixes.
+	URL      string `json:"url"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// PasswordEnv is the environment variable containing the password.
+	PasswordEnv string `json:"passwordEnv" yaml:"passwordEnv"`
+	// PasswordFile is the file containing the password.
+	PasswordFile string `json:"passwordFile" yaml:"passwordFile"`
+	// PasswordSecret is the kubernetes secret key containing the
+	// password.
+	PasswordSecret *secretKeyRef `json:"passwordSecret" yaml:"passwordSecret"`
+	CAFile         string        `json:"caFile" yaml:"caFile"`
+	CertFile       string        `json:"certFile" yaml:"certFile"`
+	KeyFile        string        `json:"keyFile" yaml:"keyFile"`
+	// InsecureSkipTLSVerify skips the repository certificate
+	// verification.
+	InsecureSkipTLSVerify bool `json:"insecureSkipTLSVerify" yaml:"insecureSkipTLSVerify"`
+	// PlainHTTP connects to an oci registry over http.
+	PlainHTTP bool `json:"plainHTTP" yaml:"plainHTTP"`
+}
+
+// secretKeyRef references a key of a kubernetes secret in the default
+// cluster.
+type secretKeyRef struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Key       string `json:"key"`
+}
+
+// password resolves the repository password from the configured
+// source.
+func (r *repositoryConfig) password(ctx context.Context) (string, error) {
+	switch {
+	case r.PasswordEnv != "":
+		password, ok := os.LookupEnv(r.PasswordEnv)
+		if !ok {
+			return "", fmt.Errorf("environment variable '%s' is not set", r.PasswordEnv)
+		}
+		return password, nil
+	case r.PasswordFile != "":
+		data, err := os.ReadFile(r.PasswordFile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	case r.PasswordSecret != nil:
+		clientset, err := newClientset(nil)
+		if err != nil {
+			return "", err
+		}
+		secret, err := clientset.CoreV1().Secrets(r.PasswordSecret.Namespace).Get(ctx, r.PasswordSecret.Name, metav1.GetOptions{})
+		if err != nil {
+			return "", err
+		}
+		password, ok := secret.Data[r.PasswordSecret.Key]
+		if !ok {
+			return "", fmt.Errorf("key '%s' was not found in secret '%s/%s'", r.PasswordSecret.Key, r.PasswordSecret.Namespace, r.PasswordSecret.Name)
+		}
+		return string(password), nil
+	}
+	return r.Password, nil
+}
+
+// repository returns the repository config with the longest url
+// prefix of the chart repository url.
+func (tc *toolchain) repository(url string) *repositoryConfig {
+	if tc.config == nil {
+		return nil
+	}
+	var match *repositoryConfig
+	for i, r := range tc.config.Repositories {
+		prefix := strings.TrimSuffix(r.URL, "/")
+		if url != prefix && !strings.HasPrefix(url, prefix+"/") {
+			continue
+		}
+		if match == nil || len(prefix) > len(strings.TrimSuffix(match.URL, "/")) {
+			match = &tc.config.Repositories[i]
+		}
+	}
+	return match
+}
+
+// registryHost returns the host of the oci registry url.
+func registryHost(url string) string {
+	return strings.SplitN(strings.TrimPrefix(url, fmt.Sprintf("%s://", registry.OCIScheme)), "/", 2)[0]
+}
+
+// tlsConfig returns the tls config of the repository certificates.
+func (r *repositoryConfig) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if r == nil {
+		return config, nil
+	}
+	config.InsecureSkipVerify = r.InsecureSkipTLSVerify
+	if r.CertFile != "" || r.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(r.CertFile, r.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading the client certificate: %s", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if r.CAFile != "" {
+		pem, err := os.ReadFile(r.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading the ca file: %s", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates were found in '%s'", r.CAFile)
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+// pullChart downloads and extracts the component chart into the
+// components directory.
+//
+// Charts are pulled from oci:// registries by reference, and from
+// http repositories by the <repository>/<chart>-<version>.tgz url.
+func (tc *toolchain) pullChart(ctx context.Context, c component) error {
+	repo := tc.repository(c.Repo)
+	var username, password string
+	if repo != nil {
+		p, err := repo.password(ctx)
+		if err != nil {
+			return fmt.Errorf("error resolving the '%s' repository password: %s", repo.URL, err)
+		}
+		username, password = repo.Username, p
+	}
+	if registry.IsOCI(c.Repo) {
+		return tc.pullOCIChart(ctx, c, repo, username, password)
+	}
+
+	pull := action.NewPullWithOpts(action.WithConfig(&action.Configuration{}))
+	pull.Settings = cli.New()
+	pull.UntarDir = tc.componentsPath()
+	pull.Untar = true
+	if repo != nil {
+		pull.Username = username
+		pull.Password = password
+		pull.CaFile = repo.CAFile
+		pull.CertFile = repo.CertFile
+		pull.KeyFile = repo.KeyFile
+		pull.InsecureSkipTLSverify = repo.InsecureSkipTLSVerify
+	}
+	if _, err := pull.Run(fmt.Sprintf("%s/%s-%s.tgz", c.Repo, c.Chart, c.Version)); err != nil {
+		return err
+	}
+	return tc.removeChartArchive(c)
+}
+
+// pullOCIChart pulls the component chart from an oci registry.
+//
+// The helm registry client does not support the repository tls
+// options, so the chart layer is pulled with a resolver that uses the
+// repository certificates. The repository credentials are only sent to
+// the registry host. The other hosts use the helm registry and docker
+// credentials.
+func (tc *toolchain) pullOCIChart(ctx context.Context, c component, repo *repositoryConfig, username, password string) error {
+	tlsConfig, err := repo.tlsConfig()
+	if err != nil {
+		return fmt.Errorf("error configuring the '%s' repository tls: %s", c.Repo, err)
+	}
+	host := registryHost(c.Repo)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: tlsConfig,
+	}}
+	credentials := func(h string) (string, string, error) {
+		if username != "" && h == host {
+			return username, password, nil
+		}
+		return registryCredential(h)
+	}
+	resolver := docker.NewResolver(docker.ResolverOptions{
+		Hosts: docker.ConfigureDefaultRegistries(
+			docker.WithClient(client),
+			docker.WithPlainHTTP(func(string) (bool, error) {
+				return repo != nil && repo.PlainHTTP, nil
+			}),
+			docker.WithAuthorizer(docker.NewDockerAuthorizer(
+				docker.WithAuthClient(client),
+				docker.WithAuthCreds(credentials),
+			)),
+		),
+	})
+	ref := fmt.Sprintf("%s/%s:%s", strings.TrimPrefix(strings.TrimSuffix(c.Repo, "/"), fmt.Sprintf("%s://", registry.OCIScheme)), c.Chart, strings.ReplaceAll(c.Version, "+", "_"))
+	store := content.NewMemory()
+	var layers []ocispec.Descriptor
+	if _, err := oras.Copy(ctx, content.Registry{Resolver: resolver}, ref, store, "",
+		oras.WithPullEmptyNameAllowed(),
+		oras.WithAllowedMediaTypes([]string{registry.ConfigMediaType, registry.ChartLayerMediaType, registry.LegacyChartLayerMediaType}),
+		oras.WithLayerDescriptors(func(l []ocispec.Descriptor) {
+			layers = l
+		}),
+	); err != nil {
+		return fmt.Errorf("error pulling '%s': %s", ref, err)
+	}
+	for _, layer := range layers {
+		if layer.MediaType != registry.ChartLayerMediaType && layer.MediaType != registry.LegacyChartLayerMediaType {
+			continue
+		}
+		_, data, ok := store.Get(layer)
+		if !ok {
+			return fmt.Errorf("error pulling '%s': the chart layer was not fetched", ref)
+		}
+		archive := tc.chartArchivePath(c)
+		if err := os.MkdirAll(tc.componentsPath(), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(archive, data, 0644); err != nil {
+			return err
+		}
+		if err := chartutil.ExpandFile(tc.componentsPath(), archive); err != nil {
+			return err
+		}
+		return tc.removeChartArchive(c)
+	}
+	return fmt.Errorf("'%s' does not contain a chart layer", ref)
+}
+
+// registryCredential returns the helm registry or docker credentials
+// of the registry host.
+func registryCredential(host string) (string, string, error) {
+	client, err := dockerauth.NewClientWithDockerFallback(cli.New().RegistryConfig)
+	if err != nil {
+		logger.Debugf("error reading the registry credentials: %s", err)
+		return "", "", nil
+	}
+	username, password, err := client.(*dockerauth.Client).Credential(host)
+	if err != nil {
+		// the registry is accessed anonymously.
+		return "", "", nil
+	}
+	return username, password, nil
+}
+
+// chartArchivePath returns the path of the downloaded chart archive of
+// the component.
+func (tc *toolchain) chartArchivePath(c component) string {
+	return path.Join(tc.componentsPath(), fmt.Sprintf("%s-%s.tgz", path.Base(c.Chart), c.Version))
+}
+
+// removeChartArchive removes the chart archive of the component once
+// it is extracted.
+func (tc *toolchain) removeChartArchive(c component) error {
+	if err := os.Remove(tc.chartArchivePath(c)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package toolchain
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"helm.sh/helm/v3/pkg/registry"
+)
+
+func TestRepository(t *testing.T) {
+	tc := &toolchain{name: "test", config: &toolchainConfig{
+		Repositories: []repositoryConfig{
+			{URL: "https://harbor.example.com/chartrepo", Username: "robot"},
+			{URL: "https://harbor.example.com/chartrepo/platform/", Username: "platform"},
+		},
+	}}
+	r := tc.repository("https://harbor.example.com/chartrepo/platform")
+	if assert.NotNil(t, r) {
+		assert.Equal(t, "platform", r.Username, "expected the longest matching prefix")
+	}
+	r = tc.repository("https://harbor.example.com/chartrepo/library")
+	if assert.NotNil(t, r) {
+		assert.Equal(t, "robot", r.Username)
+	}
+	assert.Nil(t, tc.repository("https://harbor.example.com/chartrepository"), "expected prefixes to match on path boundaries")
+	assert.Nil(t, (&toolchain{name: "test"}).repository("https://charts.example.com"))
+}
+
+func TestRepositoryPassword(t *testing.T) {
+	r := &repositoryConfig{Password: "inline"}
+	password, err := r.password(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "inline", password)
+
+	t.Setenv("TEST_REPOSITORY_PASSWORD", "from-env")
+	r = &repositoryConfig{Password: "inline", PasswordEnv: "TEST_REPOSITORY_PASSWORD"}
+	password, err = r.password(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "from-env", password)
+
+	r = &repositoryConfig{PasswordEnv: "TEST_REPOSITORY_PASSWORD_UNSET"}
+	_, err = r.password(context.TODO())
+	assert.Error(t, err, "expected an error for an unset environment variable")
+
+	f := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(f, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	r = &repositoryConfig{PasswordFile: f}
+	password, err = r.password(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "from-file", password)
+}
+
+func TestRegistryHost(t *testing.T) {
+	assert.Equal(t, "harbor.example.com", registryHost("oci://harbor.example.com/trustacks/charts"))
+	assert.Equal(t, "localhost:5000", registryHost("oci://localhost:5000"))
+}
+
+// newTestRegistry starts a tls oci registry that serves the chart
+// archive as <name>:<version>.
+func newTestRegistry(t *testing.T, name, version string, chart []byte) *httptest.Server {
+	blobs := map[string][]byte{}
+	descriptor := func(mediaType string, data []byte) map[string]interface{} {
+		digest := fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+		blobs[digest] = data
+		return map[string]interface{}{"mediaType": mediaType, "digest": digest, "size": len(data)}
+	}
+	manifest, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+		"config":        descriptor(registry.ConfigMediaType, []byte(`{"name":"helloworld","version":"1.0.0"}`)),
+		"layers":        []interface{}{descriptor(registry.ChartLayerMediaType, chart)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestDigest := fmt.Sprintf("sha256:%x", sha256.Sum256(manifest))
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == fmt.Sprintf("/v2/%s/manifests/%s", name, version) || r.URL.Path == fmt.Sprintf("/v2/%s/manifests/%s", name, manifestDigest):
+			w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+			w.Header().Set("Docker-Content-Digest", manifestDigest)
+			w.Header().Set("Content-Length", fmt.Sprint(len(manifest)))
+			if r.Method == http.MethodGet {
+				_, _ = w.Write(manifest)
+			}
+		case strings.HasPrefix(r.URL.Path, fmt.Sprintf("/v2/%s/blobs/", name)):
+			data, ok := blobs[strings.TrimPrefix(r.URL.Path, fmt.Sprintf("/v2/%s/blobs/", name))]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+			_, _ = w.Write(data)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestPullOCIChartTLS(t *testing.T) {
+	defer patchToolchainRoot()()
+	chart, err := os.ReadFile(filepath.Join("testdata", "helloworld-1.0.0.tgz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := newTestRegistry(t, "charts/helloworld", "1.0.0", chart)
+	defer ts.Close()
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	repo := fmt.Sprintf("oci://%s/charts", strings.TrimPrefix(ts.URL, "https://"))
+	c := component{Repo: repo, Chart: "helloworld", Version: "1.0.0"}
+
+	tc := &toolchain{name: "test", config: &toolchainConfig{}}
+	err = tc.pullChart(context.TODO(), c)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "certificate signed by unknown authority", "expected the registry certificate to be untrusted without the ca")
+	}
+
+	tc.config.Repositories = []repositoryConfig{{URL: repo, CAFile: ca}}
+	if err := tc.pullChart(context.TODO(), c); err != nil {
+		t.Fatal(err)
+	}
+	assert.FileExists(t, filepath.Join(tc.componentsPath(), "helloworld", "Chart.yaml"))
+	assert.NoFileExists(t, filepath.Join(tc.componentsPath(), "helloworld-1.0.0.tgz"))
+}
@@ -7,23 +7,23 @@ import (
 	"fmt"
 	"html/template"
 	"io"
-	"log"
 	"net/http"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"filippo.io/age"
 	"github.com/Masterminds/sprig/v3"
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/plumbing"
 	helmclient "github.com/mittwald/go-helm-client"
+	"github.com/sirupsen/logrus"
 	"github.com/trustacks/trustacks/pkg"
 	"gopkg.in/yaml.v3"
-	"helm.sh/helm/v3/pkg/action"
-	"helm.sh/helm/v3/pkg/cli"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 )
@@ -35,12 +35,27 @@ var (
 
 // component represents a toolchain component.
 type component struct {
+	// Type is the component type (helm, kustomize or manifest). The
+	// component is a helm chart if it is empty.
+	Type string `json:"type,omitempty"`
+	// Source is the kustomize target or the manifest url of kustomize
+	// and manifest components. {{ .Version }} is replaced with the
+	// component version.
+	Source           string `json:"source,omitempty"`
 	Repo             string `json:"repository"`
 	Chart            string `json:"chart"`
 	Version          string `json:"version"`
 	Values           string `json:"values"`
 	Hooks            string `json:"hooks"`
 	ApplicationHooks string `json:"applicationHooks,omitempty"`
+	// Backup contains the backup and restore jobs of the component
+	// data.
+	Backup *componentBackup `json:"backup,omitempty"`
+	// Requirements are the cluster requirements of the component.
+	Requirements *requirements `json:"requirements,omitempty"`
+	// Health contains the functional readiness checks of the
+	// component.
+	Health []healthCheck `json:"health,omitempty"`
 }
 
 // componentCatalogConfigParameters .
@@ -60,19 +75,36 @@ type componentCatalog struct {
 	Version    string                  `json:"version"`
 	Components map[string]component    `json:"components"`
 	Config     *componentCatalogConfig `json:"config"`
+	// Requirements are the cluster requirements of the catalog
+	// components.
+	Requirements *requirements `json:"requirements,omitempty"`
 }
 
 // getToolchainCatalog gets the component catalog.
-func getToolchainCatalog(url string) (*componentCatalog, error) {
-	resp, err := http.Get(fmt.Sprintf("%s/.well-known/catalog-manifest", url))
+func getToolchainCatalog(ctx context.Context, url string) (*componentCatalog, error) {
+	data, err := getCatalogManifest(ctx, url)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-	data, err := io.ReadAll(resp.Body)
+	return parseCatalogManifest(data)
+}
+
+// getCatalogManifest downloads the raw component catalog manifest.
+func getCatalogManifest(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/.well-known/catalog-manifest", url), nil)
 	if err != nil {
 		return nil, err
 	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+// parseCatalogManifest parses the raw component catalog manifest.
+func parseCatalogManifest(data []byte) (*componentCatalog, error) {
 	var catalog *componentCatalog
 	if err := json.Unmarshal(data, &catalog); err != nil {
 		return nil, err
@@ -88,40 +120,110 @@ type toolchainDependencies struct {
 
 // toolchain represents a toolchain helm chart.
 type toolchain struct {
-	name         string
+	name   string
+	config *toolchainConfig
+	// root overrides the toolchain root directory.
+	root string
+	// bundle is the offline bundle that replaces the network sources.
+	bundle *bundle
+	// overrides are the command line parameter overrides of the
+	// toolchain install.
+	overrides    map[string]interface{}
 	Dependencies []toolchainDependencies `yaml:"dependencies"`
 }
 
 // addComponents downloads the component charts and adds them to the
 // resource components.
-func (tc *toolchain) addComponents(components []string, catalog *componentCatalog) error {
+func (tc *toolchain) addComponents(ctx context.Context, components []string, catalog *componentCatalog) error {
 	for _, name := range components {
+		component := tc.component(name, catalog)
 		// Check if the chart already exists.
 		if _, err := os.Stat(path.Join(tc.componentsPath(), name)); !os.IsNotExist(err) {
+			version, err := componentVersion(path.Join(tc.componentsPath(), name))
+			if err != nil || version == component.Version {
+				continue
+			}
+			logger.WithField("component", name).Infof("replacing chart version %s with %s", version, component.Version)
+			if err := os.RemoveAll(path.Join(tc.componentsPath(), name)); err != nil {
+				return err
+			}
+		}
+		if tc.bundle != nil {
+			logger.WithField("component", name).Debug("copying the component chart from the bundle")
+			if err := tc.bundle.copyChart(name, path.Join(tc.componentsPath(), name)); err != nil {
+				return err
+			}
 			continue
 		}
-		component := catalog.Components[name]
-		pull := action.NewPullWithOpts(action.WithConfig(&action.Configuration{}))
-		pull.Settings = cli.New()
-		pull.UntarDir = tc.componentsPath()
-		pull.Untar = true
-		url := fmt.Sprintf("%s/%s-%s.tgz", component.Repo, component.Chart, component.Version)
-		_, err := pull.Run(url)
-		if err != nil {
-			return err
+		if !component.helm() {
+			logger.WithFields(logrus.Fields{"component": name, "type": component.Type}).Debug("fetching component manifests")
+			if err := tc.fetchManifests(ctx, name, component); err != nil {
+				return err
+			}
+			continue
 		}
-		if err := os.Remove(path.Join(tc.componentsPath(), fmt.Sprintf("%s-%s.tgz", component.Chart, component.Version))); err != nil {
+		logger.WithFields(logrus.Fields{"component": name, "version": component.Version}).Debug("pulling component chart")
+		if err := tc.pullChart(ctx, component); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// component returns the catalog component with the version and
+// repository overrides of the toolchain config.
+//
+// A warning is logged for each deviation from the catalog.
+func (tc *toolchain) component(name string, catalog *componentCatalog) component {
+	c := catalog.Components[name]
+	if tc.config == nil {
+		return c
+	}
+	config, ok := tc.config.Components[name]
+	if !ok {
+		return c
+	}
+	if config.Version != "" && config.Version != c.Version {
+		logger.WithField("component", name).Warnf("chart version %s is pinned over the catalog version %s", config.Version, c.Version)
+		c.Version = config.Version
+	}
+	if config.Repository != "" && config.Repository != c.Repo {
+		logger.WithField("component", name).Warnf("chart repository %s overrides the catalog repository %s", config.Repository, c.Repo)
+		c.Repo = config.Repository
+	}
+	return c
+}
+
+// componentVersion returns the version of the component in the
+// directory, read from the component metadata or the chart.
+func componentVersion(dir string) (string, error) {
+	if metadata, err := readComponentMetadata(dir); err == nil {
+		return metadata.Version, nil
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "Chart.yaml"))
+	if err != nil {
+		return "", err
+	}
+	metadata := struct {
+		Version string `yaml:"version"`
+	}{}
+	if err := yaml.Unmarshal(data, &metadata); err != nil {
+		return "", err
+	}
+	return metadata.Version, nil
+}
+
 // addHooks creates the hook template file in the chart.
 func (tc *toolchain) addHooks(components []string, catalog *componentCatalog, params map[string]interface{}) error {
 	for _, name := range components {
-		params["image"] = catalog.HookSource
+		params["image"] = mirrorImage(tc.registryMirror(), catalog.HookSource)
 		component := catalog.Components[name]
+		if !component.helm() {
+			if component.Hooks != "" {
+				logger.WithField("component", name).Warnf("hooks are not supported by %s components", component.Type)
+			}
+			continue
+		}
 
 		var buf bytes.Buffer
 		t := template.Must(template.New("hook").Parse(component.Hooks))
@@ -129,7 +231,7 @@ func (tc *toolchain) addHooks(components []string, catalog *componentCatalog, pa
 			return err
 		}
 		path := filepath.Join(tc.componentsPath(), name, "templates", "trustacks-hooks.yaml")
-		if err := os.WriteFile(path, buf.Bytes(), 0666); err != nil {
+		if err := os.WriteFile(path, tc.mirrorHooks(buf.Bytes()), 0666); err != nil {
 			return err
 		}
 	}
@@ -140,17 +242,30 @@ func (tc *toolchain) addHooks(components []string, catalog *componentCatalog, pa
 // file.
 func (tc *toolchain) addSubChartValues(components []string, catalog *componentCatalog, parameters map[string]interface{}) error {
 	for _, name := range components {
-		values, err := os.Create(path.Join(tc.componentsPath(), name, "override-values.yaml"))
-		if err != nil {
-			return err
-		}
 		component := catalog.Components[name]
+		if !component.helm() {
+			continue
+		}
 		t := template.Must(template.New("values").Funcs(sprig.FuncMap()).Parse(component.Values))
 		var buf bytes.Buffer
 		if err := t.Execute(&buf, parameters); err != nil {
 			return err
 		}
-		if _, err := values.Write(buf.Bytes()); err != nil {
+		values := buf.Bytes()
+		if tc.config != nil {
+			if config, ok := tc.config.Components[name]; ok {
+				overridden, err := applyValueOverrides(values, config)
+				if err != nil {
+					return fmt.Errorf("error overriding '%s' values: %s", name, err)
+				}
+				values = overridden
+			}
+		}
+		values, err := mirrorValues(tc.registryMirror(), values)
+		if err != nil {
+			return fmt.Errorf("error rewriting '%s' value images: %s", name, err)
+		}
+		if err := os.WriteFile(path.Join(tc.componentsPath(), name, "override-values.yaml"), values, 0644); err != nil {
 			return err
 		}
 	}
@@ -161,8 +276,19 @@ func (tc *toolchain) addSubChartValues(components []string, catalog *componentCa
 func (tc *toolchain) createAgeKeySecret() error {
 	privateKey, err := age.GenerateX25519Identity()
 	if err != nil {
-		log.Fatalf("Failed to generate key pair: %v", err)
+		return fmt.Errorf("failed to generate key pair: %s", err)
 	}
+	return tc.writeAgeKeySecret(privateKey)
+}
+
+// ageKeySecretPath returns the path of the age keys secret template.
+func (tc *toolchain) ageKeySecretPath() string {
+	return path.Join(tc.path(), "chart", "templates", "sops-age-secret.yaml")
+}
+
+// writeAgeKeySecret writes the age keys secret template of the
+// identity.
+func (tc *toolchain) writeAgeKeySecret(privateKey *age.X25519Identity) error {
 	secret := map[string]interface{}{
 		"apiVersion": "v1",
 		"kind":       "Secret",
@@ -178,116 +304,200 @@ func (tc *toolchain) createAgeKeySecret() error {
 	if err != nil {
 		return err
 	}
-	if err := os.MkdirAll(path.Join(tc.path(), "chart", "templates"), 0755); err != nil {
+	if err := os.MkdirAll(path.Dir(tc.ageKeySecretPath()), 0755); err != nil {
 		return err
 	}
-	return os.WriteFile(path.Join(tc.path(), "chart", "templates", "sops-age-secret.yaml"), yml, 0644)
+	return os.WriteFile(tc.ageKeySecretPath(), yml, 0644)
 }
 
-// install installs the toolchain helm chart.
-func (tc *toolchain) install() error {
-	slug := fmt.Sprintf("trustacks-toolchain-%s", tc.name)
-	chartSpec := helmclient.ChartSpec{
-		ReleaseName:     slug,
-		ChartName:       filepath.Join(tc.path(), "chart"),
-		Namespace:       slug,
-		UpgradeCRDs:     true,
-		CreateNamespace: true,
-		CleanupOnFail:   true,
-	}
-	kubeconfig, err := os.ReadFile(filepath.Join(os.Getenv("HOME"), ".kube", "config"))
+// ageIdentity reads the age identity of the toolchain.
+func (tc *toolchain) ageIdentity() (*age.X25519Identity, error) {
+	data, err := os.ReadFile(tc.ageKeySecretPath())
 	if err != nil {
-		return err
+		return nil, err
 	}
-	helmClient, err := helmclient.NewClientFromKubeConf(&helmclient.KubeConfClientOptions{
-		Options:    &helmclient.Options{Namespace: slug},
-		KubeConfig: kubeconfig,
-	})
-	if err != nil {
-		return err
+	secret := struct {
+		StringData map[string]string `yaml:"stringData"`
+	}{}
+	if err := yaml.Unmarshal(data, &secret); err != nil {
+		return nil, err
 	}
-	_, err = helmClient.InstallOrUpgradeChart(context.Background(), &chartSpec, nil)
-	return err
+	return age.ParseX25519Identity(secret.StringData["age.agekey"])
 }
 
-// installComponents installs the component helm charts.
-func (tc *toolchain) installComponents() error {
+// install installs the toolchain helm chart in each of the toolchain
+// clusters.
+func (tc *toolchain) install(ctx context.Context) error {
 	slug := fmt.Sprintf("trustacks-toolchain-%s", tc.name)
+	namespace := tc.namespaceConfig()
+	for _, target := range tc.clusters() {
+		cluster := target.config
+		clientset, err := newClientset(cluster)
+		if err != nil {
+			return err
+		}
+		if err := ensureNamespace(ctx, clientset, namespace); err != nil {
+			return fmt.Errorf("cluster '%s': %s", clusterLabel(cluster), err)
+		}
+		chartSpec := helmclient.ChartSpec{
+			ReleaseName:   slug,
+			ChartName:     filepath.Join(tc.path(), "chart"),
+			Namespace:     namespace.Name,
+			UpgradeCRDs:   true,
+			CleanupOnFail: true,
+		}
+		helmClient, err := newHelmClient(namespace.Name, cluster)
+		if err != nil {
+			return err
+		}
+		opts, err := tc.helmOptions()
+		if err != nil {
+			return err
+		}
+		logger.WithFields(logrus.Fields{"release": slug, "cluster": clusterLabel(cluster)}).Info("installing the toolchain chart")
+		if _, err := helmClient.InstallOrUpgradeChart(ctx, &chartSpec, opts); err != nil {
+			return fmt.Errorf("cluster '%s': %s", clusterLabel(cluster), err)
+		}
+	}
+	return nil
+}
+
+// installComponents installs the component helm charts.
+func (tc *toolchain) installComponents(ctx context.Context) error {
+	namespace := tc.namespace()
 	components, err := os.ReadDir(tc.componentsPath())
 	if err != nil {
 		return err
 	}
-	var wg sync.WaitGroup
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []string
+	)
 	for _, component := range components {
 		wg.Add(1)
-		go func(name string, wg *sync.WaitGroup) {
-			values, err := os.ReadFile(filepath.Join(tc.componentsPath(), name, "override-values.yaml"))
-			if err != nil {
-				log.Fatalf("error reading override values: %s", err)
-			}
-			chartSpec := helmclient.ChartSpec{
-				ReleaseName:     name,
-				ChartName:       filepath.Join(tc.componentsPath(), name),
-				Namespace:       slug,
-				UpgradeCRDs:     true,
-				CreateNamespace: true,
-				CleanupOnFail:   true,
-				ValuesYaml:      string(values),
-			}
-			kubeconfig, err := os.ReadFile(filepath.Join(os.Getenv("HOME"), ".kube", "config"))
-			if err != nil {
-				log.Fatalf("error reading kubeconfig: %s", err)
-			}
-			helmClient, err := helmclient.NewClientFromKubeConf(&helmclient.KubeConfClientOptions{
-				Options:    &helmclient.Options{Namespace: slug},
-				KubeConfig: kubeconfig,
-			})
-			if err != nil {
-				log.Fatalf("error creating helm client: %s", err)
-			}
-			_, err = helmClient.InstallOrUpgradeChart(context.Background(), &chartSpec, nil)
-			if err != nil {
-				log.Fatalf("error deploying '%s': %s", name, err)
+		go func(name string) {
+			defer wg.Done()
+			if err := tc.installComponent(ctx, name, namespace); err != nil {
+				logger.WithField("component", name).Errorf("error deploying component: %s", err)
+				mu.Lock()
+				errs = append(errs, fmt.Sprintf("'%s': %s", name, err))
+				mu.Unlock()
 			}
-			wg.Done()
-		}(component.Name(), &wg)
+		}(component.Name())
 	}
 	wg.Wait()
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("error deploying components: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// installComponent installs the component helm chart into the
+// namespace of the component cluster.
+func (tc *toolchain) installComponent(ctx context.Context, name, namespace string) error {
+	cluster := tc.cluster(name)
+	if metadata, err := readComponentMetadata(filepath.Join(tc.componentsPath(), name)); err == nil {
+		if err := tc.applyComponent(ctx, name, namespace, cluster, metadata); err != nil {
+			return err
+		}
+		logger.WithField("component", name).Info("component installed")
+		return nil
+	}
+	values, err := os.ReadFile(filepath.Join(tc.componentsPath(), name, "override-values.yaml"))
+	if err != nil {
+		return fmt.Errorf("error reading override values: %s", err)
+	}
+	chartSpec := helmclient.ChartSpec{
+		ReleaseName:   name,
+		ChartName:     filepath.Join(tc.componentsPath(), name),
+		Namespace:     namespace,
+		UpgradeCRDs:   true,
+		CleanupOnFail: true,
+		ValuesYaml:    string(values),
+	}
+	helmClient, err := newHelmClient(namespace, cluster)
+	if err != nil {
+		return fmt.Errorf("error creating helm client: %s", err)
+	}
+	opts, err := tc.helmOptions()
+	if err != nil {
+		return err
+	}
+	logger.WithFields(logrus.Fields{"component": name, "cluster": clusterLabel(cluster)}).Info("installing component")
+	started := time.Now()
+	if _, err := helmClient.InstallOrUpgradeChart(ctx, &chartSpec, opts); err != nil {
+		return withHookLogs(err, name, started, namespace, cluster)
+	}
+	logger.WithField("component", name).Info("component installed")
 	return nil
 }
 
 // join combines the toolchain configuration parameters with the
 // component parameters
 //
-// Parameter defaults are set if required.
-func (tc *toolchain) join(parameters map[string]interface{}, catalogParameters []componentCatalogConfigParameters) map[string]interface{} {
+// Parameter defaults are set if required. The override layers are
+// applied over the toolchain parameters in order, so the precedence is
+// catalog default < toolchain < overrides.
+func (tc *toolchain) join(parameters map[string]interface{}, catalogParameters []componentCatalogConfigParameters, overrides ...map[string]interface{}) map[string]interface{} {
+	layered := make(map[string]interface{})
+	for _, layer := range append([]map[string]interface{}{parameters}, overrides...) {
+		for k, v := range layer {
+			layered[k] = v
+		}
+	}
 	joined := make(map[string]interface{})
 	for _, param := range catalogParameters {
-		if _, ok := parameters[param.Name]; !ok {
+		if _, ok := layered[param.Name]; !ok {
 			if param.Default != "" {
 				joined[param.Name] = param.Default
 			}
 		} else {
-			joined[param.Name] = parameters[param.Name]
+			joined[param.Name] = layered[param.Name]
 		}
 	}
 	return joined
 }
 
+// catalog gets the component catalog from the bundle, or from the
+// catalog url if the toolchain is not installed from a bundle.
+func (tc *toolchain) catalog(ctx context.Context, url string) (*componentCatalog, error) {
+	if tc.bundle != nil {
+		return tc.bundle.catalog(url)
+	}
+	return getToolchainCatalog(ctx, url)
+}
+
 // path returns the filesystem path of the toolchain metadata.
 func (tc *toolchain) path() string {
+	if tc.root != "" {
+		return filepath.Join(tc.root, tc.name)
+	}
 	return filepath.Join(toolchainRoot, tc.name)
 }
 
 // componentsPath returns the filesystem path of the toolchain
 // components.
 func (tc *toolchain) componentsPath() string {
-	return filepath.Join(toolchainRoot, tc.name, "components")
+	return filepath.Join(tc.path(), "components")
+}
+
+// configPath returns the filesystem path of the stored toolchain
+// config.
+func (tc *toolchain) configPath() string {
+	return filepath.Join(tc.path(), "toolchain-config.yaml")
+}
+
+// overridesPath returns the filesystem path of the stored install
+// parameter overrides.
+func (tc *toolchain) overridesPath() string {
+	return filepath.Join(tc.path(), "parameter-overrides.yaml")
 }
 
 // applicationsPath returns the filesystem path of the applications.
 func (tc *toolchain) applicationsPath() string {
-	return filepath.Join(toolchainRoot, tc.name, "applications")
+	return filepath.Join(tc.path(), "applications")
 }
 
 // newToolchain creates a new toolchain chart instance.
@@ -312,67 +522,217 @@ func newToolchain(name, source, version string, force bool, cloneFunc func(strin
 	if err := tc.createAgeKeySecret(); err != nil {
 		return nil, err
 	}
-	manifest, err := os.ReadFile(filepath.Join(tc.path(), "config.yaml"))
-	if err != nil {
-		return nil, err
-	}
-	if err := yaml.Unmarshal(manifest, tc); err != nil {
+	if err := tc.readManifest(); err != nil {
 		return nil, err
 	}
 	return tc, nil
 }
 
+// readManifest reads the toolchain dependencies from the toolchain
+// source config.
+func (tc *toolchain) readManifest() error {
+	manifest, err := os.ReadFile(filepath.Join(tc.path(), "config.yaml"))
+	if err != nil {
+		return err
+	}
+	return yaml.Unmarshal(manifest, tc)
+}
+
+// newToolchainFromConfig creates a toolchain instance from the
+// installed toolchain metadata.
 func newToolchainFromConfig(name string) (*toolchain, error) {
 	tc := &toolchain{name: name}
-	manifest, err := os.ReadFile(filepath.Join(tc.path(), "config.yaml"))
+	if err := tc.readManifest(); err != nil {
+		return nil, err
+	}
+	// the stored config keeps the environment variable references, which
+	// are interpolated again. The commands that do not use the values
+	// must not require the variables, so unset variables are kept.
+	values, err := readConfigValues(tc.configPath())
+	if os.IsNotExist(err) {
+		return tc, nil
+	}
 	if err != nil {
 		return nil, err
 	}
-	if err := yaml.Unmarshal(manifest, tc); err != nil {
+	if tc.config, err = decodeConfigValues(values, false); err != nil {
+		return nil, err
+	}
+	overrides, err := os.ReadFile(tc.overridesPath())
+	if os.IsNotExist(err) {
+		return tc, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(overrides, &tc.overrides); err != nil {
 		return nil, err
 	}
 	return tc, nil
 }
 
+// saveConfig stores the toolchain config with the toolchain metadata.
+//
+// The values read from environment variables are stored as the
+// references to the variables, to keep them out of the stored config.
+func (tc *toolchain) saveConfig() error {
+	data, err := encodeConfig(tc.config)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(tc.configPath(), data, 0600); err != nil {
+		return err
+	}
+	// the install overrides are stored separately so that they take
+	// precedence over the application parameters.
+	overrides, err := yaml.Marshal(tc.overrides)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(tc.overridesPath(), overrides, 0600)
+}
+
 // toolchainConfig contains the toolchain configuration parameters.
 type toolchainConfig struct {
-	Name         string                 `json:"name"`
-	Source       string                 `json:"source"`
-	Version      string                 `json:"version"`
-	Parameters   map[string]interface{} `json:"parameters"`
-	Applications []applicationConfig    `json:"applications"`
+	Name         string                     `json:"name"`
+	Source       string                     `json:"source"`
+	Version      string                     `json:"version"`
+	Parameters   map[string]interface{}     `json:"parameters"`
+	Applications []applicationConfig        `json:"applications"`
+	Clusters     map[string]clusterConfig   `json:"clusters"`
+	Components   map[string]componentConfig `json:"components"`
+	Namespace    *namespaceConfig           `json:"namespace"`
+	Repositories []repositoryConfig         `json:"repositories"`
+	// RegistryMirror is the registry that the toolchain images are
+	// pulled from.
+	RegistryMirror string `json:"registryMirror" yaml:"registryMirror"`
+	// PostRender is the post render pipeline of the rendered
+	// manifests.
+	PostRender *postRenderConfig `json:"postRender" yaml:"postRender"`
+	// Installer is the installer backend of the toolchain.
+	Installer *installerConfig `json:"installer"`
+
+	// envReferences are the values read from environment variables by
+	// their path in the config values.
+	envReferences map[string]envReference
 }
 
 // loadToolchainConfig loads the config file at the provided path.
-func loadToolchainConfig(path string) (*toolchainConfig, error) {
-	rawConfig, err := os.ReadFile(path)
+//
+// The config.<env>.yaml overlay of the environment is merged over the
+// config if env is not empty. ${VAR} references in the string values
+// are replaced with the environment variable values, and $$ with a
+// literal $. Relative post render paths are resolved to absolute paths
+// from the directory of the config file.
+func loadToolchainConfig(path, env string) (*toolchainConfig, error) {
+	values, err := readConfigValues(path)
 	if err != nil {
 		return nil, err
 	}
-	var config *toolchainConfig
-	if err := yaml.Unmarshal(rawConfig, &config); err != nil {
-		return nil, err
+	if env != "" {
+		overlay, err := readConfigValues(overlayPath(path, env))
+		if err != nil {
+			return nil, fmt.Errorf("error loading the '%s' overlay: %s", env, err)
+		}
+		values = mergeConfigValues(values, overlay)
+	}
+	config, err := decodeConfigValues(values, true)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	if config != nil && config.PostRender != nil {
+		if err := config.PostRender.resolvePaths(filepath.Dir(path)); err != nil {
+			return nil, err
+		}
 	}
 	return config, nil
 }
 
+// InstallOptions contains the optional toolchain install parameters.
+type InstallOptions struct {
+	// Confirm is called before the releases stuck in an intermediate
+	// state are repaired. The stuck releases are left untouched if it
+	// is nil.
+	Confirm ConfirmFunc
+	// Parameters are merged over the config file parameters.
+	Parameters map[string]interface{}
+	// Env is the environment overlay merged over the config file.
+	Env string
+	// Bundle is the path of an offline bundle. The toolchain source,
+	// catalogs and charts are read from the bundle instead of the
+	// network if it is set.
+	Bundle string
+	// SkipPreflight skips the pre-flight cluster checks.
+	SkipPreflight bool
+	// Wait is how long the install waits for the components to be
+	// deployed and pass their health checks. The install does not
+	// wait if it is zero.
+	Wait time.Duration
+}
+
 // Install installs the toolchain.
-func Install(configPath string, force bool, cloneFunc func(string, bool, *git.CloneOptions) (*git.Repository, error)) error {
-	config, err := loadToolchainConfig(configPath)
+//
+// Cancelling the context interrupts the in-flight helm operations. The
+// releases left in an intermediate state are reported in the returned
+// error.
+func Install(ctx context.Context, configPath string, force bool, cloneFunc func(string, bool, *git.CloneOptions) (*git.Repository, error), opts *InstallOptions) error {
+	if opts == nil {
+		opts = &InstallOptions{}
+	}
+	config, err := loadToolchainConfig(configPath, opts.Env)
 	if err != nil {
 		return fmt.Errorf("error loading the toolchain config: %s", err)
 	}
+	if opts.Parameters != nil {
+		config.Parameters = mergeValues(config.Parameters, opts.Parameters)
+	}
+	if err := validateClusters(config); err != nil {
+		return fmt.Errorf("error validating the cluster targets: %s", err)
+	}
+	if err := validateInstaller(config); err != nil {
+		return fmt.Errorf("error validating the installer: %s", err)
+	}
+	// the gitops repository is cloned with the provided clone func
+	// when installing from a bundle.
+	gitClone := cloneFunc
+	var b *bundle
+	if opts.Bundle != "" {
+		b, err = openBundle(opts.Bundle)
+		if err != nil {
+			return fmt.Errorf("error opening the bundle: %s", err)
+		}
+		defer b.remove()
+		cloneFunc = b.clone
+	}
 	tc, err := newToolchain(config.Name, config.Source, config.Version, force, cloneFunc)
 	if err != nil {
 		return fmt.Errorf("error creating the toolchian: %s", err)
 	}
+	tc.config = config
+	tc.bundle = b
+	tc.overrides = opts.Parameters
+	if err := tc.saveConfig(); err != nil {
+		return fmt.Errorf("error saving the toolchain config: %s", err)
+	}
+	if tc.controllerInstaller() {
+		if err := tc.resetControllerResources(); err != nil {
+			return fmt.Errorf("error resetting the controller resources: %s", err)
+		}
+	}
+	reqs := map[string]*requirements{}
+	var components []string
 	for _, dep := range tc.Dependencies {
-		catalog, err := getToolchainCatalog(dep.Catalog)
+		logger.WithField("catalog", dep.Catalog).Debug("fetching the component catalog")
+		catalog, err := tc.catalog(ctx, dep.Catalog)
 		if err != nil {
 			return fmt.Errorf("error fetching catalog: %s", err)
 		}
 		parameters := tc.join(config.Parameters, catalog.Config.Parameters)
-		if err := tc.addComponents(dep.Components, catalog); err != nil {
+		if err := tc.addRequirements(reqs, dep.Components, catalog); err != nil {
+			return fmt.Errorf("error reading the catalog requirements: %s", err)
+		}
+		components = append(components, dep.Components...)
+		if err := tc.addComponents(ctx, dep.Components, catalog); err != nil {
 			return fmt.Errorf("error adding subcharts: %s", err)
 		}
 		if err := tc.addHooks(dep.Components, catalog, parameters); err != nil {
@@ -381,25 +741,145 @@ func Install(configPath string, force bool, cloneFunc func(string, bool, *git.Cl
 		if err := tc.addSubChartValues(dep.Components, catalog, parameters); err != nil {
 			return fmt.Errorf("error adding subchart values: %s", err)
 		}
+		if err := tc.addBackupJobs(dep.Components, catalog, parameters); err != nil {
+			return fmt.Errorf("error adding the backup jobs: %s", err)
+		}
+		if err := tc.addHealthChecks(dep.Components, catalog, parameters); err != nil {
+			return fmt.Errorf("error adding the health checks: %s", err)
+		}
+		if tc.controllerInstaller() {
+			if err := tc.addControllerResources(ctx, dep.Components, catalog); err != nil {
+				return fmt.Errorf("error adding the controller resources: %s", err)
+			}
+		}
+	}
+	if tc.installer() == installerGitOps {
+		if err := tc.publish(ctx, gitClone); err != nil {
+			return fmt.Errorf("error publishing the toolchain manifests: %s", err)
+		}
+		if opts.Wait > 0 {
+			logger.Warn("the gitops installer does not wait for the components")
+		}
+		return nil
+	}
+	footprints, err := tc.footprints(components)
+	if err != nil {
+		return fmt.Errorf("error estimating the component footprint: %s", err)
+	}
+	logger.Infof("component resource footprint:\n%s", describeFootprints(footprints))
+	if !opts.SkipPreflight {
+		results, err := tc.preflight(ctx, reqs, tc.clusterFootprints(footprints))
+		if err != nil {
+			return fmt.Errorf("error running the pre-flight checks: %s", err)
+		}
+		if err := preflightError(results); err != nil {
+			return err
+		}
+	}
+	if err := tc.repair(ctx, opts.Confirm); err != nil {
+		return err
+	}
+	if err := tc.install(ctx); err != nil {
+		return tc.interrupted(ctx, fmt.Errorf("error installing the toolchain chart: %s", err))
+	}
+	// the gitops controller installs the components from the
+	// resources of the toolchain chart.
+	if !tc.controllerInstaller() {
+		if err := tc.installComponents(ctx); err != nil {
+			return tc.interrupted(ctx, fmt.Errorf("error installing the toolchain components: %s", err))
+		}
 	}
-	if err := tc.install(); err != nil {
-		return fmt.Errorf("error installing the toolchain chart: %s", err)
+	if opts.Wait > 0 {
+		return tc.waitReady(ctx, opts.Wait)
 	}
-	if err := tc.installComponents(); err != nil {
-		return fmt.Errorf("error installing the toolchain components: %s", err)
+	return nil
+}
+
+// repair offers to recover the releases stuck in an intermediate state
+// before they block the install.
+func (tc *toolchain) repair(ctx context.Context, confirm ConfirmFunc) error {
+	namespace := tc.namespace()
+	for _, target := range tc.clusters() {
+		cluster := target.config
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		releases, err := pendingReleases(namespace, cluster)
+		if err != nil {
+			logger.WithField("cluster", clusterLabel(cluster)).Debugf("error listing the pending releases: %s", err)
+			continue
+		}
+		if len(releases) == 0 {
+			continue
+		}
+		logger.WithField("cluster", clusterLabel(cluster)).Warnf("releases stuck in an intermediate state: %s", describeReleases(releases))
+		if confirm == nil {
+			continue
+		}
+		if _, err := repairReleases(ctx, namespace, cluster, confirm); err != nil {
+			return fmt.Errorf("error repairing the toolchain releases: %s", err)
+		}
 	}
 	return nil
 }
 
+// interrupted reports the releases left in an intermediate state if
+// the error was caused by the context cancellation.
+func (tc *toolchain) interrupted(ctx context.Context, err error) error {
+	if ctx.Err() == nil {
+		return err
+	}
+	return withInterruptedReleases(err, tc.namespaces(), tc.clusters())
+}
+
 // Destroy removes the software factory kubernetes resources and the
 // toolchain helm assets.
-func Destory(name string, clientset kubernetes.Interface) error {
-	tc := &toolchain{}
+func Destory(ctx context.Context, name string, clientset kubernetes.Interface) error {
+	tc := &toolchain{name: name}
 	if _, err := os.Stat(tc.path()); os.IsNotExist(err) {
 		return fmt.Errorf("error: toolchain '%s' could not be found", name)
 	}
-	if err := clientset.CoreV1().Namespaces().Delete(context.TODO(), fmt.Sprintf("trustacks-toolchain-%s", name), metav1.DeleteOptions{}); err != nil {
+	if config, err := newToolchainFromConfig(name); err == nil {
+		tc = config
+	}
+	// the cluster scoped objects of the kustomize and manifest
+	// components are not removed with the namespaces.
+	if err := tc.removeManifests(ctx); err != nil {
+		return fmt.Errorf("error removing the component manifests: %s", err)
+	}
+	// the argo cd applications would keep syncing the components
+	// into the removed namespaces.
+	if tc.installer() == installerArgoCD {
+		for _, target := range tc.clusters() {
+			client, _, err := newDynamicClient(target.config)
+			if err != nil {
+				return err
+			}
+			if err := tc.removeArgoApplications(ctx, client); err != nil {
+				return fmt.Errorf("cluster '%s': error removing the argo cd applications: %s", clusterLabel(target.config), err)
+			}
+		}
+	}
+	releases, err := tc.releaseNames()
+	if err != nil {
 		return err
 	}
+	for _, target := range tc.clusters() {
+		cluster := target.config
+		// the default cluster is removed with the provided clientset.
+		clusterClientset := clientset
+		if cluster != nil {
+			c, err := newClientset(cluster)
+			if err != nil {
+				return err
+			}
+			clusterClientset = c
+		}
+		for _, namespace := range tc.namespaces() {
+			if err := removeNamespace(ctx, clusterClientset, namespace, cluster, releases); err != nil {
+				return fmt.Errorf("cluster '%s': error removing namespace '%s': %s", clusterLabel(cluster), namespace.Name, err)
+			}
+		}
+	}
 	return os.RemoveAll(tc.path())
 }
@@ -1,6 +1,7 @@
 package toolchain
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -47,7 +48,7 @@ func TestNewToolchain(t *testing.T) {
 }
 
 func TestLoadToolchainConfig(t *testing.T) {
-	config, err := loadToolchainConfig(filepath.Join("testdata", "config.yaml"))
+	config, err := loadToolchainConfig(filepath.Join("testdata", "config.yaml"), "")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -71,7 +72,7 @@ func TestGetToolchainCatalog(t *testing.T) {
 			t.Fatal(err)
 		}
 	}))
-	catalog, err := getToolchainCatalog(ts.URL)
+	catalog, err := getToolchainCatalog(context.Background(), ts.URL)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -115,7 +116,7 @@ func TestAddComponents(t *testing.T) {
 		},
 	}
 	tc := &toolchain{name: "test"}
-	if err := tc.addComponents([]string{"helloworld"}, catalog); err != nil {
+	if err := tc.addComponents(context.TODO(), []string{"helloworld"}, catalog); err != nil {
 		t.Fatal(err)
 	}
 	assert.DirExists(t, fmt.Sprintf("%s/components/helloworld", tc.path()), "expected chart to exist")
@@ -242,3 +243,75 @@ func TestFromConfig(t *testing.T) {
 	}
 	assert.Equal(t, "http://test-catalog.local", tc.Dependencies[0].Catalog, "got an unexpected dependency catalog")
 }
+
+func TestFromConfigWithSavedConfig(t *testing.T) {
+	defer patchToolchainRoot()()
+	if err := os.MkdirAll(filepath.Join(toolchainRoot, "test"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(toolchainRoot, "test", "config.yaml"), []byte(""), 0666); err != nil {
+		t.Fatal(err)
+	}
+	tc := &toolchain{
+		name: "test",
+		config: &toolchainConfig{
+			Name:       "test",
+			Parameters: map[string]interface{}{"password": "pa${TEST_FROM_CONFIG_MISSING}"},
+			Clusters:   map[string]clusterConfig{"build": {Context: "k3d-build"}},
+		},
+	}
+	if err := tc.saveConfig(); err != nil {
+		t.Fatal(err)
+	}
+	tc, err := newToolchainFromConfig("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "k3d-build", tc.config.Clusters["build"].Context, "got an unexpected saved cluster context")
+	assert.Equal(t, "pa${TEST_FROM_CONFIG_MISSING}", tc.config.Parameters["password"], "expected the saved config not to be interpolated")
+}
+
+func TestConfigJoinParameterOverrides(t *testing.T) {
+	catalogParameters := []componentCatalogConfigParameters{
+		{Name: "target", Default: "local"},
+		{Name: "cpu", Default: "1"},
+		{Name: "memory", Default: "1Gi"},
+	}
+	toolchainParameters := map[string]interface{}{"cpu": "2", "memory": "2Gi", "unknown": "value"}
+	applicationParameters := map[string]interface{}{"memory": "4Gi"}
+	joined := (&toolchain{}).join(toolchainParameters, catalogParameters, applicationParameters)
+	assert.Equal(t, map[string]interface{}{
+		"target": "local",
+		"cpu":    "2",
+		"memory": "4Gi",
+	}, joined, "got unexpected joined parameters")
+}
+
+func TestToolchainComponentOverrides(t *testing.T) {
+	catalog := &componentCatalog{
+		Components: map[string]component{
+			"concourse": {Repo: "https://charts.trustacks.io", Chart: "concourse", Version: "17.0.0"},
+			"authentik": {Repo: "https://charts.trustacks.io", Chart: "authentik", Version: "2022.7.2"},
+		},
+	}
+	tc := &toolchain{
+		config: &toolchainConfig{
+			Components: map[string]componentConfig{
+				"concourse": {Version: "16.1.0", Repository: "https://charts.mirror.local"},
+			},
+		},
+	}
+	concourse := tc.component("concourse", catalog)
+	assert.Equal(t, "16.1.0", concourse.Version, "expected the pinned version")
+	assert.Equal(t, "https://charts.mirror.local", concourse.Repo, "expected the repository override")
+	assert.Equal(t, "17.0.0", catalog.Components["concourse"].Version, "expected the catalog to be unmodified")
+	assert.Equal(t, "2022.7.2", tc.component("authentik", catalog).Version, "expected the catalog version")
+}
+
+func TestChartVersion(t *testing.T) {
+	version, err := componentVersion(filepath.Join("testdata", "helloworld"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "1.0.0", version, "got an unexpected chart version")
+}
@@ -0,0 +1,90 @@
+package toolchain
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"sigs.k8s.io/yaml"
+)
+
+// mergeValues deep merges the src values into the dst values and
+// returns the result. Values in src take precedence, and nested maps
+// are merged key by key.
+func mergeValues(dst, src map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(dst))
+	for k, v := range dst {
+		merged[k] = v
+	}
+	for k, v := range src {
+		if srcMap, ok := v.(map[string]interface{}); ok {
+			if dstMap, ok := merged[k].(map[string]interface{}); ok {
+				merged[k] = mergeValues(dstMap, srcMap)
+				continue
+			}
+		}
+		merged[k] = v
+	}
+	return merged
+}
+
+// stringValues converts the top level values to strings. Nested maps
+// and lists are not supported.
+func stringValues(values map[string]interface{}) (map[string]string, error) {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	converted := make(map[string]string, len(values))
+	for _, k := range keys {
+		switch v := values[k].(type) {
+		case map[string]interface{}, []interface{}:
+			return nil, fmt.Errorf("value '%s' must be a string", k)
+		case nil:
+			converted[k] = ""
+		default:
+			converted[k] = fmt.Sprint(v)
+		}
+	}
+	return converted, nil
+}
+
+// applyValueOverrides merges the component config values over the
+// rendered values and applies the component config patches.
+//
+// The rendered values are returned unchanged if the component config
+// has no overrides.
+func applyValueOverrides(rendered []byte, config componentConfig) ([]byte, error) {
+	if len(config.Values) == 0 && len(config.Patches) == 0 {
+		return rendered, nil
+	}
+	values := map[string]interface{}{}
+	if err := yaml.Unmarshal(rendered, &values); err != nil {
+		return nil, err
+	}
+	values = mergeValues(values, config.Values)
+	if len(config.Patches) > 0 {
+		doc, err := json.Marshal(values)
+		if err != nil {
+			return nil, err
+		}
+		ops, err := json.Marshal(config.Patches)
+		if err != nil {
+			return nil, err
+		}
+		patch, err := jsonpatch.DecodePatch(ops)
+		if err != nil {
+			return nil, err
+		}
+		if doc, err = patch.Apply(doc); err != nil {
+			return nil, err
+		}
+		values = map[string]interface{}{}
+		if err := json.Unmarshal(doc, &values); err != nil {
+			return nil, err
+		}
+	}
+	return yaml.Marshal(values)
+}
@@ -0,0 +1,93 @@
+package toolchain
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMergeValues(t *testing.T) {
+	dst := map[string]interface{}{
+		"ci": "concourse",
+		"resources": map[string]interface{}{
+			"cpu":    "1",
+			"memory": "1Gi",
+		},
+	}
+	src := map[string]interface{}{
+		"tls": "true",
+		"resources": map[string]interface{}{
+			"memory": "2Gi",
+		},
+	}
+	merged := mergeValues(dst, src)
+	assert.Equal(t, map[string]interface{}{
+		"ci":  "concourse",
+		"tls": "true",
+		"resources": map[string]interface{}{
+			"cpu":    "1",
+			"memory": "2Gi",
+		},
+	}, merged, "got unexpected merged values")
+	assert.Equal(t, "1Gi", dst["resources"].(map[string]interface{})["memory"], "expected the destination values to be unmodified")
+}
+
+func TestStringValues(t *testing.T) {
+	values, err := stringValues(map[string]interface{}{
+		"name":    "test",
+		"port":    int64(8080),
+		"enabled": true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, map[string]string{"name": "test", "port": "8080", "enabled": "true"}, values, "got unexpected string values")
+
+	_, err = stringValues(map[string]interface{}{"nested": map[string]interface{}{"key": "value"}})
+	assert.ErrorContains(t, err, "value 'nested' must be a string", "expected a nested value error")
+}
+
+func TestApplyValueOverrides(t *testing.T) {
+	rendered := []byte(`web:
+  replicas: 1
+  resources:
+    requests:
+      memory: 256Mi
+worker:
+  replicas: 2
+`)
+	values, err := applyValueOverrides(rendered, componentConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, rendered, values, "expected the rendered values without overrides")
+
+	values, err = applyValueOverrides(rendered, componentConfig{
+		Values: map[string]interface{}{
+			"web": map[string]interface{}{
+				"resources": map[string]interface{}{
+					"requests": map[string]interface{}{"memory": "512Mi"},
+				},
+			},
+		},
+		Patches: []map[string]interface{}{
+			{"op": "replace", "path": "/worker/replicas", "value": 4},
+			{"op": "remove", "path": "/web/replicas"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, `web:
+  resources:
+    requests:
+      memory: 512Mi
+worker:
+  replicas: 4
+`, string(values), "got unexpected overridden values")
+
+	_, err = applyValueOverrides(rendered, componentConfig{
+		Patches: []map[string]interface{}{{"op": "remove", "path": "/missing"}},
+	})
+	assert.NotNil(t, err, "expected a patch error")
+}